@@ -1,47 +1,249 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
-	"github.com/ekomobile/dadata/v2/api/suggest"
-	"github.com/ekomobile/dadata/v2/client"
+	"io"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// droppedResults counts the suggestions AddressSearch filtered out, by reason.
+var droppedResults = expvar.NewMap("geo_dropped_results")
+
 type GeoService struct {
-	api       *suggest.Api
-	apiKey    string
-	secretKey string
+	client   *http.Client
+	endpoint string
+	// guards the API key, which rotates while requests run; the suggestions
+	// API needs no secret key
+	mu     sync.RWMutex
+	apiKey string
+	Filter FilterPolicy
+}
+
+// SetAPIKey replaces the DaData API key. Requests already sent finish with
+// the old one.
+func (g *GeoService) SetAPIKey(apiKey string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.apiKey = apiKey
+}
+
+func (g *GeoService) key() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.apiKey
+}
+
+// FilterPolicy decides which suggestions AddressSearch keeps.
+type FilterPolicy struct {
+	// MinFiasLevel is the coarsest FIAS level that is still returned,
+	// e.g. "7" keeps streets and anything more precise. Empty keeps all.
+	MinFiasLevel string `yaml:"min_fias_level"`
+	// RequireCoords drops suggestions without geo_lat/geo_lon.
+	RequireCoords bool `yaml:"require_coords"`
+}
+
+// DefaultFilterPolicy keeps settlements, villages included, and finer.
+var DefaultFilterPolicy = FilterPolicy{MinFiasLevel: "6"}
+
+// fiasRank orders FIAS levels by precision: planning structures (65) sit
+// between settlements and streets, steads (75) between streets and houses.
+var fiasRank = map[string]int{
+	"-1": 0, "0": 1, "1": 2, "3": 3, "4": 4, "5": 5, "6": 6,
+	"65": 7, "7": 8, "75": 9, "8": 10, "9": 11,
+}
+
+// Allow reports whether the suggestion passes the policy, and the reason if not.
+func (p FilterPolicy) Allow(d *Data) (bool, string) {
+	if p.MinFiasLevel != "" && fiasRank[deref(d.FiasLevel)] < fiasRank[p.MinFiasLevel] {
+		return false, "fias_level"
+	}
+	if p.RequireCoords && (deref(d.GeoLat) == "" || deref(d.GeoLon) == "") {
+		return false, "no_coords"
+	}
+	return true, ""
+}
+
+// Validate checks that MinFiasLevel is a known FIAS level.
+func (p FilterPolicy) Validate() error {
+	if _, ok := fiasRank[p.MinFiasLevel]; p.MinFiasLevel != "" && !ok {
+		return fmt.Errorf("unknown FIAS level %q", p.MinFiasLevel)
+	}
+	return nil
 }
 
 type GeoProvider interface {
-	AddressSearch(input string) ([]*Address, error)
-	GeoCode(lat, lng string) ([]*Address, error)
+	AddressSearch(params SearchParams) ([]*Address, error)
+	GeoCode(params GeocodeParams) ([]*Address, error)
 }
 
-func NewGeoService(apiKey, secretKey string) *GeoService {
-	var err error
-	endpointUrl, err := url.Parse("https://suggestions.dadata.ru/suggestions/api/4_1/rs/")
-	if err != nil {
-		return nil
+// ContextSearcher is implemented by providers whose address search can be
+// cancelled, so a caller that no longer needs the result can abort it.
+type ContextSearcher interface {
+	AddressSearchContext(ctx context.Context, params SearchParams) ([]*Address, error)
+}
+
+// UnsupportedParamError is returned by a provider that can't honour one of
+// the requested search parameters.
+type UnsupportedParamError struct {
+	Provider string
+	Param    string
+}
+
+func (e *UnsupportedParamError) Error() string {
+	return fmt.Sprintf("%s doesn't support the %q parameter", e.Provider, e.Param)
+}
+
+// UpstreamError is returned when a provider answers with a non-2xx status.
+type UpstreamError struct {
+	Provider string
+	Status   int
+	// start of the response body
+	Body string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", e.Provider, e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried later: the
+// provider is rate limiting or failing, rather than rejecting the key.
+func (e *UpstreamError) Temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// SearchParams are the provider-level options of an address search.
+type SearchParams struct {
+	//A search request in JSON format
+	//example: Москва Обуховская 11
+	Query string `json:"query"`
+	//Maximum number of results, 1-20 (default 10)
+	Count int `json:"count,omitempty"`
+	//Restrict results to these regions, cities etc.
+	Locations []SearchLocation `json:"locations,omitempty"`
+	//Rank results from these locations first, only kladr_id is used
+	LocationsBoost []SearchLocation `json:"locations_boost,omitempty"`
+	//Coarsest address part to suggest: country, region, area, city, settlement, street, house, flat
+	FromBound string `json:"from_bound,omitempty"`
+	//Finest address part to suggest, same values as from_bound
+	ToBound string `json:"to_bound,omitempty"`
+	//Result language: ru or en
+	Language string `json:"language,omitempty"`
+}
+
+type SearchLocation struct {
+	CountryISOCode string `json:"country_iso_code,omitempty"`
+	RegionISOCode  string `json:"region_iso_code,omitempty"`
+	KladrID        string `json:"kladr_id,omitempty"`
+	FiasID         string `json:"fias_id,omitempty"`
+	Region         string `json:"region,omitempty"`
+	RegionFiasID   string `json:"region_fias_id,omitempty"`
+	Area           string `json:"area,omitempty"`
+	City           string `json:"city,omitempty"`
+	CityFiasID     string `json:"city_fias_id,omitempty"`
+	Settlement     string `json:"settlement,omitempty"`
+	Street         string `json:"street,omitempty"`
+}
+
+const maxSearchCount = 20
+
+// searchBounds lists the from_bound/to_bound granularities from coarse to fine.
+var searchBounds = []string{"country", "region", "area", "city", "settlement", "street", "house", "flat"}
+
+func boundIndex(b string) int {
+	for i, v := range searchBounds {
+		if v == b {
+			return i
+		}
 	}
+	return -1
+}
 
-	creds := client.Credentials{
-		ApiKeyValue:    apiKey,
-		SecretKeyValue: secretKey,
+// Validate checks the parameters independently of the provider.
+func (p *SearchParams) Validate() error {
+	if p.Count < 0 || p.Count > maxSearchCount {
+		return fmt.Errorf("count must be between 1 and %d", maxSearchCount)
+	}
+	for _, b := range []string{p.FromBound, p.ToBound} {
+		if b != "" && boundIndex(b) < 0 {
+			return fmt.Errorf("unknown bound %q", b)
+		}
 	}
+	if p.FromBound != "" && p.ToBound != "" && boundIndex(p.FromBound) > boundIndex(p.ToBound) {
+		return fmt.Errorf("from_bound %q is finer than to_bound %q", p.FromBound, p.ToBound)
+	}
+	switch p.Language {
+	case "", "ru", "en":
+	default:
+		return fmt.Errorf("unknown language %q", p.Language)
+	}
+	for _, l := range p.Locations {
+		if l == (SearchLocation{}) {
+			return fmt.Errorf("empty location filter")
+		}
+	}
+	for _, l := range p.LocationsBoost {
+		if l.KladrID == "" {
+			return fmt.Errorf("locations_boost needs kladr_id")
+		}
+	}
+	return nil
+}
 
-	api := suggest.Api{
-		Client: client.NewClient(endpointUrl, client.WithCredentialProvider(&creds)),
+// Used lists the optional parameters that are set, by their JSON names.
+func (p *SearchParams) Used() []string {
+	var used []string
+	if p.Count != 0 {
+		used = append(used, "count")
+	}
+	if len(p.Locations) > 0 {
+		used = append(used, "locations")
 	}
+	if len(p.LocationsBoost) > 0 {
+		used = append(used, "locations_boost")
+	}
+	if p.FromBound != "" {
+		used = append(used, "from_bound")
+	}
+	if p.ToBound != "" {
+		used = append(used, "to_bound")
+	}
+	if p.Language != "" {
+		used = append(used, "language")
+	}
+	return used
+}
 
+// Require returns an UnsupportedParamError for the first parameter in use
+// that isn't in the provider's supported list.
+func (p *SearchParams) Require(provider string, supported ...string) error {
+	for _, param := range p.Used() {
+		found := false
+		for _, s := range supported {
+			if s == param {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &UnsupportedParamError{Provider: provider, Param: param}
+		}
+	}
+	return nil
+}
+
+func NewGeoService(apiKey string) *GeoService {
 	return &GeoService{
-		api:       &api,
-		apiKey:    apiKey,
-		secretKey: secretKey,
+		client:   &http.Client{},
+		endpoint: "https://suggestions.dadata.ru/suggestions/api/4_1/rs/",
+		apiKey:   apiKey,
+		Filter:   DefaultFilterPolicy,
 	}
 }
 
@@ -51,56 +253,220 @@ type Address struct {
 	House  string `json:"house"`
 	Lat    string `json:"lat"`
 	Lon    string `json:"lon"`
+	// distance from the reverse geocoding query point
+	Distance *float64 `json:"distance_meters,omitempty"`
+	// zones containing the address, only with zones=true
+	Zones []ZoneRef `json:"zones,omitempty"`
+	// extended fields, only serialized with detail=full
+	*AddressDetails
 }
 
-func (g *GeoService) AddressSearch(input string) ([]*Address, error) {
-	var res []*Address
-	rawRes, err := g.api.Address(context.Background(), &suggest.RequestParams{Query: input})
+type AddressDetails struct {
+	Value              string         `json:"value"`
+	UnrestrictedValue  string         `json:"unrestricted_value"`
+	PostalCode         string         `json:"postal_code"`
+	Country            string         `json:"country"`
+	Region             string         `json:"region"`
+	RegionWithType     string         `json:"region_with_type"`
+	Area               string         `json:"area"`
+	AreaWithType       string         `json:"area_with_type"`
+	Settlement         string         `json:"settlement"`
+	SettlementWithType string         `json:"settlement_with_type"`
+	CityDistrict       string         `json:"city_district"`
+	StreetWithType     string         `json:"street_with_type"`
+	Block              string         `json:"block"`
+	BlockType          string         `json:"block_type"`
+	Flat               string         `json:"flat"`
+	FlatType           string         `json:"flat_type"`
+	RegionFiasID       string         `json:"region_fias_id"`
+	AreaFiasID         string         `json:"area_fias_id"`
+	CityFiasID         string         `json:"city_fias_id"`
+	SettlementFiasID   string         `json:"settlement_fias_id"`
+	StreetFiasID       string         `json:"street_fias_id"`
+	HouseFiasID        string         `json:"house_fias_id"`
+	FiasID             string         `json:"fias_id"`
+	FiasLevel          string         `json:"fias_level"`
+	KladrID            string         `json:"kladr_id"`
+	Okato              string         `json:"okato"`
+	Oktmo              string         `json:"oktmo"`
+	Timezone           string         `json:"timezone"`
+	QcGeo              string         `json:"qc_geo"`
+	Metro              []MetroStation `json:"metro"`
+}
+
+type MetroStation struct {
+	Name     string  `json:"name"`
+	Line     string  `json:"line"`
+	Distance float64 `json:"distance"`
+}
+
+// Compact returns a copy of the address without the extended fields.
+func (a *Address) Compact() *Address {
+	return &Address{City: a.City, Street: a.Street, House: a.House, Lat: a.Lat, Lon: a.Lon, Distance: a.Distance}
+}
+
+func (g *GeoService) AddressSearch(params SearchParams) ([]*Address, error) {
+	return g.AddressSearchContext(context.Background(), params)
+}
+
+func (g *GeoService) AddressSearchContext(ctx context.Context, params SearchParams) ([]*Address, error) {
+	err := params.Require("dadata", "count", "locations", "locations_boost", "from_bound", "to_bound", "language")
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{"query": params.Query}
+	if params.Count != 0 {
+		body["count"] = params.Count
+	}
+	if len(params.Locations) > 0 {
+		body["locations"] = params.Locations
+	}
+	if len(params.LocationsBoost) > 0 {
+		body["locations_boost"] = params.LocationsBoost
+	}
+	if params.FromBound != "" {
+		body["from_bound"] = map[string]string{"value": params.FromBound}
+	}
+	if params.ToBound != "" {
+		body["to_bound"] = map[string]string{"value": params.ToBound}
+	}
+	if params.Language != "" {
+		body["language"] = params.Language
+	}
+
+	geoCode, err := g.suggest(ctx, "suggest/address", body)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, r := range rawRes {
-		if r.Data.City == "" || r.Data.Street == "" {
+	var res []*Address
+	for _, r := range geoCode.Suggestions {
+		if ok, reason := g.Filter.Allow(&r.Data); !ok {
+			droppedResults.Add(reason, 1)
 			continue
 		}
-		res = append(res, &Address{City: r.Data.City, Street: r.Data.Street, House: r.Data.House, Lat: r.Data.GeoLat, Lon: r.Data.GeoLon})
+		res = append(res, r.Address())
 	}
 
 	return res, nil
 }
 
-func (g *GeoService) GeoCode(lat, lng string) ([]*Address, error) {
-	httpClient := &http.Client{}
-	var data = strings.NewReader(fmt.Sprintf(`{"lat": %s, "lon": %s}`, lat, lng))
-	req, err := http.NewRequest("POST", "https://suggestions.dadata.ru/suggestions/api/4_1/rs/geolocate/address", data)
+// GeocodeParams are the provider-level options of a reverse geocoding request.
+type GeocodeParams struct {
+	//latitude
+	Lat string `json:"lat"`
+	//longitude
+	Lng string `json:"lng"`
+	//Search radius in meters, 1-1000 (default 100)
+	RadiusMeters int `json:"radius_meters,omitempty"`
+	//Maximum number of results, 1-20 (default 10)
+	Count int `json:"count,omitempty"`
+}
+
+const (
+	defaultGeocodeRadius = 100
+	maxGeocodeRadius     = 1000
+	defaultGeocodeCount  = 10
+)
+
+// coordinates parses the latitude and longitude, which arrive as strings.
+func (p *GeocodeParams) coordinates() (lat, lng float64, err error) {
+	lat, err = strconv.ParseFloat(p.Lat, 64)
+	// written so that NaN fails too
+	if err != nil || !(lat >= -90 && lat <= 90) {
+		return 0, 0, fmt.Errorf("lat must be a number between -90 and 90")
+	}
+	lng, err = strconv.ParseFloat(p.Lng, 64)
+	if err != nil || !(lng >= -180 && lng <= 180) {
+		return 0, 0, fmt.Errorf("lng must be a number between -180 and 180")
+	}
+	return lat, lng, nil
+}
+
+// Validate checks the coordinates, radius and count; zero radius and count
+// mean the defaults.
+func (p *GeocodeParams) Validate() error {
+	_, _, err := p.coordinates()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", g.apiKey))
-	resp, err := httpClient.Do(req)
+	if p.RadiusMeters < 0 || p.RadiusMeters > maxGeocodeRadius {
+		return fmt.Errorf("radius_meters must be between 1 and %d", maxGeocodeRadius)
+	}
+	if p.Count < 0 || p.Count > maxSearchCount {
+		return fmt.Errorf("count must be between 1 and %d", maxSearchCount)
+	}
+	return nil
+}
+
+// WithDefaults returns a copy with unset radius and count filled in.
+func (p GeocodeParams) WithDefaults() GeocodeParams {
+	if p.RadiusMeters == 0 {
+		p.RadiusMeters = defaultGeocodeRadius
+	}
+	if p.Count == 0 {
+		p.Count = defaultGeocodeCount
+	}
+	return p
+}
+
+// geolocateRequest is the body of a DaData reverse geocoding request.
+type geolocateRequest struct {
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	RadiusMeters int     `json:"radius_meters"`
+	Count        int     `json:"count"`
+}
+
+func (g *GeoService) GeoCode(params GeocodeParams) ([]*Address, error) {
+	params = params.WithDefaults()
+	lat, lng, err := params.coordinates()
 	if err != nil {
 		return nil, err
 	}
-	var geoCode GeoCode
-
-	err = json.NewDecoder(resp.Body).Decode(&geoCode)
+	data := geolocateRequest{Lat: lat, Lon: lng, RadiusMeters: params.RadiusMeters, Count: params.Count}
+	geoCode, err := g.suggest(context.Background(), "geolocate/address", data)
 	if err != nil {
 		return nil, err
 	}
+
 	var res []*Address
 	for _, r := range geoCode.Suggestions {
-		var address Address
-		address.City = string(r.Data.City)
-		address.Street = string(r.Data.Street)
-		address.House = r.Data.House
-		address.Lat = r.Data.GeoLat
-		address.Lon = r.Data.GeoLon
-
-		res = append(res, &address)
+		res = append(res, r.Address())
 	}
+	setDistances(res, params.Lat, params.Lng)
 
 	return res, nil
 }
+
+// suggest posts a request to one of the DaData suggestions endpoints. Both
+// address search and reverse geocoding answer with the same suggestion schema.
+func (g *GeoService) suggest(ctx context.Context, method string, body interface{}) (*GeoCode, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", g.endpoint+method, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", g.key()))
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return nil, &UpstreamError{Provider: "dadata", Status: resp.StatusCode, Body: strings.TrimSpace(string(snippet))}
+	}
+
+	var geoCode GeoCode
+	err = json.NewDecoder(resp.Body).Decode(&geoCode)
+	if err != nil {
+		return nil, err
+	}
+	return &geoCode, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeDaData returns a GeoService talking to a local server that replies
+// with the recorded response from testdata.
+func newFakeDaData(t *testing.T, file string) *GeoService {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	}))
+	t.Cleanup(srv.Close)
+
+	geo := NewGeoService("key")
+	geo.endpoint = srv.URL + "/"
+	return geo
+}
+
+func TestAddressSearch_filterPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		policy   FilterPolicy
+		want     int
+		locality string
+		reason   string
+	}{
+		{"rural settlement kept", "suggest_rural_settlement.json", DefaultFilterPolicy, 1, "Жуковка", ""},
+		{"street without house kept", "suggest_missing_house.json", DefaultFilterPolicy, 1, "Москва", ""},
+		{"street dropped by house level", "suggest_missing_house.json", FilterPolicy{MinFiasLevel: "8"}, 0, "", "fias_level"},
+		{"no policy", "suggest_missing_house.json", FilterPolicy{}, 1, "Москва", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			geo := newFakeDaData(t, tt.file)
+			geo.Filter = tt.policy
+
+			var before int64
+			if tt.reason != "" {
+				if v := droppedResults.Get(tt.reason); v != nil {
+					before = v.(*expvar.Int).Value()
+				}
+			}
+
+			addresses, err := geo.AddressSearch(SearchParams{Query: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addresses) != tt.want {
+				t.Fatalf("expected %d addresses but got %d", tt.want, len(addresses))
+			}
+			if tt.want > 0 && addresses[0].City != tt.locality {
+				t.Errorf("expected locality %q but got %q", tt.locality, addresses[0].City)
+			}
+			if tt.reason != "" {
+				after := droppedResults.Get(tt.reason).(*expvar.Int).Value()
+				if after != before+1 {
+					t.Errorf("dropped counter %q not incremented", tt.reason)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterPolicy_requireCoords(t *testing.T) {
+	policy := FilterPolicy{RequireCoords: true}
+	lat := "55.1"
+	if ok, reason := policy.Allow(&Data{GeoLat: &lat}); ok || reason != "no_coords" {
+		t.Errorf("expected no_coords, got %v %q", ok, reason)
+	}
+	for level, want := range map[string]bool{"4": false, "6": true, "65": true, "7": true, "8": true} {
+		if ok, _ := DefaultFilterPolicy.Allow(&Data{FiasLevel: &level}); ok != want {
+			t.Errorf("default policy, FIAS level %s: got %v", level, ok)
+		}
+	}
+	if err := (FilterPolicy{MinFiasLevel: "42"}).Validate(); err == nil {
+		t.Error("expected error for unknown FIAS level")
+	}
+}
+
+func TestSearchParams_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  SearchParams
+		wantErr bool
+	}{
+		{"query only", SearchParams{Query: "Москва"}, false},
+		{"all params", SearchParams{Query: "Москва", Count: 5, Locations: []SearchLocation{{City: "Москва"}}, LocationsBoost: []SearchLocation{{KladrID: "77"}}, FromBound: "street", ToBound: "house", Language: "en"}, false},
+		{"count too big", SearchParams{Count: 21}, true},
+		{"negative count", SearchParams{Count: -1}, true},
+		{"unknown bound", SearchParams{FromBound: "planet"}, true},
+		{"bounds reversed", SearchParams{FromBound: "house", ToBound: "city"}, true},
+		{"unknown language", SearchParams{Language: "de"}, true},
+		{"empty location", SearchParams{Locations: []SearchLocation{{}}}, true},
+		{"boost without kladr_id", SearchParams{LocationsBoost: []SearchLocation{{City: "Москва"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.params.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSearchParams_Require(t *testing.T) {
+	params := SearchParams{Query: "Москва", Count: 3, Language: "en"}
+	if err := params.Require("test", "count", "language"); err != nil {
+		t.Error(err)
+	}
+	err := params.Require("test", "count")
+	var unsupported *UnsupportedParamError
+	if !errors.As(err, &unsupported) || unsupported.Param != "language" {
+		t.Errorf("expected unsupported language, got %v", err)
+	}
+}
+
+func TestAddressSearch_params(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"suggestions": []}`))
+	}))
+	defer srv.Close()
+	geo := NewGeoService("key")
+	geo.endpoint = srv.URL + "/"
+
+	_, err := geo.AddressSearch(SearchParams{Query: "Москва", Count: 5, FromBound: "street", Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["count"] != float64(5) || body["language"] != "en" {
+		t.Errorf("params not sent upstream: %v", body)
+	}
+	if bound, _ := body["from_bound"].(map[string]interface{}); bound["value"] != "street" {
+		t.Errorf("wrong from_bound: %v", body["from_bound"])
+	}
+	if _, ok := body["to_bound"]; ok {
+		t.Error("unset to_bound should not be sent")
+	}
+}
+
+func TestGeocodeParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  GeocodeParams
+		wantErr bool
+	}{
+		{"defaults", GeocodeParams{Lat: "55.878", Lng: "37.653"}, false},
+		{"radius and count", GeocodeParams{Lat: "-90", Lng: "180", RadiusMeters: 1000, Count: 20}, false},
+		{"radius too big", GeocodeParams{Lat: "55.878", Lng: "37.653", RadiusMeters: 1001}, true},
+		{"negative radius", GeocodeParams{Lat: "55.878", Lng: "37.653", RadiusMeters: -5}, true},
+		{"count too big", GeocodeParams{Lat: "55.878", Lng: "37.653", Count: 50}, true},
+		{"missing lat", GeocodeParams{Lng: "37.653"}, true},
+		{"lat out of range", GeocodeParams{Lat: "90.1", Lng: "37.653"}, true},
+		{"lng out of range", GeocodeParams{Lat: "55.878", Lng: "-180.5"}, true},
+		{"not a number", GeocodeParams{Lat: "NaN", Lng: "37.653"}, true},
+		{"injection", GeocodeParams{Lat: `55, "count": 1000`, Lng: "37.653"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.params.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	p := GeocodeParams{Count: 3}.WithDefaults()
+	if p.RadiusMeters != defaultGeocodeRadius || p.Count != 3 {
+		t.Errorf("wrong defaults %+v", p)
+	}
+}
+
+func TestGeoCode_radiusAndDistance(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "geolocate_metro.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write(raw)
+	}))
+	defer srv.Close()
+	geo := NewGeoService("key")
+	geo.endpoint = srv.URL + "/"
+
+	addresses, err := geo.GeoCode(GeocodeParams{Lat: "55.878", Lng: "37.653", RadiusMeters: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["lat"] != 55.878 || body["lon"] != 37.653 ||
+		body["radius_meters"] != float64(250) || body["count"] != float64(defaultGeocodeCount) {
+		t.Errorf("wrong upstream params: %v", body)
+	}
+	if len(addresses) != 1 || addresses[0].Distance == nil || *addresses[0].Distance != 53 {
+		t.Errorf("distance not computed: %+v", addresses)
+	}
+
+	// coordinates are numbers, never spliced into the body
+	body = nil
+	_, err = geo.GeoCode(GeocodeParams{Lat: `55.878, "count": 1000, "x": 1`, Lng: "37.653"})
+	if err == nil || body != nil {
+		t.Errorf("injected coordinates reached DaData: %v %v", err, body)
+	}
+}
+
+// TestGeoService_upstreamStatus checks that DaData errors are not mistaken
+// for empty results and reach the client as gateway errors.
+func TestGeoService_upstreamStatus(t *testing.T) {
+	tests := []struct {
+		status     int
+		temporary  bool
+		wantStatus int
+	}{
+		{http.StatusUnauthorized, false, http.StatusBadGateway},
+		{http.StatusForbidden, false, http.StatusBadGateway},
+		{http.StatusTooManyRequests, true, http.StatusServiceUnavailable},
+		{http.StatusInternalServerError, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"suggestions":[],"message":"` + strings.Repeat("x", 1000) + `"}`))
+			}))
+			defer srv.Close()
+			geo := NewGeoService("key")
+			geo.endpoint = srv.URL + "/"
+
+			_, err := geo.AddressSearch(SearchParams{Query: "test"})
+			var upstream *UpstreamError
+			if !errors.As(err, &upstream) || upstream.Status != tt.status || upstream.Temporary() != tt.temporary {
+				t.Fatalf("got %v", err)
+			}
+			if len(upstream.Body) > 256 || !strings.HasPrefix(upstream.Body, `{"suggestions"`) {
+				t.Errorf("body snippet %q", upstream.Body)
+			}
+			_, err = geo.GeoCode(GeocodeParams{Lat: "55.878", Lng: "37.653"})
+			if !errors.As(err, &upstream) {
+				t.Errorf("geocode: got %v", err)
+			}
+
+			app := &application{geo: geo, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/address/search", strings.NewReader(`{"query":"test"}`))
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app.setupRouter().ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("handler: got %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	autocompleteDebounce  = 150 * time.Millisecond
+	autocompleteMinLength = 3
+	autocompleteCount     = 10
+	autocompletePongWait  = 60 * time.Second
+	autocompleteWriteWait = 10 * time.Second
+	autocompleteMaxQuery  = 300
+)
+
+// upgrader keeps gorilla's default same-origin check: the socket is
+// authenticated by cookie, so a foreign page must not be able to open it.
+var upgrader = websocket.Upgrader{}
+
+// AutocompleteMessage is what the client sends on every keystroke.
+type AutocompleteMessage struct {
+	Query string `json:"query"`
+	// 1..20, default 10
+	Count int `json:"count"`
+}
+
+// AutocompleteResult is pushed for the latest query once it settles.
+type AutocompleteResult struct {
+	Query     string     `json:"query"`
+	Addresses []*Address `json:"addresses"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// rankSuggestions orders suggestions by how many query words they contain,
+// keeping the provider's order among equals.
+func rankSuggestions(query string, addresses []*Address) []*Address {
+	words := addressWords(query)
+	score := func(a *Address) int {
+		text := strings.Join([]string{a.City, a.Street, a.House}, " ")
+		if a.AddressDetails != nil {
+			text = a.UnrestrictedValue
+		}
+		return matchedWords(words, text)
+	}
+	sort.SliceStable(addresses, func(i, j int) bool { return score(addresses[i]) > score(addresses[j]) })
+	return addresses
+}
+
+// searchContext runs an address search that stops when ctx is cancelled. A
+// provider without ContextSearcher support keeps running in the background,
+// but its result is dropped.
+func (app *application) searchContext(ctx context.Context, params SearchParams) ([]*Address, error) {
+	if cs, ok := app.geo.(ContextSearcher); ok {
+		return cs.AddressSearchContext(ctx, params)
+	}
+	type result struct {
+		addresses []*Address
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		addresses, err := app.geo.AddressSearch(params)
+		done <- result{addresses, err}
+	}()
+	select {
+	case res := <-done:
+		return res.addresses, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (app *application) AutocompleteHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route GET /address/autocomplete Autocomplete
+	// swagger:operation GET /address/autocomplete Autocomplete
+	//
+	// WebSocket autocomplete: send {"query": ".."} per keystroke, receive ranked addresses for the latest query
+	//
+	//
+	//
+	// ---
+	// responses:
+	//   '101':
+	//     description: switching to the WebSocket protocol
+	//   '400':
+	//      description: not a WebSocket handshake
+	//      schema:
+	//	        type: string
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(4096)
+	// the client is pinged twice per pongWait; a peer that neither answers
+	// nor writes lets the deadline pass, and the read below fails
+	pongWait := app.pongWait
+	if pongWait <= 0 {
+		pongWait = autocompletePongWait
+	}
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// the reader only decodes; all writes happen in the loop below, since a
+	// connection supports one concurrent writer
+	messages := make(chan AutocompleteMessage)
+	go func() {
+		defer cancel()
+		for {
+			var msg AutocompleteMessage
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if !errors.As(err, &closeErr) && !errors.Is(err, context.Canceled) {
+					app.logger.Debug("autocomplete read", "error", err.Error())
+				}
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(pongWait))
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	type searchResult struct {
+		seq int
+		res AutocompleteResult
+	}
+	results := make(chan searchResult, 1)
+	var (
+		pending      *AutocompleteMessage
+		seq          int
+		cancelSearch = func() {}
+	)
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	ping := time.NewTicker(pongWait / 2)
+	defer ping.Stop()
+	defer func() { cancelSearch() }()
+
+	write := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(autocompleteWriteWait))
+		return conn.WriteJSON(v)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-messages:
+			// a newer prefix makes the in-flight search stale
+			cancelSearch()
+			seq++
+			msg.Query = strings.TrimSpace(msg.Query)
+			pending = &msg
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(autocompleteDebounce)
+
+		case <-debounce.C:
+			if pending == nil {
+				continue
+			}
+			msg := *pending
+			pending = nil
+			if utf8.RuneCountInString(msg.Query) < autocompleteMinLength {
+				if write(AutocompleteResult{Query: msg.Query, Addresses: []*Address{}}) != nil {
+					return
+				}
+				continue
+			}
+			params := SearchParams{Query: msg.Query, Count: msg.Count}
+			if params.Count == 0 {
+				params.Count = autocompleteCount
+			}
+			if utf8.RuneCountInString(msg.Query) > autocompleteMaxQuery {
+				params.Query = string([]rune(msg.Query)[:autocompleteMaxQuery])
+			}
+			if err := params.Validate(); err != nil {
+				if write(AutocompleteResult{Query: msg.Query, Error: err.Error()}) != nil {
+					return
+				}
+				continue
+			}
+
+			searchCtx, stop := context.WithCancel(ctx)
+			cancelSearch = stop
+			go func(seq int, sctx context.Context) {
+				addresses, err := app.searchContext(sctx, params)
+				res := AutocompleteResult{Query: msg.Query}
+				if err != nil {
+					if sctx.Err() != nil {
+						return
+					}
+					app.logger.Error(err.Error())
+					res.Error = "search failed"
+				} else {
+					res.Addresses = withDetail(rankSuggestions(msg.Query, addresses), false)
+				}
+				select {
+				case results <- searchResult{seq: seq, res: res}:
+				case <-sctx.Done():
+				}
+			}(seq, searchCtx)
+
+		case r := <-results:
+			if r.seq != seq {
+				continue
+			}
+			if write(r.res) != nil {
+				return
+			}
+
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(autocompleteWriteWait))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ctxGeoService is a provider with cancellable search.
+type ctxGeoService struct {
+	MockGeoService
+	mu        sync.Mutex
+	queries   []string
+	cancelled []string
+}
+
+func (m *ctxGeoService) AddressSearchContext(ctx context.Context, params SearchParams) ([]*Address, error) {
+	m.mu.Lock()
+	m.queries = append(m.queries, params.Query)
+	m.mu.Unlock()
+	if strings.HasPrefix(params.Query, "медленно") {
+		<-ctx.Done()
+		m.mu.Lock()
+		m.cancelled = append(m.cancelled, params.Query)
+		m.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	return []*Address{
+		{City: "Тверь", AddressDetails: &AddressDetails{UnrestrictedValue: "г Тверь"}},
+		{City: "Москва", Street: "Тверская", AddressDetails: &AddressDetails{UnrestrictedValue: "г Москва, ул Тверская"}},
+	}, nil
+}
+
+func (m *ctxGeoService) calls() ([]string, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.queries...), append([]string(nil), m.cancelled...)
+}
+
+func dialAutocomplete(t *testing.T, srv *httptest.Server, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/address/autocomplete"
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+func authHeader() http.Header {
+	return http.Header{"Cookie": {"jwt=" + GenerateToken("test")}}
+}
+
+func readResult(t *testing.T, conn *websocket.Conn) AutocompleteResult {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var res AutocompleteResult
+	if err := conn.ReadJSON(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAutocomplete(t *testing.T) {
+	geo := &ctxGeoService{}
+	app := &application{geo: geo, logger: slog.New(slog.NewTextHandler(os.Stdout, nil))}
+	srv := httptest.NewServer(app.setupRouter())
+	defer srv.Close()
+
+	t.Run("requires the jwt cookie", func(t *testing.T) {
+		_, resp, err := dialAutocomplete(t, srv, nil)
+		if err == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected a 403 handshake failure, got %v", err)
+		}
+	})
+
+	t.Run("rejects foreign origins", func(t *testing.T) {
+		h := authHeader()
+		h.Set("Origin", "http://evil.example")
+		_, resp, err := dialAutocomplete(t, srv, h)
+		if err == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected a 403 handshake failure, got %v", err)
+		}
+	})
+
+	conn, _, err := dialAutocomplete(t, srv, authHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Run("debounces keystrokes and ranks", func(t *testing.T) {
+		for _, q := range []string{"Тве", "Твер", "Тверская"} {
+			conn.WriteJSON(AutocompleteMessage{Query: q})
+		}
+		res := readResult(t, conn)
+		if res.Query != "Тверская" || len(res.Addresses) != 2 {
+			t.Fatalf("wrong result %+v", res)
+		}
+		if res.Addresses[0].Street != "Тверская" {
+			t.Errorf("expected the better match first, got %+v", res.Addresses[0])
+		}
+		if res.Addresses[0].AddressDetails != nil {
+			t.Error("expected compact addresses")
+		}
+		if queries, _ := geo.calls(); len(queries) != 1 || queries[0] != "Тверская" {
+			t.Errorf("expected a single search for the settled prefix, got %v", queries)
+		}
+	})
+
+	t.Run("short prefix", func(t *testing.T) {
+		conn.WriteJSON(AutocompleteMessage{Query: "Тв"})
+		res := readResult(t, conn)
+		if res.Query != "Тв" || len(res.Addresses) != 0 {
+			t.Errorf("wrong result %+v", res)
+		}
+	})
+
+	t.Run("cancels stale searches", func(t *testing.T) {
+		conn.WriteJSON(AutocompleteMessage{Query: "медленно"})
+		time.Sleep(3 * autocompleteDebounce)
+		conn.WriteJSON(AutocompleteMessage{Query: "Тверская 1"})
+
+		res := readResult(t, conn)
+		if res.Query != "Тверская 1" {
+			t.Errorf("expected only the newest result, got %+v", res)
+		}
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, cancelled := geo.calls(); len(cancelled) == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("stale search was not cancelled")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestAutocomplete_pongWait(t *testing.T) {
+	app := &application{geo: &ctxGeoService{}, logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), pongWait: 200 * time.Millisecond}
+	srv := httptest.NewServer(app.setupRouter())
+	defer srv.Close()
+
+	// a client that keeps reading answers the pings and stays connected
+	alive, _, err := dialAutocomplete(t, srv, authHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	results := make(chan AutocompleteResult)
+	go func() {
+		defer close(results)
+		for {
+			var res AutocompleteResult
+			if alive.ReadJSON(&res) != nil {
+				return
+			}
+			results <- res
+		}
+	}()
+
+	// a client that never reads leaves the pings unanswered
+	silent, _, err := dialAutocomplete(t, srv, authHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	time.Sleep(5 * app.pongWait)
+
+	alive.WriteJSON(AutocompleteMessage{Query: "Тверь"})
+	select {
+	case res, ok := <-results:
+		if !ok || res.Query != "Тверь" {
+			t.Errorf("answering client: got %+v, open %v", res, ok)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("answering client: no result")
+	}
+
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := silent.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Error("silent client was not disconnected")
+		}
+		break
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	strategyRoundRobin     = "round_robin"
+	strategyLeastConn      = "least_conn"
+	strategyConsistentHash = "consistent_hash"
+
+	// points per upstream on the consistent hash ring
+	hashReplicas = 100
+
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultMaxFails       = 3
+	defaultEjectFor       = 30 * time.Second
+)
+
+// Duration is a time.Duration written as a string such as "10s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// HealthCheckConfig enables periodic probes of every upstream of a route.
+type HealthCheckConfig struct {
+	// requested on each upstream, e.g. /healthz
+	Path string `json:"path"`
+	// default 200
+	ExpectedStatus int `json:"expected_status"`
+	// default 10s
+	Interval Duration `json:"interval"`
+	// default 2s
+	Timeout Duration `json:"timeout"`
+}
+
+// OutlierConfig ejects an upstream after consecutive failed requests.
+type OutlierConfig struct {
+	// 5xx responses or transport errors in a row, default 3
+	MaxFails int `json:"max_fails"`
+	// default 30s
+	EjectFor Duration `json:"eject_for"`
+}
+
+// upstream is one instance of a route's pool with its health state.
+type upstream struct {
+	url *url.URL
+	// set by active health checks
+	healthy atomic.Bool
+	// requests in flight
+	active atomic.Int64
+	// consecutive failed requests
+	fails atomic.Int64
+	// unix nanoseconds until which passive checks have ejected the upstream
+	ejectedUntil atomic.Int64
+}
+
+func newUpstream(u *url.URL) *upstream {
+	up := &upstream{url: u}
+	up.healthy.Store(true)
+	return up
+}
+
+func (up *upstream) available(now time.Time) bool {
+	return up.healthy.Load() && now.UnixNano() >= up.ejectedUntil.Load()
+}
+
+// keepUpstreams carries the upstreams still configured over from prev, so a
+// reload resets neither their health and ejections nor the requests in
+// flight that least_conn counts. Upstreams are matched by URL.
+func (t *routeTable) keepUpstreams(prev *routeTable) {
+	old := make(map[string]*upstream)
+	for _, rt := range prev.routes {
+		for _, up := range rt.upstreams {
+			if _, ok := old[up.url.String()]; !ok {
+				old[up.url.String()] = up
+			}
+		}
+	}
+	for _, rt := range t.routes {
+		for i, up := range rt.upstreams {
+			kept, ok := old[up.url.String()]
+			if !ok {
+				continue
+			}
+			if rt.health == nil {
+				// no probe would ever mark it healthy again
+				kept.healthy.Store(true)
+			}
+			rt.upstreams[i] = kept
+		}
+	}
+}
+
+// done records the outcome of a proxied request for outlier ejection.
+func (rt *route) done(up *upstream, failed bool) {
+	if !failed {
+		up.fails.Store(0)
+		return
+	}
+	if rt.outlier == nil {
+		return
+	}
+	if up.fails.Add(1) >= int64(rt.outlier.MaxFails) {
+		up.fails.Store(0)
+		up.ejectedUntil.Store(time.Now().Add(time.Duration(rt.outlier.EjectFor)).UnixNano())
+	}
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream int
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func buildRing(upstreams []*upstream) []ringPoint {
+	ring := make([]ringPoint, 0, len(upstreams)*hashReplicas)
+	for i, up := range upstreams {
+		for j := 0; j < hashReplicas; j++ {
+			ring = append(ring, ringPoint{hash: hash32(up.url.String() + "#" + strconv.Itoa(j)), upstream: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// key returns what consistent hashing keys a request on.
+func (rt *route) key(r *http.Request) string {
+	switch rt.hashKey {
+	case "", "ip":
+		if addr, ok := clientAddr(r); ok {
+			return addr.String()
+		}
+		return r.RemoteAddr
+	case "path":
+		return r.URL.Path
+	default:
+		return r.Header.Get(rt.hashKey)
+	}
+}
+
+// pick chooses an upstream for r among the available ones. When none is
+// available every upstream is tried, since a wrong health verdict is better
+// than a certain 502.
+func (rt *route) pick(r *http.Request) *upstream {
+	if len(rt.upstreams) == 1 {
+		return rt.upstreams[0]
+	}
+	now := time.Now()
+	ok := make([]bool, len(rt.upstreams))
+	var candidates []*upstream
+	for i, up := range rt.upstreams {
+		if up.available(now) {
+			ok[i] = true
+			candidates = append(candidates, up)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = rt.upstreams
+		for i := range ok {
+			ok[i] = true
+		}
+	}
+
+	switch rt.strategy {
+	case strategyConsistentHash:
+		h := hash32(rt.key(r))
+		i := sort.Search(len(rt.ring), func(i int) bool { return rt.ring[i].hash >= h })
+		for n := 0; n < len(rt.ring); n++ {
+			p := rt.ring[(i+n)%len(rt.ring)]
+			if ok[p.upstream] {
+				return rt.upstreams[p.upstream]
+			}
+		}
+	case strategyLeastConn:
+		// start at a rotating offset so ties are spread
+		start := int(atomic.AddUint64(&rt.next, 1) % uint64(len(candidates)))
+		best := candidates[start]
+		for n := 1; n < len(candidates); n++ {
+			up := candidates[(start+n)%len(candidates)]
+			if up.active.Load() < best.active.Load() {
+				best = up
+			}
+		}
+		return best
+	}
+	n := atomic.AddUint64(&rt.next, 1)
+	return candidates[(n-1)%uint64(len(candidates))]
+}
+
+// healthCheck probes the route's upstreams until ctx is done.
+func (rt *route) healthCheck(ctx context.Context, transport http.RoundTripper) {
+	hc := rt.health
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(hc.Timeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	probe := func(up *upstream) {
+		u := *up.url
+		u.Path = u.Path + hc.Path
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				up.healthy.Store(false)
+			}
+			return
+		}
+		resp.Body.Close()
+		up.healthy.Store(resp.StatusCode == hc.ExpectedStatus)
+	}
+
+	ticker := time.NewTicker(time.Duration(hc.Interval))
+	defer ticker.Stop()
+	for {
+		for _, up := range rt.upstreams {
+			go probe(up)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UpstreamStatus is the health of one upstream.
+type UpstreamStatus struct {
+	URL string `json:"url"`
+	// false after a failed health check
+	Healthy bool `json:"healthy"`
+	// set while passive checks keep the upstream out of rotation
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Active       int64      `json:"active_requests"`
+	Fails        int64      `json:"consecutive_failures"`
+}
+
+// RouteStatus is the state of one proxied route.
+type RouteStatus struct {
+	Host      string           `json:"host,omitempty"`
+	Prefix    string           `json:"prefix"`
+	Strategy  string           `json:"strategy"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// Status reports the upstreams of every proxied route.
+func (rp *ReverseProxy) Status() []RouteStatus {
+	now := time.Now()
+	res := []RouteStatus{}
+	for _, rt := range rp.table.Load().routes {
+		if len(rt.upstreams) == 0 {
+			continue
+		}
+		rs := RouteStatus{Host: rt.host, Prefix: rt.prefix, Strategy: rt.strategy}
+		for _, up := range rt.upstreams {
+			us := UpstreamStatus{
+				URL:     up.url.String(),
+				Healthy: up.healthy.Load(),
+				Active:  up.active.Load(),
+				Fails:   up.fails.Load(),
+			}
+			if until := up.ejectedUntil.Load(); until > now.UnixNano() {
+				t := time.Unix(0, until).UTC()
+				us.EjectedUntil = &t
+			}
+			rs.Upstreams = append(rs.Upstreams, us)
+		}
+		res = append(res, rs)
+	}
+	return res
+}
+
+func (app *application) UpstreamStatusHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON, _ := json.Marshal(app.proxy.Status())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
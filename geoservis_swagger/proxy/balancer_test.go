@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRoute(t *testing.T, strategy string, n int) *route {
+	t.Helper()
+	rc := RouteConfig{Strategy: strategy}
+	for i := 0; i < n; i++ {
+		rc.Upstreams = append(rc.Upstreams, fmt.Sprintf("http://u%d:80", i))
+	}
+	tbl, err := (&ProxyConfig{Routes: []RouteConfig{rc}}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tbl.routes[0]
+}
+
+func pickHost(rt *route, r *http.Request) string {
+	return rt.pick(r).url.Host
+}
+
+func TestRoute_pick(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	t.Run("round robin skips unavailable", func(t *testing.T) {
+		rt := testRoute(t, "", 3)
+		rt.upstreams[1].healthy.Store(false)
+		var got []string
+		for i := 0; i < 4; i++ {
+			got = append(got, pickHost(rt, r))
+		}
+		if strings.Join(got, " ") != "u0:80 u2:80 u0:80 u2:80" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("all unavailable falls back to every upstream", func(t *testing.T) {
+		rt := testRoute(t, "", 2)
+		for _, up := range rt.upstreams {
+			up.ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+		}
+		if pickHost(rt, r) == pickHost(rt, r) {
+			t.Error("expected rotation over all upstreams")
+		}
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		rt := testRoute(t, strategyLeastConn, 3)
+		rt.upstreams[0].active.Store(5)
+		rt.upstreams[1].active.Store(1)
+		rt.upstreams[2].active.Store(3)
+		for i := 0; i < 3; i++ {
+			if got := pickHost(rt, r); got != "u1:80" {
+				t.Errorf("got %s", got)
+			}
+		}
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		rt := testRoute(t, strategyConsistentHash, 4)
+		rt.hashKey = "X-User"
+		req := func(user string) *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-User", user)
+			return r
+		}
+
+		before := map[string]string{}
+		for i := 0; i < 200; i++ {
+			user := fmt.Sprint("user", i)
+			before[user] = pickHost(rt, req(user))
+			if again := pickHost(rt, req(user)); again != before[user] {
+				t.Fatalf("%s moved from %s to %s", user, before[user], again)
+			}
+		}
+
+		rt.upstreams[2].healthy.Store(false)
+		for user, host := range before {
+			got := pickHost(rt, req(user))
+			if host != "u2:80" && got != host {
+				t.Errorf("%s moved from %s to %s although its upstream is healthy", user, host, got)
+			}
+			if got == "u2:80" {
+				t.Errorf("%s still on the unhealthy upstream", user)
+			}
+		}
+	})
+}
+
+// flakyUpstream answers health checks and requests with the current status.
+func flakyUpstream(t *testing.T, name string, status *atomic.Int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReverseProxy_healthCheck(t *testing.T) {
+	var aStatus, bStatus atomic.Int64
+	aStatus.Store(http.StatusOK)
+	bStatus.Store(http.StatusOK)
+	a, b := flakyUpstream(t, "a", &aStatus), flakyUpstream(t, "b", &bStatus)
+
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{Routes: []RouteConfig{{
+		Upstreams:   []string{a.URL, b.URL},
+		HealthCheck: &HealthCheckConfig{Path: "/healthz", Interval: Duration(10 * time.Millisecond)},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+	h := proxyRouter(rp)
+
+	bStatus.Store(http.StatusServiceUnavailable)
+	waitFor(t, "b to be marked unhealthy", func() bool { return !rp.Status()[0].Upstreams[1].Healthy })
+	for i := 0; i < 4; i++ {
+		if got := get(h, "http://localhost/"); got != "a" {
+			t.Errorf("got %q from an unhealthy upstream", got)
+		}
+	}
+
+	bStatus.Store(http.StatusOK)
+	waitFor(t, "b to recover", func() bool { return rp.Status()[0].Upstreams[1].Healthy })
+}
+
+func TestReverseProxy_outlier(t *testing.T) {
+	var aStatus, bStatus atomic.Int64
+	aStatus.Store(http.StatusOK)
+	bStatus.Store(http.StatusBadGateway)
+	a, b := flakyUpstream(t, "a", &aStatus), flakyUpstream(t, "b", &bStatus)
+	// an upstream that refuses connections
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{Routes: []RouteConfig{{
+		Upstreams: []string{a.URL, b.URL, closed.URL},
+		Outlier:   &OutlierConfig{MaxFails: 2, EjectFor: Duration(time.Hour)},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxyRouter(rp)
+
+	// two rounds fail b and the closed upstream twice each
+	for i := 0; i < 6; i++ {
+		get(h, "http://localhost/")
+	}
+	for i := 0; i < 4; i++ {
+		if got := get(h, "http://localhost/"); got != "a" {
+			t.Errorf("got %q from an ejected upstream", got)
+		}
+	}
+
+	status := rp.Status()[0].Upstreams
+	if status[0].EjectedUntil != nil || status[1].EjectedUntil == nil || status[2].EjectedUntil == nil {
+		t.Errorf("wrong ejections %+v", status)
+	}
+}
+
+func TestUpstreamStatusHandler(t *testing.T) {
+	app := &application{proxy: NewReverseProxy("hugo_task", "1313"), admins: map[string]bool{"admin": true}}
+	r := httptest.NewRequest(http.MethodGet, "/api/debug/upstreams", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("admin")})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+
+	var status []RouteStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	want := RouteStatus{Prefix: "/", Strategy: strategyRoundRobin, Upstreams: []UpstreamStatus{{URL: "http://hugo_task:1313", Healthy: true}}}
+	if len(status) != 1 || fmt.Sprint(status[0]) != fmt.Sprint(want) {
+		t.Errorf("got %+v", status)
+	}
+}
+
+func TestProxyConfig_balancing(t *testing.T) {
+	var cfg ProxyConfig
+	err := json.Unmarshal([]byte(`{"routes": [{"upstreams": ["http://a"], "strategy": "least_conn",
+		"health_check": {"path": "/healthz", "interval": "5s"}, "outlier": {"eject_for": "1m"}}]}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := cfg.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := tbl.routes[0]
+	if rt.health.Interval != Duration(5*time.Second) || rt.health.Timeout != Duration(defaultHealthTimeout) ||
+		rt.health.ExpectedStatus != http.StatusOK {
+		t.Errorf("health check defaults %+v", rt.health)
+	}
+	if rt.outlier.MaxFails != defaultMaxFails || rt.outlier.EjectFor != Duration(time.Minute) {
+		t.Errorf("outlier defaults %+v", rt.outlier)
+	}
+
+	if json.Unmarshal([]byte(`{"interval": 5}`), &HealthCheckConfig{}) == nil {
+		t.Error("expected an error for a numeric duration")
+	}
+	bad := []RouteConfig{
+		{Upstreams: []string{"http://a"}, Strategy: "random"},
+		{Upstreams: []string{"http://a"}, HealthCheck: &HealthCheckConfig{Path: "healthz"}},
+		{Upstreams: []string{"http://a"}, Outlier: &OutlierConfig{MaxFails: -1}},
+	}
+	for _, rc := range bad {
+		if _, err := (&ProxyConfig{Routes: []RouteConfig{rc}}).compile(); err == nil {
+			t.Errorf("expected an error for %+v", rc)
+		}
+	}
+}
+
+// TestReverseProxy_reloadKeepsUpstreams reloads the routing table and checks
+// that ejections and in-flight counts of the kept upstreams survive.
+func TestReverseProxy_reloadKeepsUpstreams(t *testing.T) {
+	cfg := &ProxyConfig{Routes: []RouteConfig{{
+		Upstreams: []string{"http://a:80", "http://b:80"},
+		Strategy:  strategyLeastConn,
+		Outlier:   &OutlierConfig{MaxFails: 1, EjectFor: Duration(time.Hour)},
+	}}}
+	rp := newReverseProxy("")
+	if err := rp.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+	rt := rp.table.Load().routes[0]
+	a, b := rt.upstreams[0], rt.upstreams[1]
+	rt.done(a, true)
+	b.active.Add(3)
+	b.healthy.Store(false)
+
+	cfg.Routes[0].Upstreams = append(cfg.Routes[0].Upstreams, "http://c:80")
+	if err := rp.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := rp.table.Load().routes[0].upstreams
+	if got[0] != a || got[1] != b || got[2].url.Host != "c:80" {
+		t.Fatalf("upstreams not kept: %+v", got)
+	}
+	if a.available(time.Now()) || b.active.Load() != 3 {
+		t.Errorf("state lost: ejected until %d, %d in flight", a.ejectedUntil.Load(), b.active.Load())
+	}
+	// without health checks nothing would mark b healthy again
+	if !b.healthy.Load() {
+		t.Error("b stayed unhealthy after its health check was removed")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const (
+	defaultBatchWorkers  = 8
+	defaultBatchMaxItems = 1000
+)
+
+// batchResult is one NDJSON line of a batch response.
+type batchResult struct {
+	Index     int        `json:"index"`
+	Addresses []*Address `json:"addresses"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// batchDecoder reads batch items one at a time from either a JSON array or
+// an NDJSON stream, so large batches are never held in memory at once.
+type batchDecoder struct {
+	dec     *json.Decoder
+	started bool
+	array   bool
+	// broken is set once the stream itself is malformed and can't be resumed
+	broken bool
+}
+
+func newBatchDecoder(r *http.Request) *batchDecoder {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return &batchDecoder{
+		dec:   json.NewDecoder(bufio.NewReader(r.Body)),
+		array: mediaType != "application/x-ndjson",
+	}
+}
+
+// Next decodes the next item into v and returns io.EOF after the last one.
+func (b *batchDecoder) Next(v interface{}) error {
+	if b.array && !b.started {
+		b.started = true
+		tok, err := b.dec.Token()
+		if err != nil {
+			b.broken = true
+			return err
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			b.broken = true
+			return errors.New("batch body must be a JSON array")
+		}
+	}
+	if b.array && !b.dec.More() {
+		return io.EOF
+	}
+	err := b.dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if err != nil && !errors.Is(err, io.EOF) && !errors.As(err, &typeErr) {
+		b.broken = true
+	}
+	return err
+}
+
+// batchJob resolves a single batch item.
+type batchJob func() ([]*Address, error)
+
+// serveBatch fans the decoded items out to a bounded worker pool and streams
+// the results back as NDJSON in the order the items were received. next is
+// called for every item and returns either its job or a per-item error.
+func (app *application) serveBatch(w http.ResponseWriter, r *http.Request, next func(b *batchDecoder) (batchJob, error)) {
+	workers := app.batchWorkers
+	if workers <= 0 {
+		workers = defaultBatchWorkers
+	}
+	maxItems := app.batchMaxItems
+	if maxItems <= 0 {
+		maxItems = defaultBatchMaxItems
+	}
+
+	type task struct {
+		job    batchJob
+		result chan batchResult
+		index  int
+	}
+	tasks := make(chan task)
+	// pending keeps the result channels in input order; its capacity bounds
+	// how far the workers can run ahead of the writer.
+	pending := make(chan chan batchResult, workers*2)
+	ctx := r.Context()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for t := range tasks {
+				addresses, err := t.job()
+				res := batchResult{Index: t.index, Addresses: addresses}
+				if err != nil {
+					res.Error = err.Error()
+				}
+				t.result <- res
+			}
+		}()
+	}
+
+	go func() {
+		defer close(pending)
+		defer close(tasks)
+		dec := newBatchDecoder(r)
+		for i := 0; ; i++ {
+			result := make(chan batchResult, 1)
+			job, err := next(dec)
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err == nil && i >= maxItems {
+				err = fmt.Errorf("batch exceeds %d items", maxItems)
+			}
+			if err != nil {
+				result <- batchResult{Index: i, Error: err.Error()}
+				select {
+				case pending <- result:
+				case <-ctx.Done():
+					return
+				}
+				if i >= maxItems || dec.broken {
+					return
+				}
+				continue
+			}
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case tasks <- task{job: job, result: result, index: i}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// results are flushed while the body is still being decoded; without full
+	// duplex HTTP/1.1 closes the unread body on the first flush. HTTP/2 is
+	// always full duplex and doesn't support the call.
+	err := http.NewResponseController(w).EnableFullDuplex()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.logger.Error("failed to enable full duplex", "error", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for result := range pending {
+		select {
+		case res := <-result:
+			if err := enc.Encode(res); err != nil {
+				app.logger.Error("failed to write batch result", "error", err.Error())
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (app *application) SearchBatchHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /address/search/batch GetAddressBatch
+	// swagger:operation POST /address/search/batch GetAddressBatch
+	//
+	// resolves a JSON array or NDJSON stream of search requests, streaming NDJSON results in input order
+	//
+	//
+	//
+	// ---
+	// consumes:
+	// - application/json
+	// - application/x-ndjson
+	// produces:
+	// - application/x-ndjson
+	// parameters:
+	// - name: requests
+	//   in: body
+	//   schema:
+	//     type: array
+	//     items:
+	//       type: object
+	// responses:
+	//   '200':
+	//     description: one NDJSON line per item with index and addresses or error
+	//     schema:
+	//         type: string
+
+	app.serveBatch(w, r, func(b *batchDecoder) (batchJob, error) {
+		var req SearchRequest
+		err := b.Next(&req)
+		if err != nil {
+			return nil, err
+		}
+		full, err := isFullDetail(req.Detail)
+		if err != nil {
+			return nil, err
+		}
+		err = req.SearchParams.Validate()
+		if err != nil {
+			return nil, err
+		}
+		return func() ([]*Address, error) {
+			addresses, err := app.geo.AddressSearch(req.SearchParams)
+			if err != nil {
+				return nil, err
+			}
+			addresses = withDetail(addresses, full)
+			if req.Zones {
+				app.tagZones(addresses)
+			}
+			return addresses, nil
+		}, nil
+	})
+}
+
+func (app *application) GeocodeBatchHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /address/geocode/batch GetAddressByGeocodeBatch
+	// swagger:operation POST /address/geocode/batch GetAddressByGeocodeBatch
+	//
+	// resolves a JSON array or NDJSON stream of geocode requests, streaming NDJSON results in input order
+	//
+	//
+	//
+	// ---
+	// consumes:
+	// - application/json
+	// - application/x-ndjson
+	// produces:
+	// - application/x-ndjson
+	// parameters:
+	// - name: requests
+	//   in: body
+	//   schema:
+	//     type: array
+	//     items:
+	//       type: object
+	// responses:
+	//   '200':
+	//     description: one NDJSON line per item with index and addresses or error
+	//     schema:
+	//         type: string
+
+	app.serveBatch(w, r, func(b *batchDecoder) (batchJob, error) {
+		var req GeocodeRequest
+		err := b.Next(&req)
+		if err != nil {
+			return nil, err
+		}
+		full, err := isFullDetail(req.Detail)
+		if err != nil {
+			return nil, err
+		}
+		err = req.GeocodeParams.Validate()
+		if err != nil {
+			return nil, err
+		}
+		return func() ([]*Address, error) {
+			addresses, err := app.geo.GeoCode(req.GeocodeParams)
+			if err != nil {
+				return nil, err
+			}
+			addresses = withDetail(addresses, full)
+			if req.Zones {
+				app.tagZones(addresses)
+			}
+			return addresses, nil
+		}, nil
+	})
+}
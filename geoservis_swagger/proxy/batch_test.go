@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newBatchApp(workers, maxItems int, inFlight *int32, maxInFlight *int32) *application {
+	track := func() func() {
+		n := atomic.AddInt32(inFlight, 1)
+		for {
+			m := atomic.LoadInt32(maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(maxInFlight, m, n) {
+				break
+			}
+		}
+		return func() { atomic.AddInt32(inFlight, -1) }
+	}
+	return &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+				defer track()()
+				if params.Query == "fail" {
+					return nil, errors.New("upstream error")
+				}
+				// later items finish first to check ordering
+				time.Sleep(time.Duration(10-len(params.Query)%10) * time.Millisecond)
+				return []*Address{{City: params.Query}}, nil
+			},
+			GeoCode_field: func(params GeocodeParams) ([]*Address, error) {
+				defer track()()
+				return []*Address{{Lat: params.Lat, Lon: params.Lng}}, nil
+			},
+		},
+		logger:        slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		batchWorkers:  workers,
+		batchMaxItems: maxItems,
+	}
+}
+
+func readBatch(t *testing.T, body string) []batchResult {
+	t.Helper()
+	var results []batchResult
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		var res batchResult
+		if err := json.Unmarshal(sc.Bytes(), &res); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", sc.Text(), err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func doBatch(app *application, path, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestSearchBatchHandler(t *testing.T) {
+	var items []string
+	for i := 0; i < 30; i++ {
+		items = append(items, fmt.Sprintf(`{"query":"%s"}`, strings.Repeat("a", i+1)))
+	}
+	items[5] = `{"query":"fail"}`
+	items[7] = `{"query":"x","count":100}`
+
+	t.Run("json array", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		app := newBatchApp(4, 100, &inFlight, &maxInFlight)
+		w := doBatch(app, "/api/address/search/batch", "application/json", "["+strings.Join(items, ",")+"]")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("wrong content type %q", ct)
+		}
+		results := readBatch(t, w.Body.String())
+		if len(results) != len(items) {
+			t.Fatalf("expected %d results but got %d", len(items), len(results))
+		}
+		for i, res := range results {
+			if res.Index != i {
+				t.Fatalf("result %d has index %d", i, res.Index)
+			}
+			switch i {
+			case 5, 7:
+				if res.Error == "" {
+					t.Errorf("item %d should fail", i)
+				}
+			default:
+				if res.Error != "" || len(res.Addresses) != 1 || res.Addresses[0].City != strings.Repeat("a", i+1) {
+					t.Errorf("wrong result for item %d: %+v", i, res)
+				}
+			}
+		}
+		if maxInFlight > 4 {
+			t.Errorf("expected at most 4 concurrent calls but got %d", maxInFlight)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		app := newBatchApp(2, 100, &inFlight, &maxInFlight)
+		w := doBatch(app, "/api/address/search/batch", "application/x-ndjson", strings.Join(items[:3], "\n")+"\n")
+		results := readBatch(t, w.Body.String())
+		if len(results) != 3 || results[2].Addresses[0].City != "aaa" {
+			t.Errorf("wrong ndjson results: %+v", results)
+		}
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		app := newBatchApp(2, 10, &inFlight, &maxInFlight)
+		w := doBatch(app, "/api/address/search/batch", "application/json", "["+strings.Join(items, ",")+"]")
+		results := readBatch(t, w.Body.String())
+		if len(results) != 11 || !strings.Contains(results[10].Error, "exceeds 10 items") {
+			t.Errorf("batch limit not enforced: %d results, last %+v", len(results), results[len(results)-1])
+		}
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		var inFlight, maxInFlight int32
+		app := newBatchApp(2, 10, &inFlight, &maxInFlight)
+		w := doBatch(app, "/api/address/search/batch", "application/json", `{"query":"a"}`)
+		results := readBatch(t, w.Body.String())
+		if len(results) != 1 || results[0].Error == "" {
+			t.Errorf("expected a single error line, got %+v", results)
+		}
+	})
+}
+
+func TestGeocodeBatchHandler(t *testing.T) {
+	var inFlight, maxInFlight int32
+	app := newBatchApp(2, 10, &inFlight, &maxInFlight)
+	body := `{"lat":"55.1","lng":"37.1"}
+{"lat":"55.2","lng":"37.2","radius_meters":5000}
+{"lat":"55.3","lng":"37.3"}
+`
+	w := doBatch(app, "/api/address/geocode/batch", "application/x-ndjson", body)
+	results := readBatch(t, w.Body.String())
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results but got %d", len(results))
+	}
+	if results[0].Addresses[0].Lat != "55.1" || results[1].Error == "" || results[2].Addresses[0].Lat != "55.3" {
+		t.Errorf("wrong geocode batch results: %+v", results)
+	}
+}
+
+// TestSearchBatchHandler_server streams a batch larger than the first flush
+// through a real HTTP/1.1 server, which closes an unread request body once
+// the response has started unless the handler asks for full duplex.
+func TestSearchBatchHandler_server(t *testing.T) {
+	var inFlight, maxInFlight int32
+	srv := httptest.NewServer(newBatchApp(8, 1000, &inFlight, &maxInFlight).setupRouter())
+	defer srv.Close()
+
+	const n = 800
+	tests := []struct {
+		name        string
+		contentType string
+		join        func(items []string) string
+	}{
+		{"json", "application/json", func(items []string) string { return "[" + strings.Join(items, ",") + "]" }},
+		{"ndjson", "application/x-ndjson", func(items []string) string { return strings.Join(items, "\n") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var items []string
+			for i := 0; i < n; i++ {
+				items = append(items, fmt.Sprintf(`{"query":"q%d"}`, i))
+			}
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/address/search/batch", strings.NewReader(tt.join(items)))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			results := readBatch(t, string(body))
+			if len(results) != n {
+				t.Fatalf("expected %d results but got %d", n, len(results))
+			}
+			for i, res := range results {
+				if res.Index != i || res.Error != "" || len(res.Addresses) != 1 || res.Addresses[0].City != fmt.Sprintf("q%d", i) {
+					t.Fatalf("result %d: %+v", i, res)
+				}
+			}
+		})
+	}
+}
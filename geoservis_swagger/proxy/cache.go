@@ -0,0 +1,635 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMaxBytes      = 64 << 20
+	defaultCacheMaxEntryBytes = 4 << 20
+	// how long a background revalidation may take
+	cacheRefreshTimeout = 30 * time.Second
+)
+
+// CacheConfig enables the shared response cache for proxied routes.
+type CacheConfig struct {
+	// total size of stored responses, default 64 MiB
+	MaxBytes int64 `json:"max_bytes"`
+	// larger responses are not stored, default 4 MiB
+	MaxEntryBytes int64 `json:"max_entry_bytes"`
+}
+
+// cacheableStatus lists the statuses stored, following RFC 9110 15.1.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheEntry is a stored response. Entries are never modified once stored;
+// a revalidation stores a copy.
+type cacheEntry struct {
+	key    string
+	path   string
+	status int
+	header http.Header
+	body   []byte
+	// request header values the response varies on
+	vary map[string]string
+	// when the response was received or last revalidated
+	stored time.Time
+	// Age reported by the upstream at that time
+	age time.Duration
+	// freshness lifetime
+	ttl time.Duration
+	// how long after ttl the entry may be served while it is revalidated
+	swr time.Duration
+}
+
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for k, vv := range e.header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+func (e *cacheEntry) matchesVary(r *http.Request) bool {
+	for k, v := range e.vary {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// responseCache is an LRU store capped by the total size of its entries.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxEntry int64
+	bytes    int64
+	lru      *list.List
+	items    map[string]*list.Element
+	// keys with a background revalidation in flight
+	refreshing map[string]bool
+}
+
+func newResponseCache(cfg *CacheConfig) *responseCache {
+	c := &responseCache{lru: list.New(), items: map[string]*list.Element{}, refreshing: map[string]bool{}}
+	c.setLimits(cfg)
+	return c
+}
+
+func (c *responseCache) setLimits(cfg *CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes, c.maxEntry = cfg.MaxBytes, cfg.MaxEntryBytes
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultCacheMaxBytes
+	}
+	if c.maxEntry <= 0 {
+		c.maxEntry = defaultCacheMaxEntryBytes
+	}
+	c.evict()
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.size() > c.maxEntry {
+		c.removeLocked(e.key)
+		return
+	}
+	c.removeLocked(e.key)
+	c.items[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+	c.evict()
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *responseCache) removeLocked(key string) {
+	if el, ok := c.items[key]; ok {
+		c.bytes -= el.Value.(*cacheEntry).size()
+		c.lru.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// evict drops the least recently used entries until the cache fits.
+func (c *responseCache) evict() {
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// purge removes the entries whose path starts with prefix and returns how
+// many there were.
+func (c *responseCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for key, el := range c.items {
+		if strings.HasPrefix(el.Value.(*cacheEntry).path, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		c.removeLocked(key)
+	}
+	return len(keys)
+}
+
+// startRefresh claims the background revalidation of key.
+func (c *responseCache) startRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *responseCache) endRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, key)
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase directives
+// and their unquoted arguments.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(d, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+func seconds(cc map[string]string, directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func cacheKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + " " + r.URL.RequestURI()
+}
+
+// cacheable reports whether r may be answered from the cache.
+func cacheable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Header.Get("Upgrade") == ""
+}
+
+// newCacheEntry builds an entry for a response to r, or returns nil when the
+// response must not be stored.
+func newCacheEntry(r *http.Request, status int, header http.Header, body []byte, now time.Time) *cacheEntry {
+	if r.Method != http.MethodGet || !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	cc := parseCacheControl(header)
+	_, noStore := cc["no-store"]
+	_, private := cc["private"]
+	if noStore || private {
+		return nil
+	}
+	if r.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, shared := cc["s-maxage"]
+		if !public && !shared {
+			return nil
+		}
+	}
+
+	e := &cacheEntry{
+		key:    cacheKey(r),
+		path:   r.URL.Path,
+		status: status,
+		header: header.Clone(),
+		body:   body,
+		vary:   map[string]string{},
+		stored: now,
+	}
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				e.vary[http.CanonicalHeaderKey(name)] = r.Header.Get(name)
+			}
+		}
+	}
+	// an encoded body depends on Accept-Encoding whether or not the
+	// upstream says so
+	if header.Get("Content-Encoding") != "" {
+		e.vary["Accept-Encoding"] = r.Header.Get("Accept-Encoding")
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		e.age = time.Duration(age) * time.Second
+	}
+	e.header.Del("Age")
+	e.header.Del("X-Cache")
+	e.setFreshness(cc, now)
+
+	if e.ttl == 0 && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		// neither fresh nor revalidatable
+		return nil
+	}
+	return e
+}
+
+// setFreshness reads the freshness lifetime from the stored headers.
+func (e *cacheEntry) setFreshness(cc map[string]string, now time.Time) {
+	e.ttl, e.swr = 0, 0
+	if _, ok := cc["no-cache"]; ok {
+		return
+	}
+	if ttl, ok := seconds(cc, "s-maxage"); ok {
+		e.ttl = ttl
+	} else if ttl, ok := seconds(cc, "max-age"); ok {
+		e.ttl = ttl
+	} else if expires, err := http.ParseTime(e.header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(e.header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		if expires.After(date) {
+			e.ttl = expires.Sub(date)
+		}
+	}
+	_, must := cc["must-revalidate"]
+	_, proxyMust := cc["proxy-revalidate"]
+	if !must && !proxyMust {
+		e.swr, _ = seconds(cc, "stale-while-revalidate")
+	}
+}
+
+// revalidated returns a copy of e updated with the headers of a 304.
+func (e *cacheEntry) revalidated(header http.Header, now time.Time) *cacheEntry {
+	n := *e
+	n.header = e.header.Clone()
+	for k, v := range header {
+		switch k {
+		case "Content-Length", "Content-Type", "Transfer-Encoding", "X-Cache":
+			continue
+		}
+		n.header[k] = v
+	}
+	n.age = 0
+	if age, err := strconv.Atoi(n.header.Get("Age")); err == nil && age > 0 {
+		n.age = time.Duration(age) * time.Second
+	}
+	n.header.Del("Age")
+	n.stored = now
+	n.setFreshness(parseCacheControl(n.header), now)
+	return &n
+}
+
+// notModified evaluates the client's conditional headers against e.
+func (e *cacheEntry) notModified(r *http.Request) bool {
+	if e.status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// serveEntry answers r from e, with a 304 when the client's copy is current.
+func serveEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string, now time.Time) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.Itoa(int(e.currentAge(now)/time.Second)))
+	h.Set("X-Cache", status)
+	if e.notModified(r) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// cacheWriter passes a proxied response to the client while keeping a copy
+// for the cache. A 304 to a revalidation is held back, since the client gets
+// the stored response instead.
+type cacheWriter struct {
+	// nil for background revalidations
+	dst          http.ResponseWriter
+	header       http.Header
+	revalidating bool
+	limit        int64
+
+	status int
+	// the upstream's header as sent, before middleware further out such
+	// as compression rewrites the shared map
+	stored      http.Header
+	notModified bool
+	body        []byte
+	// false once the body outgrew limit
+	complete bool
+}
+
+func newCacheWriter(dst http.ResponseWriter, revalidating bool, limit int64) *cacheWriter {
+	cw := &cacheWriter{dst: dst, revalidating: revalidating, limit: limit, complete: true}
+	if dst != nil {
+		cw.header = dst.Header()
+	} else {
+		cw.header = http.Header{}
+	}
+	return cw
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	cw.stored = cw.header.Clone()
+	if status == http.StatusNotModified && cw.revalidating {
+		cw.notModified = true
+		return
+	}
+	// streams and large bodies are passed through without a copy
+	ct, _, _ := mime.ParseMediaType(cw.header.Get("Content-Type"))
+	if n, err := strconv.ParseInt(cw.header.Get("Content-Length"), 10, 64); ct == "text/event-stream" || (err == nil && n > cw.limit) {
+		cw.complete = false
+	}
+	if cw.dst != nil {
+		cw.header.Set("X-Cache", "MISS")
+		cw.dst.WriteHeader(status)
+	}
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(b), nil
+	}
+	if cw.complete {
+		if int64(len(cw.body)+len(b)) > cw.limit {
+			cw.complete, cw.body = false, nil
+		} else {
+			cw.body = append(cw.body, b...)
+		}
+	}
+	if cw.dst == nil {
+		return len(b), nil
+	}
+	return cw.dst.Write(b)
+}
+
+func (cw *cacheWriter) Flush() {
+	if cw.notModified || cw.dst == nil {
+		return
+	}
+	if f, ok := cw.dst.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.dst
+}
+
+// conditionalHeaders are the client's validators, replaced by the cache's own
+// when it revalidates.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// serveCached answers a cacheable request from the cache or the upstream.
+func (rp *ReverseProxy) serveCached(w http.ResponseWriter, r *http.Request, table *routeTable, rt *route, next http.Handler) {
+	c := table.cache
+	reqCC := parseCacheControl(r.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		w.Header().Set("X-Cache", "BYPASS")
+		rp.forward(w, r, table, rt, next)
+		return
+	}
+
+	now := time.Now()
+	key := cacheKey(r)
+	e := c.get(key)
+	if e != nil && !e.matchesVary(r) {
+		e = nil
+	}
+	_, noCache := reqCC["no-cache"]
+	maxAge, limited := seconds(reqCC, "max-age")
+	if e != nil && !noCache && !(limited && e.currentAge(now) > maxAge) {
+		age := e.currentAge(now)
+		if age < e.ttl {
+			serveEntry(w, r, e, "HIT", now)
+			return
+		}
+		if age < e.ttl+e.swr {
+			if c.startRefresh(key) {
+				go rp.refresh(r, table, rt, e)
+			}
+			serveEntry(w, r, e, "STALE", now)
+			return
+		}
+	}
+	rp.fetch(w, r, table, rt, e, next)
+}
+
+// fetch forwards r, revalidating e if there is one, and stores the result.
+// A nil w means a background revalidation.
+func (rp *ReverseProxy) fetch(w http.ResponseWriter, r *http.Request, table *routeTable, rt *route, e *cacheEntry, next http.Handler) {
+	c := table.cache
+	if e == nil && r.Method == http.MethodHead {
+		// a HEAD response cannot be stored, so it is simply forwarded
+		w.Header().Set("X-Cache", "MISS")
+		rp.forward(w, r, table, rt, next)
+		return
+	}
+	out := r
+	if e != nil {
+		out = r.Clone(r.Context())
+		out.Method = http.MethodGet
+		for _, h := range conditionalHeaders {
+			out.Header.Del(h)
+		}
+		if etag := e.header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	c.mu.Lock()
+	limit := c.maxEntry
+	c.mu.Unlock()
+	cw := newCacheWriter(w, e != nil, limit)
+	rp.forward(cw, out, table, rt, next)
+
+	now := time.Now()
+	if cw.notModified {
+		fresh := e.revalidated(cw.stored, now)
+		c.put(fresh)
+		if w != nil {
+			// drop what the 304 put into the client's headers
+			for k := range w.Header() {
+				delete(w.Header(), k)
+			}
+			serveEntry(w, r, fresh, "REVALIDATED", now)
+		}
+		return
+	}
+	if !cw.complete || r.Context().Err() != nil {
+		return
+	}
+	if ne := newCacheEntry(out, cw.status, cw.stored, cw.body, now); ne != nil {
+		c.put(ne)
+	} else if e != nil && cw.status < http.StatusInternalServerError {
+		// the upstream no longer allows storing it; a failing upstream
+		// keeps the old copy
+		c.remove(e.key)
+	}
+}
+
+// refresh revalidates e in the background while clients get the stale copy.
+func (rp *ReverseProxy) refresh(r *http.Request, table *routeTable, rt *route, e *cacheEntry) {
+	defer table.cache.endRefresh(e.key)
+	ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshTimeout)
+	defer cancel()
+	rp.fetch(nil, r.Clone(ctx), table, rt, e, http.NotFoundHandler())
+}
+
+// Purge drops cached responses whose path starts with prefix, or all of them
+// for an empty prefix. It returns how many were dropped.
+func (rp *ReverseProxy) Purge(prefix string) int {
+	c := rp.table.Load().cache
+	if c == nil {
+		return 0
+	}
+	return c.purge(prefix)
+}
+
+// swagger:parameters PurgeCache
+type PurgeRequest struct {
+	// cached paths starting with it are purged, all when empty
+	// example: /posts/
+	Prefix string `json:"prefix"`
+}
+
+func (app *application) PurgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /cache/purge PurgeCache
+	// swagger:operation POST /cache/purge PurgeCache
+	//
+	// drops cached pages of the proxied site, admins only
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: prefix
+	//   in: body
+	//   type: object
+	// responses:
+	//   '200':
+	//     description: number of purged pages
+	//     schema:
+	//         type: object
+	//   '400':
+	//      description: invalid request body
+	//      schema:
+	//	        type: string
+	//   '403':
+	//      description: not an admin
+	//      schema:
+	//	        type: string
+
+	var req PurgeRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	n := app.proxy.Purge(req.Prefix)
+	app.logger.Info("cache purged", "prefix", req.Prefix, "entries", n)
+
+	responseJSON, _ := json.Marshal(map[string]int{"purged": n})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
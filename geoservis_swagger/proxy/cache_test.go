@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pageUpstream serves pages whose headers and body the test controls, and
+// counts full responses and 304s per path.
+type pageUpstream struct {
+	mu      sync.Mutex
+	header  map[string]http.Header
+	body    map[string]string
+	full    map[string]int
+	notMod  map[string]int
+	lastReq map[string]http.Header
+	*httptest.Server
+}
+
+func newPageUpstream(t *testing.T) *pageUpstream {
+	t.Helper()
+	u := &pageUpstream{
+		header: map[string]http.Header{}, body: map[string]string{},
+		full: map[string]int{}, notMod: map[string]int{}, lastReq: map[string]http.Header{},
+	}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.lastReq[r.URL.Path] = r.Header.Clone()
+		for k, v := range u.header[r.URL.Path] {
+			w.Header()[k] = v
+		}
+		if etag := w.Header().Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+			u.notMod[r.URL.Path]++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		u.full[r.URL.Path]++
+		fmt.Fprint(w, u.body[r.URL.Path])
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *pageUpstream) set(path, body string, header ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	h := http.Header{}
+	for i := 0; i+1 < len(header); i += 2 {
+		h.Add(header[i], header[i+1])
+	}
+	u.header[path], u.body[path] = h, body
+}
+
+func (u *pageUpstream) counts(path string) (int, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.full[path], u.notMod[path]
+}
+
+func cachingProxy(t *testing.T, upstream string, cfg *CacheConfig) (*ReverseProxy, http.Handler) {
+	t.Helper()
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{
+		Routes: []RouteConfig{
+			{Prefix: "/api", Local: true},
+			{Prefix: "/", Upstreams: []string{upstream}},
+			{Prefix: "/live", Upstreams: []string{upstream}, NoCache: true},
+		},
+		Cache: cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp, proxyRouter(rp)
+}
+
+func do(h http.Handler, method, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://example.com"+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// backdate makes the entry for path look older by d.
+func backdate(rp *ReverseProxy, path string, d time.Duration) {
+	c := rp.table.Load().cache
+	e := *c.get("example.com " + path)
+	e.stored = e.stored.Add(-d)
+	c.put(&e)
+}
+
+func TestCache_freshness(t *testing.T) {
+	u := newPageUpstream(t)
+	u.set("/posts/", "posts", "Cache-Control", "max-age=60", "ETag", `"v1"`,
+		"Last-Modified", "Mon, 05 Oct 2026 10:00:00 GMT")
+	rp, h := cachingProxy(t, u.URL, &CacheConfig{})
+
+	if w := do(h, "GET", "/posts/"); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "posts" {
+		t.Fatalf("first request: %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	backdate(rp, "/posts/", 10*time.Second)
+	w := do(h, "GET", "/posts/")
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "posts" || w.Header().Get("Age") != "10" {
+		t.Errorf("second request: %s %q age %s", w.Header().Get("X-Cache"), w.Body.String(), w.Header().Get("Age"))
+	}
+	if w := do(h, "HEAD", "/posts/"); w.Header().Get("X-Cache") != "HIT" || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "5" {
+		t.Errorf("HEAD: %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+
+	t.Run("conditional requests", func(t *testing.T) {
+		tests := [][]string{
+			{"If-None-Match", `"v1"`},
+			{"If-None-Match", `"v0", W/"v1"`},
+			{"If-Modified-Since", "Mon, 05 Oct 2026 10:00:00 GMT"},
+		}
+		for _, hdr := range tests {
+			w := do(h, "GET", "/posts/", hdr...)
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != `"v1"` {
+				t.Errorf("%v: got %d %q", hdr, w.Code, w.Body.String())
+			}
+		}
+		if w := do(h, "GET", "/posts/", "If-None-Match", `"v0"`); w.Code != http.StatusOK {
+			t.Errorf("stale client copy: got %d", w.Code)
+		}
+	})
+
+	if full, _ := u.counts("/posts/"); full != 1 {
+		t.Errorf("upstream served %d full responses, want 1", full)
+	}
+
+	t.Run("expired entries are revalidated", func(t *testing.T) {
+		backdate(rp, "/posts/", time.Minute)
+		w := do(h, "GET", "/posts/")
+		if w.Header().Get("X-Cache") != "REVALIDATED" || w.Body.String() != "posts" || w.Code != http.StatusOK {
+			t.Errorf("got %d %s %q", w.Code, w.Header().Get("X-Cache"), w.Body.String())
+		}
+		if full, notMod := u.counts("/posts/"); full != 1 || notMod != 1 {
+			t.Errorf("upstream counts %d/%d", full, notMod)
+		}
+		if w := do(h, "GET", "/posts/"); w.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("revalidation did not refresh the entry: %s", w.Header().Get("X-Cache"))
+		}
+	})
+
+	t.Run("changed content replaces the entry", func(t *testing.T) {
+		u.set("/posts/", "new posts", "Cache-Control", "max-age=60", "ETag", `"v2"`)
+		backdate(rp, "/posts/", time.Minute)
+		if w := do(h, "GET", "/posts/"); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "new posts" {
+			t.Errorf("got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+		}
+		if w := do(h, "GET", "/posts/"); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "new posts" {
+			t.Errorf("got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+		}
+	})
+
+	t.Run("client no-cache forces revalidation", func(t *testing.T) {
+		_, before := u.counts("/posts/")
+		if w := do(h, "GET", "/posts/", "Cache-Control", "no-cache"); w.Header().Get("X-Cache") != "REVALIDATED" {
+			t.Errorf("got %s", w.Header().Get("X-Cache"))
+		}
+		if _, after := u.counts("/posts/"); after != before+1 {
+			t.Error("upstream was not asked")
+		}
+	})
+}
+
+func TestCache_staleWhileRevalidate(t *testing.T) {
+	u := newPageUpstream(t)
+	u.set("/", "old", "Cache-Control", "max-age=10, stale-while-revalidate=60", "ETag", `"v1"`)
+	rp, h := cachingProxy(t, u.URL, &CacheConfig{})
+
+	do(h, "GET", "/")
+	u.set("/", "new", "Cache-Control", "max-age=10, stale-while-revalidate=60", "ETag", `"v2"`)
+	backdate(rp, "/", 30*time.Second)
+
+	w := do(h, "GET", "/")
+	if w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "old" {
+		t.Fatalf("got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	waitFor(t, "the background refresh", func() bool {
+		full, _ := u.counts("/")
+		return full == 2
+	})
+	waitFor(t, "the refreshed entry", func() bool {
+		w := do(h, "GET", "/")
+		return w.Header().Get("X-Cache") == "HIT" && w.Body.String() == "new"
+	})
+
+	// past the stale window the client waits for the upstream
+	backdate(rp, "/", 2*time.Minute)
+	if w := do(h, "GET", "/"); w.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("got %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_notStored(t *testing.T) {
+	u := newPageUpstream(t)
+	tests := []struct {
+		name   string
+		header []string
+		req    []string
+	}{
+		{"no-store", []string{"Cache-Control", "no-store, max-age=60"}, nil},
+		{"private", []string{"Cache-Control", "private, max-age=60"}, nil},
+		{"set-cookie", []string{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"}, nil},
+		{"vary star", []string{"Cache-Control", "max-age=60", "Vary", "*"}, nil},
+		{"no freshness or validators", nil, nil},
+		{"authorized", []string{"Cache-Control", "max-age=60"}, []string{"Authorization", "Bearer x"}},
+	}
+	for i, tt := range tests {
+		u.set(fmt.Sprint("/", i), "page", tt.header...)
+	}
+	_, h := cachingProxy(t, u.URL, &CacheConfig{})
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := fmt.Sprint("/", i)
+			do(h, "GET", path, tt.req...)
+			if w := do(h, "GET", path, tt.req...); w.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("got %s", w.Header().Get("X-Cache"))
+			}
+			if full, _ := u.counts(path); full != 2 {
+				t.Errorf("upstream served %d, want 2", full)
+			}
+		})
+	}
+
+	u.set("/public", "page", "Cache-Control", "public, max-age=60")
+	do(h, "GET", "/public", "Authorization", "Bearer x")
+	if w := do(h, "GET", "/public", "Authorization", "Bearer x"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("public response to an authorized request: got %s", w.Header().Get("X-Cache"))
+	}
+
+	u.set("/live/feed", "feed", "Cache-Control", "max-age=60")
+	if w := do(h, "GET", "/live/feed"); w.Header().Get("X-Cache") != "" {
+		t.Errorf("no_cache route: got X-Cache %s", w.Header().Get("X-Cache"))
+	}
+	if w := do(h, "GET", "/", "Cache-Control", "no-store"); w.Header().Get("X-Cache") != "BYPASS" {
+		t.Errorf("no-store request: got %s", w.Header().Get("X-Cache"))
+	}
+	if w := do(h, "POST", "/"); w.Header().Get("X-Cache") != "BYPASS" {
+		t.Errorf("POST: got %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_vary(t *testing.T) {
+	u := newPageUpstream(t)
+	u.set("/", "page", "Cache-Control", "max-age=60", "Vary", "Accept-Encoding")
+	_, h := cachingProxy(t, u.URL, &CacheConfig{})
+
+	steps := []struct {
+		encoding, want string
+	}{
+		{"gzip", "MISS"},
+		{"gzip", "HIT"},
+		{"", "MISS"},
+		{"", "HIT"},
+	}
+	for _, s := range steps {
+		if w := do(h, "GET", "/", "Accept-Encoding", s.encoding); w.Header().Get("X-Cache") != s.want {
+			t.Errorf("Accept-Encoding %q: got %s, want %s", s.encoding, w.Header().Get("X-Cache"), s.want)
+		}
+	}
+}
+
+func TestCache_limits(t *testing.T) {
+	u := newPageUpstream(t)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		u.set(p, strings.Repeat("x", 300), "Cache-Control", "max-age=60")
+	}
+	u.set("/big", strings.Repeat("x", 2000), "Cache-Control", "max-age=60")
+	rp, h := cachingProxy(t, u.URL, &CacheConfig{MaxBytes: 1000, MaxEntryBytes: 1000})
+
+	do(h, "GET", "/a")
+	do(h, "GET", "/b")
+	do(h, "GET", "/a") // /b is now the least recently used
+	do(h, "GET", "/c")
+	want := map[string]string{"/a": "HIT", "/b": "MISS", "/c": "HIT"}
+	for _, p := range []string{"/a", "/c", "/b"} {
+		if w := do(h, "GET", p); w.Header().Get("X-Cache") != want[p] {
+			t.Errorf("%s: got %s, want %s", p, w.Header().Get("X-Cache"), want[p])
+		}
+	}
+
+	do(h, "GET", "/big")
+	if w := do(h, "GET", "/big"); w.Header().Get("X-Cache") != "MISS" || w.Body.Len() != 2000 {
+		t.Errorf("oversized entry: got %s", w.Header().Get("X-Cache"))
+	}
+	if c := rp.table.Load().cache; c.bytes > c.maxBytes {
+		t.Errorf("cache holds %d bytes, cap %d", c.bytes, c.maxBytes)
+	}
+
+	// a reload keeps the entries
+	rp.Load(&ProxyConfig{Routes: []RouteConfig{{Upstreams: []string{u.URL}}}, Cache: &CacheConfig{}})
+	if w := do(h, "GET", "/b"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("after reload: got %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestPurgeCacheHandler(t *testing.T) {
+	u := newPageUpstream(t)
+	for _, p := range []string{"/posts/a", "/posts/b", "/about"} {
+		u.set(p, "page", "Cache-Control", "max-age=60")
+	}
+	rp, h := cachingProxy(t, u.URL, &CacheConfig{})
+	for _, p := range []string{"/posts/a", "/posts/b", "/about"} {
+		do(h, "GET", p)
+	}
+
+	app := &application{
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		proxy:  rp,
+		admins: map[string]bool{"admin@example.com": true},
+	}
+	router := app.setupRouter()
+	purge := func(user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/cache/purge", strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken(user)})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := purge("user@example.com", ""); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: got %d", w.Code)
+	}
+	if w := purge("admin@example.com", "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: got %d", w.Code)
+	}
+	if w := purge("admin@example.com", `{"prefix": "/posts/"}`); w.Body.String() != `{"purged":2}` {
+		t.Errorf("prefix purge: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(h, "GET", "/posts/a"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("purged page: got %s", w.Header().Get("X-Cache"))
+	}
+	if w := do(h, "GET", "/about"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("kept page: got %s", w.Header().Get("X-Cache"))
+	}
+	if w := purge("admin@example.com", ""); w.Body.String() != `{"purged":2}` {
+		t.Errorf("full purge: got %s", w.Body.String())
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(http.Header{"Cache-Control": {`Public, max-age="60"`, "stale-while-revalidate=30,,no-transform"}})
+	want := map[string]string{"public": "", "max-age": "60", "stale-while-revalidate": "30", "no-transform": ""}
+	if fmt.Sprint(cc) != fmt.Sprint(want) {
+		t.Errorf("got %v", cc)
+	}
+	if d, ok := seconds(cc, "max-age"); !ok || d != time.Minute {
+		t.Errorf("max-age: got %v %v", d, ok)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// cleanCandidates is how many suggestions are compared to pick the best match.
+const cleanCandidates = 5
+
+// qcGeoConfidence maps DaData qc_geo codes to a confidence score: 0 is an
+// exact house, 1 the nearest house, 2 the street, 3 the settlement, 4 the
+// city and 5 means the coordinates are unknown.
+var qcGeoConfidence = map[string]float64{
+	"0": 1,
+	"1": 0.9,
+	"2": 0.7,
+	"3": 0.5,
+	"4": 0.3,
+	"5": 0,
+}
+
+// swagger:parameters CleanAddress
+type CleanRequest struct {
+	// A free-form address
+	// example: москва сухонская 11
+	Query string `json:"query"`
+}
+
+// CleanResponse is the single best match for a free-form address.
+//
+//swagger:model
+type CleanResponse struct {
+	Value             string `json:"value"`
+	UnrestrictedValue string `json:"unrestricted_value"`
+	PostalCode        string `json:"postal_code"`
+	// parsed address components
+	Components *Address `json:"components"`
+	// 0..1, derived from qc_geo
+	Confidence float64 `json:"confidence"`
+	// set when another candidate matches the query as well as this one
+	Ambiguous bool `json:"ambiguous"`
+}
+
+// cleanAddress picks the best of the candidates for query. The provider's
+// first suggestion wins; the result is ambiguous when another candidate of
+// the same FIAS level matches at least as many query words.
+func cleanAddress(query string, candidates []*Address) *CleanResponse {
+	best := candidates[0]
+	details := best.AddressDetails
+	if details == nil {
+		details = &AddressDetails{}
+	}
+	res := &CleanResponse{
+		Value:             details.Value,
+		UnrestrictedValue: details.UnrestrictedValue,
+		PostalCode:        details.PostalCode,
+		Components:        best,
+		Confidence:        qcGeoConfidence[details.QcGeo],
+	}
+
+	words := addressWords(query)
+	score := matchedWords(words, details.UnrestrictedValue)
+	for _, c := range candidates[1:] {
+		if c.AddressDetails == nil || c.FiasLevel != details.FiasLevel {
+			continue
+		}
+		if matchedWords(words, c.UnrestrictedValue) >= score {
+			res.Ambiguous = true
+			break
+		}
+	}
+	return res
+}
+
+// addressWords splits s into lower-case words, dropping punctuation.
+func addressWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func matchedWords(words []string, value string) int {
+	have := make(map[string]bool)
+	for _, w := range addressWords(value) {
+		have[w] = true
+	}
+	n := 0
+	for _, w := range words {
+		if have[w] {
+			n++
+		}
+	}
+	return n
+}
+
+func (app *application) CleanHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /address/clean CleanAddress
+	// swagger:operation POST /address/clean CleanAddress
+	//
+	// normalizes a free-form address into its single best match
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: query
+	//   in: body
+	//   type: string
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: the best match
+	//     schema:
+	//         "$ref": "#/definitions/CleanResponse"
+	//   '400':
+	//      description: invalid request body
+	//      schema:
+	//	        type: string
+	//   '404':
+	//      description: nothing matches the address
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	var req CleanRequest
+	req.Query = r.URL.Query().Get("query")
+	if req.Query == "" {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			app.logger.Error(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	candidates, err := app.geo.AddressSearch(SearchParams{Query: req.Query, Count: cleanCandidates})
+	if err != nil {
+		app.geoError(w, err)
+		return
+	}
+	if len(candidates) == 0 {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	responseJSON, _ := json.Marshal(cleanAddress(req.Query, candidates))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
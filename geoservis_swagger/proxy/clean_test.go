@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func cleanCandidate(value, fiasLevel, qcGeo string) *Address {
+	return &Address{
+		City: "Москва",
+		AddressDetails: &AddressDetails{
+			Value:             value,
+			UnrestrictedValue: "127642, " + value,
+			PostalCode:        "127642",
+			FiasLevel:         fiasLevel,
+			QcGeo:             qcGeo,
+		},
+	}
+}
+
+func TestCleanAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		candidates     []*Address
+		wantConfidence float64
+		wantAmbiguous  bool
+	}{
+		{"single", "москва сухонская 11", []*Address{
+			cleanCandidate("г Москва, ул Сухонская, д 11", "8", "0"),
+		}, 1, false},
+		{"weaker second candidate", "москва сухонская 11", []*Address{
+			cleanCandidate("г Москва, ул Сухонская, д 11", "8", "0"),
+			cleanCandidate("г Москва, ул Сухонская, д 11А", "8", "0"),
+		}, 1, false},
+		{"same street in two cities", "сухонская 11", []*Address{
+			cleanCandidate("г Москва, ул Сухонская, д 11", "8", "1"),
+			cleanCandidate("г Вологда, ул Сухонская, д 11", "8", "0"),
+		}, 0.9, true},
+		{"other level is not ambiguous", "сухонская", []*Address{
+			cleanCandidate("г Москва, ул Сухонская", "7", "2"),
+			cleanCandidate("г Москва, ул Сухонская, д 11", "8", "0"),
+		}, 0.7, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cleanAddress(tt.query, tt.candidates)
+			if got.Value != tt.candidates[0].Value || got.PostalCode != "127642" {
+				t.Errorf("wrong best match %+v", got)
+			}
+			if got.Confidence != tt.wantConfidence {
+				t.Errorf("confidence = %v, want %v", got.Confidence, tt.wantConfidence)
+			}
+			if got.Ambiguous != tt.wantAmbiguous {
+				t.Errorf("ambiguous = %v, want %v", got.Ambiguous, tt.wantAmbiguous)
+			}
+		})
+	}
+}
+
+func TestCleanHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		found      []*Address
+		wantStatus int
+	}{
+		{"found", `{"query": "москва сухонская 11"}`, []*Address{cleanCandidate("г Москва, ул Сухонская, д 11", "8", "0")}, http.StatusOK},
+		{"not found", `{"query": "нигде"}`, nil, http.StatusNotFound},
+		{"empty query", `{"query": " "}`, nil, http.StatusBadRequest},
+		{"invalid body", `{"query":`, nil, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got SearchParams
+			app := &application{
+				geo: &MockGeoService{
+					AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+						got = params
+						return tt.found, nil
+					},
+				},
+				logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/address/clean", strings.NewReader(tt.body))
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app.setupRouter().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status code %d but got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got.Count != cleanCandidates {
+				t.Errorf("expected %d candidates to be requested, got %d", cleanCandidates, got.Count)
+			}
+			var resp CleanResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.UnrestrictedValue != "127642, г Москва, ул Сухонская, д 11" || resp.Components.City != "Москва" {
+				t.Errorf("wrong response %s", w.Body.String())
+			}
+		})
+	}
+}
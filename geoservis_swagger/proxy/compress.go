@@ -0,0 +1,248 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinSize is the smallest body worth compressing; below it the
+// encoding overhead outweighs the savings.
+const compressMinSize = 1024
+
+// compressTypes are the media types that are compressed. Streamed responses,
+// text/event-stream from upstreams, application/x-ndjson from the batch
+// endpoints and text/csv job results, are left out on purpose: a compressor
+// holds back data the client is waiting for.
+var compressTypes = map[string]bool{
+	"application/geo+json":      true,
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/manifest+json": true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+	"text/css":                  true,
+	"text/html":                 true,
+	"text/javascript":           true,
+	"text/plain":                true,
+	"text/xml":                  true,
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	// level 5 keeps brotli about as fast as gzip on dynamic responses
+	brotliWriters = sync.Pool{New: func() any {
+		return brotli.NewWriterLevel(nil, 5)
+	}}
+)
+
+// compress encodes responses with brotli or gzip, whichever the client
+// prefers to accept, br winning ties.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// WebSocket connections are hijacked, HEAD has no body
+		if r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		encoding := ""
+		br, gz := encodingQuality(r, "br"), encodingQuality(r, "gzip")
+		switch {
+		case br > 0 && br >= gz:
+			encoding = "br"
+		case gz > 0:
+			encoding = "gzip"
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the start of a response until it knows whether the
+// response is worth compressing, then either encodes or passes it through.
+type compressWriter struct {
+	http.ResponseWriter
+	// negotiated encoding, empty when the client accepts neither
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	enc      io.WriteCloser
+}
+
+// compressible reports whether a response with header h and status may be
+// encoded by this middleware, and whether it may vary by Accept-Encoding.
+func compressible(h http.Header, status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return compressTypes[mediaType]
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= compressMinSize {
+		err := cw.decide(false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the header and the buffered body, encoding them if the
+// response qualifies. Unless the body is complete, a body of unknown length
+// is assumed to be large.
+func (cw *compressWriter) decide(complete bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 && h.Get("Content-Encoding") == "" {
+		// what net/http would send, needed to check the allowlist
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	large := !complete || len(cw.buf) >= compressMinSize
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		large = n >= compressMinSize
+	}
+	if h.Get("Content-Encoding") != "" && !varies(h) {
+		// passed through as the upstream encoded it, but the encoding was
+		// still negotiated
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if compressible(h, cw.status) {
+		h.Add("Vary", "Accept-Encoding")
+		if cw.encoding != "" && large {
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+			// the encoded body is a different representation
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			cw.enc = cw.newEncoder()
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// varies reports whether h already has Accept-Encoding in Vary.
+func varies(h http.Header) bool {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept-Encoding") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cw *compressWriter) newEncoder() io.WriteCloser {
+	if cw.encoding == "br" {
+		bw := brotliWriters.Get().(*brotli.Writer)
+		bw.Reset(cw.ResponseWriter)
+		return bw
+	}
+	gw := gzipWriters.Get().(*gzip.Writer)
+	gw.Reset(cw.ResponseWriter)
+	return gw
+}
+
+// Flush sends what has been written so far, compressed or not, so streams
+// the allowlist lets through still reach the client on time.
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(false)
+	}
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Flush()
+	case *brotli.Writer:
+		enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response once the handler has returned.
+func (cw *compressWriter) Close() error {
+	if cw.status == 0 {
+		return nil
+	}
+	if !cw.decided {
+		err := cw.decide(true)
+		if err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *brotli.Writer:
+		brotliWriters.Put(enc)
+	}
+	cw.enc = nil
+	return err
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decode undoes the Content-Encoding of a recorded response.
+func decode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var r io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case "br":
+		r = brotli.NewReader(w.Body)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"city":"Москва"},`, 200)
+	tests := []struct {
+		name     string
+		accept   string
+		header   map[string]string
+		status   int
+		body     string
+		encoding string
+		vary     bool
+	}{
+		{"brotli", "gzip, deflate, br", map[string]string{"Content-Type": "application/json"}, 200, large, "br", true},
+		{"gzip", "gzip", map[string]string{"Content-Type": "application/json"}, 200, large, "gzip", true},
+		{"brotli refused", "br;q=0, gzip", map[string]string{"Content-Type": "application/json"}, 200, large, "gzip", true},
+		{"gzip preferred", "gzip;q=1, br;q=0.1", map[string]string{"Content-Type": "application/json"}, 200, large, "gzip", true},
+		{"brotli preferred", "gzip;q=0.5, br;q=0.8", map[string]string{"Content-Type": "application/json"}, 200, large, "br", true},
+		{"tie", "gzip;q=0.5, br;q=0.5", map[string]string{"Content-Type": "application/json"}, 200, large, "br", true},
+		{"gzip by star", "br;q=0.2, *;q=0.9", map[string]string{"Content-Type": "application/json"}, 200, large, "gzip", true},
+		{"identity", "", map[string]string{"Content-Type": "application/json"}, 200, large, "", true},
+		{"small", "br", map[string]string{"Content-Type": "application/json"}, 200, `{"ok":true}`, "", true},
+		{"html error page", "gzip", map[string]string{"Content-Type": "text/html; charset=utf-8"}, 502, strings.Repeat("<p>ошибка</p>", 100), "gzip", true},
+		{"sniffed html", "gzip", nil, 200, "<!DOCTYPE html>" + strings.Repeat("<p>x</p>", 200), "gzip", true},
+		{"image", "br", map[string]string{"Content-Type": "image/png"}, 200, large, "", false},
+		{"event stream", "br", map[string]string{"Content-Type": "text/event-stream"}, 200, large, "", false},
+		{"ndjson", "br", map[string]string{"Content-Type": "application/x-ndjson"}, 200, large, "", false},
+		{"already compressed", "br", map[string]string{"Content-Type": "text/html", "Content-Encoding": "gzip"}, 200, large, "gzip", true},
+		{"no-transform", "br", map[string]string{"Content-Type": "text/html", "Cache-Control": "no-transform"}, 200, large, "", false},
+		{"no content", "br", map[string]string{"Content-Type": "application/json"}, 204, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				// several writes, the first below the threshold
+				for i := 0; i < len(tt.body); i += 100 {
+					end := i + 100
+					if end > len(tt.body) {
+						end = len(tt.body)
+					}
+					io.WriteString(w, tt.body[i:end])
+				}
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding %q, want %q", got, tt.encoding)
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tt.vary {
+				t.Errorf("Vary %q", w.Header().Get("Vary"))
+			}
+			if tt.header["Content-Encoding"] != "" {
+				// passed through untouched
+				if w.Body.String() != tt.body {
+					t.Error("body was altered")
+				}
+			} else if got := decode(t, w); got != tt.body {
+				t.Errorf("body differs after decoding: %d bytes, want %d", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompress_headers(t *testing.T) {
+	body := strings.Repeat("body{color:red}\n", 200)
+	h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		w.Header().Set("Content-Length", "3200")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Vary", "Origin")
+		io.WriteString(w, body)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	hdr := w.Header()
+	if hdr.Get("Content-Length") != "" || hdr.Get("Accept-Ranges") != "" {
+		t.Errorf("length headers of the identity body were kept: %v", hdr)
+	}
+	if hdr.Get("ETag") != `W/"abc"` {
+		t.Errorf("ETag %q", hdr.Get("ETag"))
+	}
+	if vary := hdr.Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Errorf("Vary %v", vary)
+	}
+	if decode(t, w) != body {
+		t.Error("body differs after decoding")
+	}
+
+	// HEAD and WebSocket upgrades are not wrapped
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodHead, "/", nil),
+		httptest.NewRequest(http.MethodGet, "/ws", nil),
+	} {
+		r.Header.Set("Accept-Encoding", "gzip")
+		if r.Method == http.MethodGet {
+			r.Header.Set("Upgrade", "websocket")
+		}
+		var wrapped bool
+		h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, wrapped = w.(*compressWriter)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if wrapped {
+			t.Errorf("%s %s was wrapped", r.Method, r.URL.Path)
+		}
+	}
+}
+
+// TestCompress_streaming checks that streamed lines reach the client before
+// the handler returns, compressed or not.
+func TestCompress_streaming(t *testing.T) {
+	for _, ctype := range []string{"application/x-ndjson", "application/json"} {
+		t.Run(ctype, func(t *testing.T) {
+			release := make(chan struct{})
+			srv := httptest.NewServer(compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", ctype)
+				io.WriteString(w, "{\"n\":1}\n")
+				w.(http.Flusher).Flush()
+				<-release
+				io.WriteString(w, "{\"n\":2}\n")
+			})))
+			defer srv.Close()
+			defer close(release)
+
+			// the default transport asks for gzip and decodes it
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			line := make(chan string, 1)
+			go func() {
+				s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				line <- s
+			}()
+			select {
+			case s := <-line:
+				if s != "{\"n\":1}\n" {
+					t.Errorf("got %q", s)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("the first line was held back")
+			}
+		})
+	}
+}
+
+func TestCompress_router(t *testing.T) {
+	page := "<!DOCTYPE html>" + strings.Repeat("<p>Задачи с proxy</p>", 100)
+	hugo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("Accept-Encoding") == "gzip" && r.URL.Path == "/gzipped/" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			io.WriteString(gw, page)
+			gw.Close()
+			return
+		}
+		io.WriteString(w, page)
+	}))
+	defer hugo.Close()
+
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{
+		Routes: []RouteConfig{
+			{Prefix: "/api", Local: true},
+			{Prefix: "/", Upstreams: []string{hugo.URL}},
+		},
+		Cache: &CacheConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{proxy: rp, admins: map[string]bool{"admin": true}}
+	router := app.setupRouter()
+
+	tests := []struct {
+		path, accept, encoding, cache string
+	}{
+		{"/posts/", "br", "br", "MISS"},
+		{"/posts/", "br", "br", "HIT"},
+		{"/posts/", "gzip", "gzip", "HIT"},
+		{"/posts/", "", "", "HIT"},
+		{"/gzipped/", "gzip", "gzip", "MISS"},
+		{"/gzipped/", "gzip", "gzip", "HIT"},
+		// the stored entry is encoded, so it varies by Accept-Encoding
+		{"/gzipped/", "", "", "MISS"},
+		{"/api/debug/vars", "br", "br", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Encoding", tt.accept)
+		}
+		if strings.HasPrefix(tt.path, "/api/") {
+			r.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("admin")})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != tt.encoding || w.Header().Get("X-Cache") != tt.cache {
+			t.Errorf("%s %q: got %q %q", tt.path, tt.accept, w.Header().Get("Content-Encoding"), w.Header().Get("X-Cache"))
+		}
+		if got := w.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+			t.Errorf("%s %q: Vary %v", tt.path, tt.accept, got)
+		}
+		body := decode(t, w)
+		if tt.path != "/api/debug/vars" && body != page {
+			t.Errorf("%s %q: page differs after decoding", tt.path, tt.accept)
+		}
+	}
+}
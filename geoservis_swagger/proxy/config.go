@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets in logs and printed configuration.
+const redacted = "[REDACTED]"
+
+// Secret is a configuration value that never shows up in logs or printed
+// configuration. Value returns the secret itself.
+type Secret string
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) MarshalYAML() (any, error) {
+	return s.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	err := value.Decode(&s)
+	if err != nil {
+		return fmt.Errorf("line %d: duration must be a string such as \"10s\"", value.Line)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// DaDataConfig holds the credentials of the DaData API.
+type DaDataConfig struct {
+	APIKey Secret `yaml:"api_key"`
+	// ignored, the suggestions API needs only the API key; still accepted so
+	// older configuration files load
+	SecretKey Secret `yaml:"secret_key,omitempty"`
+}
+
+// ProxyServerConfig chooses what serves everything outside the API: a
+// routing table file, a built site or, by default, a single upstream.
+type ProxyServerConfig struct {
+	// host:port of the Hugo server
+	Upstream string `yaml:"upstream"`
+	// JSON routing table, see ProxyConfig
+	Routes string `yaml:"routes"`
+	// built Hugo site, or "embed"
+	StaticDir string `yaml:"static_dir"`
+}
+
+// WorkersConfig sizes the geocoding done in the background and by batch
+// requests.
+type WorkersConfig struct {
+	// goroutines processing uploaded jobs
+	Jobs int `yaml:"jobs"`
+	// concurrent lookups of one batch request
+	Batch int `yaml:"batch"`
+	// most addresses in one batch request
+	BatchMaxItems int `yaml:"batch_max_items"`
+}
+
+// SecretsConfig chooses where the JWT secret and the DaData keys come from.
+// Without a provider they are read once from the configuration; with one they
+// are read from it at startup and again every refresh interval.
+type SecretsConfig struct {
+	// env, file or vault; empty uses jwt_secret and dadata
+	Provider string `yaml:"provider"`
+	// directory of secret files for the file provider
+	Dir string `yaml:"dir"`
+	// how often the provider is read again, 0 reads it only at startup
+	Refresh Duration    `yaml:"refresh"`
+	Vault   VaultConfig `yaml:"vault"`
+}
+
+// VaultConfig locates the secret in a Vault KV version 2 engine whose fields
+// are the secrets.
+type VaultConfig struct {
+	Addr  string `yaml:"addr"`
+	Token Secret `yaml:"token"`
+	Mount string `yaml:"mount"`
+	Path  string `yaml:"path"`
+}
+
+// Config is the configuration of the server. Values come from defaults, a
+// YAML file, environment variables and flags, each overriding the previous.
+type Config struct {
+	Listen          string            `yaml:"listen"`
+	ShutdownTimeout Duration          `yaml:"shutdown_timeout"`
+	JWTSecret       Secret            `yaml:"jwt_secret"`
+	DaData          DaDataConfig      `yaml:"dadata"`
+	Secrets         SecretsConfig     `yaml:"secrets"`
+	DatabaseDSN     string            `yaml:"database_dsn"`
+	Proxy           ProxyServerConfig `yaml:"proxy"`
+	// which address suggestions are returned
+	Filter  FilterPolicy  `yaml:"filter"`
+	Workers WorkersConfig `yaml:"workers"`
+	// emails of users allowed to administer the proxy
+	Admins []string `yaml:"admins"`
+}
+
+// defaultDSN keeps users, jobs, zones and POIs in a file next to the binary,
+// so queued jobs survive a restart. WAL and the busy timeout let the job
+// workers write while requests read.
+const defaultDSN = "file:geoservis.db?_busy_timeout=5000&_journal_mode=WAL"
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: Duration(5 * time.Second),
+		DatabaseDSN:     defaultDSN,
+		Proxy:           ProxyServerConfig{Upstream: "hugo_task:1313"},
+		Filter:          DefaultFilterPolicy,
+		Workers: WorkersConfig{
+			Jobs:          defaultJobWorkers,
+			Batch:         defaultBatchWorkers,
+			BatchMaxItems: defaultBatchMaxItems,
+		},
+		Secrets: SecretsConfig{
+			Dir:     "/run/secrets",
+			Refresh: Duration(time.Minute),
+			Vault:   VaultConfig{Mount: "secret", Path: "geoservis"},
+		},
+	}
+}
+
+// loadFile overrides cfg with the values present in a YAML file.
+func (cfg *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides cfg with the environment variables that are set.
+func (cfg *Config) loadEnv(getenv func(string) string) error {
+	set := func(dst *string, name string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	setSecret := func(dst *Secret, name string) {
+		if v := getenv(name); v != "" {
+			*dst = Secret(v)
+		}
+	}
+	set(&cfg.Listen, "LISTEN_ADDR")
+	setSecret(&cfg.JWTSecret, "JWT_SECRET")
+	setSecret(&cfg.DaData.APIKey, "DADATA_API_KEY")
+	set(&cfg.DatabaseDSN, "DB_DSN")
+	set(&cfg.Proxy.Upstream, "HUGO_UPSTREAM")
+	set(&cfg.Proxy.Routes, "PROXY_ROUTES")
+	set(&cfg.Proxy.StaticDir, "STATIC_DIR")
+	set(&cfg.Filter.MinFiasLevel, "FILTER_MIN_FIAS_LEVEL")
+	if v := getenv("FILTER_REQUIRE_COORDS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("FILTER_REQUIRE_COORDS: %w", err)
+		}
+		cfg.Filter.RequireCoords = b
+	}
+	for name, dst := range map[string]*int{
+		"JOB_WORKERS":     &cfg.Workers.Jobs,
+		"BATCH_WORKERS":   &cfg.Workers.Batch,
+		"BATCH_MAX_ITEMS": &cfg.Workers.BatchMaxItems,
+	} {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = n
+		}
+	}
+	set(&cfg.Secrets.Provider, "SECRETS_PROVIDER")
+	set(&cfg.Secrets.Dir, "SECRETS_DIR")
+	set(&cfg.Secrets.Vault.Addr, "VAULT_ADDR")
+	setSecret(&cfg.Secrets.Vault.Token, "VAULT_TOKEN")
+	set(&cfg.Secrets.Vault.Mount, "VAULT_KV_MOUNT")
+	set(&cfg.Secrets.Vault.Path, "VAULT_KV_PATH")
+	for name, dst := range map[string]*Duration{
+		"SHUTDOWN_TIMEOUT": &cfg.ShutdownTimeout,
+		"SECRETS_REFRESH":  &cfg.Secrets.Refresh,
+	} {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = Duration(d)
+		}
+	}
+	if v := getenv("ADMIN_EMAILS"); v != "" {
+		cfg.Admins = splitList(v)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// Validate reports every invalid setting at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if _, port, err := net.SplitHostPort(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("listen: invalid port %q", port))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	switch cfg.Secrets.Provider {
+	case "":
+		if len(cfg.JWTSecret) < 16 {
+			errs = append(errs, errors.New("jwt_secret (JWT_SECRET) must be at least 16 characters"))
+		}
+		if cfg.DaData.APIKey == "" {
+			errs = append(errs, errors.New("dadata.api_key (DADATA_API_KEY) is required"))
+		}
+	case "env":
+	case "file":
+		if cfg.Secrets.Dir == "" {
+			errs = append(errs, errors.New("secrets.dir (SECRETS_DIR) is required by the file provider"))
+		}
+	case "vault":
+		if _, err := url.ParseRequestURI(cfg.Secrets.Vault.Addr); err != nil || cfg.Secrets.Vault.Addr == "" {
+			errs = append(errs, errors.New("secrets.vault.addr (VAULT_ADDR) must be a URL"))
+		}
+		if cfg.Secrets.Vault.Token == "" {
+			errs = append(errs, errors.New("secrets.vault.token (VAULT_TOKEN) is required"))
+		}
+		if cfg.Secrets.Vault.Path == "" {
+			errs = append(errs, errors.New("secrets.vault.path (VAULT_KV_PATH) is required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("secrets.provider: unknown provider %q, want env, file or vault", cfg.Secrets.Provider))
+	}
+	if cfg.Secrets.Provider != "" && cfg.Secrets.Refresh < 0 {
+		errs = append(errs, errors.New("secrets.refresh must not be negative"))
+	}
+	if cfg.DatabaseDSN == "" {
+		errs = append(errs, errors.New("database_dsn is empty"))
+	}
+	if cfg.Proxy.Routes != "" && cfg.Proxy.StaticDir != "" {
+		errs = append(errs, errors.New("proxy: set either routes or static_dir"))
+	}
+	if cfg.Proxy.Routes == "" && cfg.Proxy.StaticDir == "" {
+		if _, _, err := net.SplitHostPort(cfg.Proxy.Upstream); err != nil {
+			errs = append(errs, fmt.Errorf("proxy.upstream: %w", err))
+		}
+	}
+	if err := cfg.Filter.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("filter.min_fias_level: %w", err))
+	}
+	for _, w := range []struct {
+		name string
+		n    int
+	}{
+		{"workers.jobs (JOB_WORKERS)", cfg.Workers.Jobs},
+		{"workers.batch (BATCH_WORKERS)", cfg.Workers.Batch},
+		{"workers.batch_max_items (BATCH_MAX_ITEMS)", cfg.Workers.BatchMaxItems},
+	} {
+		if w.n <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", w.name))
+		}
+	}
+	for _, email := range cfg.Admins {
+		if !strings.Contains(email, "@") {
+			errs = append(errs, fmt.Errorf("admins: invalid email %q", email))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// secretProvider returns the configured provider, nil when the secrets come
+// from the configuration itself.
+func (cfg *Config) secretProvider() SecretProvider {
+	switch cfg.Secrets.Provider {
+	case "env":
+		return EnvSecrets{}
+	case "file":
+		return FileSecrets{Dir: cfg.Secrets.Dir}
+	case "vault":
+		v := cfg.Secrets.Vault
+		return &VaultSecrets{
+			Addr:   v.Addr,
+			Token:  v.Token.Value(),
+			Mount:  v.Mount,
+			Path:   v.Path,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return nil
+}
+
+// LogValue logs the configuration with its secrets redacted.
+func (cfg *Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("listen", cfg.Listen),
+		slog.Duration("shutdown_timeout", time.Duration(cfg.ShutdownTimeout)),
+		slog.Any("jwt_secret", cfg.JWTSecret),
+		slog.Any("dadata_api_key", cfg.DaData.APIKey),
+		slog.String("secrets_provider", cfg.Secrets.Provider),
+		slog.String("filter_min_fias_level", cfg.Filter.MinFiasLevel),
+		slog.Bool("filter_require_coords", cfg.Filter.RequireCoords),
+		slog.Int("job_workers", cfg.Workers.Jobs),
+		slog.Int("batch_workers", cfg.Workers.Batch),
+		slog.Int("batch_max_items", cfg.Workers.BatchMaxItems),
+		slog.String("database_dsn", cfg.DatabaseDSN),
+		slog.String("proxy_upstream", cfg.Proxy.Upstream),
+		slog.String("proxy_routes", cfg.Proxy.Routes),
+		slog.String("proxy_static_dir", cfg.Proxy.StaticDir),
+		slog.Any("admins", cfg.Admins),
+	)
+}
+
+// loadConfig builds the configuration from the file named by -config or
+// CONFIG_FILE, the environment and the flags in args. It also reports whether
+// -print-config was given.
+func loadConfig(args []string, getenv func(string) string, output io.Writer) (*Config, bool, error) {
+	fs := flag.NewFlagSet("geoservis", flag.ContinueOnError)
+	fs.SetOutput(output)
+	var (
+		path      = fs.String("config", getenv("CONFIG_FILE"), "YAML configuration file (CONFIG_FILE)")
+		printOnly = fs.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+		listen    = fs.String("listen", "", "listen address (LISTEN_ADDR), default :8080")
+		shutdown  = fs.Duration("shutdown-timeout", 0, "how long requests may finish on shutdown (SHUTDOWN_TIMEOUT), default 5s")
+		dsn       = fs.String("db-dsn", "", "SQLite data source name (DB_DSN), default "+defaultDSN)
+		upstream  = fs.String("upstream", "", "host:port of the Hugo server (HUGO_UPSTREAM), default hugo_task:1313")
+		routes    = fs.String("routes", "", "JSON routing table of the proxy (PROXY_ROUTES)")
+		staticDir = fs.String("static-dir", "", "built Hugo site served instead of the upstream, or embed (STATIC_DIR)")
+		minLevel  = fs.String("min-fias-level", "", "coarsest FIAS level of returned addresses, empty keeps all (FILTER_MIN_FIAS_LEVEL), default 6")
+		coords    = fs.Bool("require-coords", false, "drop addresses without coordinates (FILTER_REQUIRE_COORDS)")
+		jobs      = fs.Int("job-workers", 0, "goroutines processing uploaded jobs (JOB_WORKERS), default "+strconv.Itoa(defaultJobWorkers))
+		batch     = fs.Int("batch-workers", 0, "concurrent lookups of one batch request (BATCH_WORKERS), default "+strconv.Itoa(defaultBatchWorkers))
+		batchMax  = fs.Int("batch-max-items", 0, "most addresses in one batch request (BATCH_MAX_ITEMS), default "+strconv.Itoa(defaultBatchMaxItems))
+		provider  = fs.String("secrets-provider", "", "where secrets are read from and refreshed: env, file or vault (SECRETS_PROVIDER)")
+		admins    = fs.String("admins", "", "comma-separated emails of admins (ADMIN_EMAILS)")
+	)
+	// secrets have no flags, command lines are visible to every local user
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cfg := DefaultConfig()
+	if *path != "" {
+		err = cfg.loadFile(*path)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err = cfg.loadEnv(getenv)
+	if err != nil {
+		return nil, false, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = Duration(*shutdown)
+		case "db-dsn":
+			cfg.DatabaseDSN = *dsn
+		case "upstream":
+			cfg.Proxy.Upstream = *upstream
+		case "routes":
+			cfg.Proxy.Routes = *routes
+		case "static-dir":
+			cfg.Proxy.StaticDir = *staticDir
+		case "min-fias-level":
+			cfg.Filter.MinFiasLevel = *minLevel
+		case "require-coords":
+			cfg.Filter.RequireCoords = *coords
+		case "job-workers":
+			cfg.Workers.Jobs = *jobs
+		case "batch-workers":
+			cfg.Workers.Batch = *batch
+		case "batch-max-items":
+			cfg.Workers.BatchMaxItems = *batchMax
+		case "secrets-provider":
+			cfg.Secrets.Provider = *provider
+		case "admins":
+			cfg.Admins = splitList(*admins)
+		}
+	})
+	return cfg, *printOnly, nil
+}
+
+// printConfig writes cfg as YAML with its secrets redacted.
+func printConfig(w io.Writer, cfg *Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(cfg)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func envOf(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, printOnly, err := loadConfig(nil, envOf(nil), io.Discard)
+	if err != nil || printOnly {
+		t.Fatal(err, printOnly)
+	}
+	if fmt.Sprint(cfg) != fmt.Sprint(DefaultConfig()) {
+		t.Errorf("defaults: got %+v", cfg)
+	}
+
+	cfg, _, err = loadConfig([]string{"-config", "testdata/config.yaml"}, envOf(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":9000" || cfg.ShutdownTimeout != Duration(10*time.Second) ||
+		cfg.JWTSecret.Value() != "file-secret-0123456789" || cfg.DaData.APIKey.Value() != "file-api-key" ||
+		cfg.DatabaseDSN != "file:geo.db?cache=shared" || cfg.Proxy.Upstream != "hugo:1313" ||
+		len(cfg.Admins) != 1 || cfg.Admins[0] != "admin@example.com" {
+		t.Errorf("file: got %#v", cfg)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		listen string
+	}{
+		{"file", nil, map[string]string{"CONFIG_FILE": "testdata/config.yaml"}, ":9000"},
+		{"env over file", nil, map[string]string{"CONFIG_FILE": "testdata/config.yaml", "LISTEN_ADDR": ":9100"}, ":9100"},
+		{"flag over env", []string{"-listen", ":9200"}, map[string]string{"CONFIG_FILE": "testdata/config.yaml", "LISTEN_ADDR": ":9100"}, ":9200"},
+		{"flag names the file", []string{"--config=testdata/config.yaml"}, map[string]string{"CONFIG_FILE": "missing.yaml"}, ":9000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := loadConfig(tt.args, envOf(tt.env), io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != tt.listen {
+				t.Errorf("listen %q, want %q", cfg.Listen, tt.listen)
+			}
+			// untouched settings keep the file's values
+			if cfg.Proxy.Upstream != "hugo:1313" {
+				t.Errorf("upstream %q", cfg.Proxy.Upstream)
+			}
+		})
+	}
+
+	cfg, _, err = loadConfig([]string{"-secrets-provider", "vault"}, envOf(map[string]string{
+		"SECRETS_PROVIDER": "file", "SECRETS_REFRESH": "30s",
+		"VAULT_ADDR": "http://vault:8200", "VAULT_TOKEN": "s.token", "VAULT_KV_PATH": "geo/prod",
+	}), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cfg.Secrets; s.Provider != "vault" || s.Refresh != Duration(30*time.Second) || s.Dir != "/run/secrets" ||
+		s.Vault.Addr != "http://vault:8200" || s.Vault.Token.Value() != "s.token" || s.Vault.Mount != "secret" || s.Vault.Path != "geo/prod" {
+		t.Errorf("secrets: got %#v", s)
+	}
+
+	cfg, _, err = loadConfig([]string{"-min-fias-level", "7"}, envOf(map[string]string{
+		"FILTER_MIN_FIAS_LEVEL": "8", "FILTER_REQUIRE_COORDS": "true",
+	}), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Filter != (FilterPolicy{MinFiasLevel: "7", RequireCoords: true}) {
+		t.Errorf("filter: got %+v", cfg.Filter)
+	}
+
+	cfg, _, err = loadConfig([]string{"-batch-workers", "4"}, envOf(map[string]string{
+		"JOB_WORKERS": "3", "BATCH_WORKERS": "16", "BATCH_MAX_ITEMS": "50",
+	}), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Workers != (WorkersConfig{Jobs: 3, Batch: 4, BatchMaxItems: 50}) {
+		t.Errorf("workers: got %+v", cfg.Workers)
+	}
+
+	cfg, printOnly, err = loadConfig(
+		[]string{"--print-config", "-shutdown-timeout", "1m", "-admins", "a@b.c, d@e.f", "-routes", "routes.json"},
+		envOf(map[string]string{"SHUTDOWN_TIMEOUT": "30s", "ADMIN_EMAILS": "x@y.z", "DADATA_API_KEY": "env-key", "STATIC_DIR": "/site"}),
+		io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printOnly || cfg.ShutdownTimeout != Duration(time.Minute) || fmt.Sprint(cfg.Admins) != "[a@b.c d@e.f]" ||
+		cfg.DaData.APIKey.Value() != "env-key" || cfg.Proxy.Routes != "routes.json" || cfg.Proxy.StaticDir != "/site" {
+		t.Errorf("flags and env: got %#v", cfg)
+	}
+
+	errs := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"unknown flag", []string{"-jwt-secret", "x"}, nil},
+		{"bad flag duration", []string{"-shutdown-timeout", "soon"}, nil},
+		{"bad env duration", nil, map[string]string{"SHUTDOWN_TIMEOUT": "soon"}},
+		{"bad refresh", nil, map[string]string{"SECRETS_REFRESH": "often"}},
+		{"bad require coords", nil, map[string]string{"FILTER_REQUIRE_COORDS": "maybe"}},
+		{"bad job workers", nil, map[string]string{"JOB_WORKERS": "many"}},
+		{"bad flag batch size", []string{"-batch-max-items", "lots"}, nil},
+		{"missing file", []string{"-config", "testdata/missing.yaml"}, nil},
+		{"unknown file field", []string{"-config", "testdata/routes.json"}, nil},
+	}
+	for _, tt := range errs {
+		if _, _, err := loadConfig(tt.args, envOf(tt.env), io.Discard); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() *Config {
+		cfg := DefaultConfig()
+		cfg.JWTSecret = "0123456789abcdef"
+		cfg.DaData = DaDataConfig{APIKey: "key"}
+		return cfg
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"listen without port", func(c *Config) { c.Listen = "localhost" }, "listen"},
+		{"listen port", func(c *Config) { c.Listen = ":http-alt" }, "invalid port"},
+		{"shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown_timeout"},
+		{"short jwt secret", func(c *Config) { c.JWTSecret = "secret" }, "jwt_secret"},
+		{"dadata key", func(c *Config) { c.DaData.APIKey = "" }, "dadata.api_key"},
+		{"dsn", func(c *Config) { c.DatabaseDSN = "" }, "database_dsn"},
+		{"routes and static", func(c *Config) { c.Proxy.Routes, c.Proxy.StaticDir = "r.json", "site" }, "either routes or static_dir"},
+		{"upstream", func(c *Config) { c.Proxy.Upstream = "hugo_task" }, "proxy.upstream"},
+		{"admin", func(c *Config) { c.Admins = []string{"admin"} }, "invalid email"},
+		{"fias level", func(c *Config) { c.Filter.MinFiasLevel = "2" }, "filter.min_fias_level"},
+		{"job workers", func(c *Config) { c.Workers.Jobs = 0 }, "workers.jobs"},
+		{"batch workers", func(c *Config) { c.Workers.Batch = -1 }, "workers.batch "},
+		{"batch size", func(c *Config) { c.Workers.BatchMaxItems = 0 }, "workers.batch_max_items"},
+		{"secrets provider", func(c *Config) { c.Secrets.Provider = "aws" }, "unknown provider"},
+		{"secrets dir", func(c *Config) { c.Secrets.Provider, c.Secrets.Dir = "file", "" }, "secrets.dir"},
+		{"vault addr", func(c *Config) { c.Secrets.Provider, c.Secrets.Vault.Token = "vault", "t" }, "secrets.vault.addr"},
+		{"vault token", func(c *Config) { c.Secrets.Provider, c.Secrets.Vault.Addr = "vault", "http://vault:8200" }, "secrets.vault.token"},
+	}
+	for _, tt := range tests {
+		cfg := valid()
+		tt.modify(cfg)
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	// a routing table replaces the upstream
+	cfg := valid()
+	cfg.Proxy.Upstream, cfg.Proxy.Routes = "", "routes.json"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("routes without upstream: %v", err)
+	}
+
+	// a provider supplies the secrets instead
+	cfg = valid()
+	cfg.JWTSecret, cfg.DaData = "", DaDataConfig{}
+	cfg.Secrets.Provider = "file"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("file provider: %v", err)
+	}
+
+	// every problem is reported at once
+	err := (&Config{}).Validate()
+	if err == nil || strings.Count(err.Error(), "\n") < 4 {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestConfig_redaction(t *testing.T) {
+	cfg, _, err := loadConfig([]string{"-config", "testdata/config.yaml"}, envOf(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := []string{"file-secret-0123456789", "file-api-key", "file-secret-key"}
+
+	var logs bytes.Buffer
+	slog.New(slog.NewJSONHandler(&logs, nil)).Info("configuration loaded", "config", cfg)
+	slog.New(slog.NewTextHandler(&logs, nil)).Info("key", "key", cfg.DaData.APIKey)
+	var printed bytes.Buffer
+	err = printConfig(&printed, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := map[string]string{
+		"log":     logs.String(),
+		"print":   printed.String(),
+		"fmt %v":  fmt.Sprintf("%v %+v", cfg, *cfg),
+		"fmt %#v": fmt.Sprintf("%#v", cfg),
+	}
+	for name, out := range outputs {
+		for _, s := range secrets {
+			if strings.Contains(out, s) {
+				t.Errorf("%s reveals %s: %s", name, s, out)
+			}
+		}
+		if !strings.Contains(out, redacted) {
+			t.Errorf("%s: nothing redacted: %s", name, out)
+		}
+	}
+
+	// the printed configuration is a valid file again
+	var back Config
+	err = yaml.Unmarshal(printed.Bytes(), &back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Listen != cfg.Listen || back.ShutdownTimeout != cfg.ShutdownTimeout || back.JWTSecret != redacted {
+		t.Errorf("round trip: got %#v", back)
+	}
+}
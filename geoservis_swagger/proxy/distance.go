@@ -0,0 +1,26 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"test/geo"
+)
+
+// setDistances fills in each address's distance from the query point, rounded
+// to whole meters. Addresses without coordinates are left without distance.
+func setDistances(addresses []*Address, lat, lng string) {
+	qLat, err1 := strconv.ParseFloat(lat, 64)
+	qLng, err2 := strconv.ParseFloat(lng, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	for _, a := range addresses {
+		aLat, err1 := strconv.ParseFloat(a.Lat, 64)
+		aLon, err2 := strconv.ParseFloat(a.Lon, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		d := math.Round(geo.Haversine(geo.Point{Lat: qLat, Lon: qLng}, geo.Point{Lat: aLat, Lon: aLon}))
+		a.Distance = &d
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSetDistances(t *testing.T) {
+	addresses := []*Address{{Lat: "55.8782557", Lon: "37.65372"}, {Lat: "", Lon: ""}}
+	setDistances(addresses, "55.878", "37.653")
+	if addresses[0].Distance == nil {
+		t.Fatal("distance not set")
+	}
+	if *addresses[0].Distance != 53 {
+		t.Errorf("wrong distance %v", *addresses[0].Distance)
+	}
+	if addresses[1].Distance != nil {
+		t.Error("address without coordinates should have no distance")
+	}
+}
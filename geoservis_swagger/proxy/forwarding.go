@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// viaPseudonym names this proxy in Via headers.
+const viaPseudonym = "geoservis"
+
+// parseTrustedProxies accepts addresses and CIDR prefixes.
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var res []netip.Prefix
+	for _, s := range list {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			res = append(res, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		res = append(res, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return res, nil
+}
+
+// clientAddr is the address of the peer that sent r.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// trusts reports whether forwarding headers sent by the peer of r describe
+// the original client and should be kept.
+func (t *routeTable) trusts(r *http.Request) bool {
+	addr, ok := clientAddr(r)
+	if !ok {
+		return false
+	}
+	for _, p := range t.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedNode formats an address as a node of RFC 7239, quoting IPv6.
+func forwardedNode(addr netip.Addr) string {
+	if addr.Is6() {
+		return `"[` + addr.String() + `]"`
+	}
+	return addr.String()
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is a token.
+func forwardedValue(v string) string {
+	if v != "" && strings.IndexFunc(v, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+	}) < 0 {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// setForwardingHeaders prepares out, the request to the upstream, from the
+// original client request. Headers from an untrusted peer are replaced, those
+// from a trusted proxy are extended. X-Forwarded-For itself is appended by
+// httputil.ReverseProxy after the director returns.
+func setForwardingHeaders(out *http.Request, trusted bool) {
+	proto := "http"
+	if out.TLS != nil {
+		proto = "https"
+	}
+	if !trusted {
+		out.Header.Del("X-Forwarded-For")
+		out.Header.Del("X-Forwarded-Host")
+		out.Header.Del("X-Forwarded-Proto")
+		out.Header.Del("Forwarded")
+	}
+	if out.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", out.Host)
+	}
+	if out.Header.Get("X-Forwarded-Proto") == "" {
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	element := "for=unknown"
+	if addr, ok := clientAddr(out); ok {
+		element = "for=" + forwardedNode(addr)
+	}
+	element += ";host=" + forwardedValue(out.Host) + ";proto=" + proto
+	if prior := out.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	out.Header.Set("Forwarded", element)
+
+	addVia(out.Header, out.ProtoMajor, out.ProtoMinor)
+}
+
+// addVia appends this proxy to the Via header with the protocol version the
+// message was received with, as RFC 9110 requires.
+func addVia(h http.Header, major, minor int) {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = strconv.Itoa(major)
+	}
+	via := version + " " + viaPseudonym
+	if prior := h.Values("Via"); len(prior) > 0 {
+		via = strings.Join(prior, ", ") + ", " + via
+	}
+	h.Set("Via", via)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// headerEcho replies with the request headers it received, Host included.
+func headerEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := map[string]string{"Host": r.Host}
+		for k := range r.Header {
+			h[k] = r.Header.Get(k)
+		}
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		json.NewEncoder(w).Encode(h)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReverseProxy_forwarding(t *testing.T) {
+	upstream := headerEcho(t)
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{
+		TrustedProxies: []string{"192.0.2.0/24", "2001:db8::10"},
+		Routes: []RouteConfig{
+			{Prefix: "/", Upstreams: []string{upstream.URL}},
+			{Prefix: "/preserve", Upstreams: []string{upstream.URL}, PreserveHost: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxyRouter(rp)
+	upstreamHost := upstream.Listener.Addr().String()
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		header     map[string]string
+		want       map[string]string
+	}{
+		{
+			name:       "untrusted client headers are replaced",
+			path:       "/",
+			remoteAddr: "198.51.100.9:4000",
+			header: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Host":  "evil.example",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.2.3.4",
+			},
+			want: map[string]string{
+				"Host":              upstreamHost,
+				"X-Forwarded-For":   "198.51.100.9",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=198.51.100.9;host=example.com;proto=http",
+				"Via":               "1.1 geoservis",
+			},
+		},
+		{
+			name:       "trusted proxy headers are extended",
+			path:       "/",
+			remoteAddr: "192.0.2.7:4000",
+			header: map[string]string{
+				"X-Forwarded-For":   "203.0.113.5",
+				"X-Forwarded-Host":  "geo.example",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         `for=203.0.113.5;host=geo.example;proto=https`,
+				"Via":               "1.1 edge",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.5, 192.0.2.7",
+				"X-Forwarded-Host":  "geo.example",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=203.0.113.5;host=geo.example;proto=https, for=192.0.2.7;host=example.com;proto=http",
+				"Via":               "1.1 edge, 1.1 geoservis",
+			},
+		},
+		{
+			name:       "ipv6 client",
+			path:       "/",
+			remoteAddr: "[2001:db8::10]:4000",
+			want: map[string]string{
+				"X-Forwarded-For": "2001:db8::10",
+				"Forwarded":       `for="[2001:db8::10]";host=example.com;proto=http`,
+			},
+		},
+		{
+			name:       "preserved host",
+			path:       "/preserve",
+			remoteAddr: "198.51.100.9:4000",
+			want: map[string]string{
+				"Host":             "example.com",
+				"X-Forwarded-Host": "example.com",
+			},
+		},
+		{
+			name:       "hop-by-hop headers are dropped",
+			path:       "/",
+			remoteAddr: "198.51.100.9:4000",
+			header: map[string]string{
+				"Connection": "X-Secret",
+				"X-Secret":   "1",
+				"Keep-Alive": "timeout=5",
+			},
+			want: map[string]string{
+				"Connection": "",
+				"X-Secret":   "",
+				"Keep-Alive": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			var got map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err, w.Body.String())
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s: got %q, want %q", k, got[k], v)
+				}
+			}
+			if w.Header().Get("Via") != "1.1 geoservis" {
+				t.Errorf("response Via: got %q", w.Header().Get("Via"))
+			}
+			if w.Header().Get("X-Internal") != "" || w.Header().Get("Connection") != "" {
+				t.Errorf("hop-by-hop response headers leaked: %v", w.Header())
+			}
+		})
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	tests := map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": `"example.com:8080"`,
+		`a"b`:              `"a\"b"`,
+		"":                 `""`,
+	}
+	for in, want := range tests {
+		if got := forwardedValue(in); got != want {
+			t.Errorf("%q: got %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies([]string{"10.1.2.3/8", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "127.0.0.1/32", "::1/128"}
+	for i, p := range prefixes {
+		if p.String() != want[i] {
+			t.Errorf("got %s, want %s", p, want[i])
+		}
+	}
+
+	_, err = (&ProxyConfig{TrustedProxies: []string{"hugo_task"}}).compile()
+	if err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
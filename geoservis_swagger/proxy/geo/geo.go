@@ -0,0 +1,106 @@
+// Package geo implements geodesic calculations on WGS 84 coordinates.
+package geo
+
+import (
+	"errors"
+	"math"
+)
+
+// EarthRadiusMeters is the mean Earth radius used by the spherical formulas.
+const EarthRadiusMeters = 6371008.8
+
+// WGS 84 ellipsoid used by Vincenty.
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+)
+
+var ErrNoConvergence = errors.New("vincenty formula failed to converge")
+
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+func degrees(rad float64) float64 { return rad * 180 / math.Pi }
+
+// Haversine returns the great-circle distance between a and b in meters.
+func Haversine(a, b Point) float64 {
+	phi1 := radians(a.Lat)
+	phi2 := radians(b.Lat)
+	dPhi := radians(b.Lat - a.Lat)
+	dLambda := radians(b.Lon - a.Lon)
+
+	h := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * EarthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// Vincenty returns the ellipsoidal distance between a and b in meters using
+// the inverse Vincenty formula. It is accurate to well under a millimeter but
+// fails to converge for nearly antipodal points.
+func Vincenty(a, b Point) (float64, error) {
+	L := radians(b.Lon - a.Lon)
+	U1 := math.Atan((1 - wgs84F) * math.Tan(radians(a.Lat)))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(radians(b.Lat)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt((cosU2*sinLambda)*(cosU2*sinLambda) +
+			(cosU1*sinU2-sinU1*cosU2*cosLambda)*(cosU1*sinU2-sinU1*cosU2*cosLambda))
+		if sinSigma == 0 {
+			return 0, nil // coincident points
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cos2Alpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0
+		if cos2Alpha != 0 {
+			// zero on the equator
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cos2Alpha
+		}
+		C := wgs84F / 16 * cos2Alpha * (4 + wgs84F*(4-3*cos2Alpha))
+		prev := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-prev) < 1e-12 {
+			u2 := cos2Alpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+			A := 1 + u2/16384*(4096+u2*(-768+u2*(320-175*u2)))
+			B := u2 / 1024 * (256 + u2*(-128+u2*(74-47*u2)))
+			dSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return wgs84B * A * (sigma - dSigma), nil
+		}
+	}
+	return 0, ErrNoConvergence
+}
+
+// InitialBearing returns the forward azimuth from a to b in degrees, 0..360
+// clockwise from north.
+func InitialBearing(a, b Point) float64 {
+	phi1 := radians(a.Lat)
+	phi2 := radians(b.Lat)
+	dLambda := radians(b.Lon - a.Lon)
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(degrees(math.Atan2(y, x))+360, 360)
+}
+
+// Midpoint returns the point halfway between a and b along the great circle.
+func Midpoint(a, b Point) Point {
+	phi1 := radians(a.Lat)
+	phi2 := radians(b.Lat)
+	lambda1 := radians(a.Lon)
+	dLambda := radians(b.Lon - a.Lon)
+
+	bx := math.Cos(phi2) * math.Cos(dLambda)
+	by := math.Cos(phi2) * math.Sin(dLambda)
+	phi := math.Atan2(math.Sin(phi1)+math.Sin(phi2), math.Sqrt((math.Cos(phi1)+bx)*(math.Cos(phi1)+bx)+by*by))
+	lambda := lambda1 + math.Atan2(by, math.Cos(phi1)+bx)
+	return Point{Lat: degrees(phi), Lon: math.Mod(degrees(lambda)+540, 360) - 180}
+}
@@ -0,0 +1,110 @@
+package geo
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+var (
+	moscow = Point{Lat: 55.7558, Lon: 37.6173}
+	spb    = Point{Lat: 59.9311, Lon: 30.3609}
+)
+
+func TestHaversine(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{"same point", Point{55.75, 37.61}, Point{55.75, 37.61}, 0},
+		{"Moscow - Saint Petersburg", moscow, spb, 633000},
+		{"one degree of latitude", Point{0, 0}, Point{1, 0}, 111195},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Haversine(tt.a, tt.b)
+			if math.Abs(got-tt.want) > tt.want*0.005+1 {
+				t.Errorf("expected about %.0f m but got %.0f m", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestVincenty(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{"same point", moscow, moscow, 0},
+		// reference values from GeographicLib
+		{"one degree of latitude at the equator", Point{0, 0}, Point{1, 0}, 110574.389},
+		{"one degree of longitude at the equator", Point{0, 0}, Point{0, 1}, 111319.491},
+		// worked example from Vincenty's 1975 paper
+		{"Flinders Peak - Buninyong", Point{-37.951033417, 144.424867889}, Point{-37.652821139, 143.926495528}, 54972.271},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Vincenty(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1 {
+				t.Errorf("expected %.3f m but got %.3f m", tt.want, got)
+			}
+		})
+	}
+
+	_, err := Vincenty(Point{0, 0}, Point{0.5, 179.7})
+	if !errors.Is(err, ErrNoConvergence) {
+		t.Errorf("expected ErrNoConvergence for nearly antipodal points, got %v", err)
+	}
+}
+
+func TestInitialBearing(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{"north", Point{0, 0}, Point{1, 0}, 0},
+		{"east", Point{0, 0}, Point{0, 1}, 90},
+		{"south", Point{1, 0}, Point{0, 0}, 180},
+		{"west", Point{0, 1}, Point{0, 0}, 270},
+		{"Moscow - Saint Petersburg", moscow, spb, 320.3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := InitialBearing(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 0.1 {
+				t.Errorf("expected %.1f° but got %.1f°", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMidpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want Point
+	}{
+		{"equator", Point{0, 0}, Point{0, 90}, Point{0, 45}},
+		{"across the antimeridian", Point{0, 170}, Point{0, -170}, Point{0, 180}},
+		{"meridian", Point{10, 20}, Point{20, 20}, Point{15, 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Midpoint(tt.a, tt.b)
+			lonDiff := math.Abs(got.Lon - tt.want.Lon)
+			if math.Abs(got.Lat-tt.want.Lat) > 1e-9 || math.Min(lonDiff, 360-lonDiff) > 1e-9 {
+				t.Errorf("expected %+v but got %+v", tt.want, got)
+			}
+		})
+	}
+}
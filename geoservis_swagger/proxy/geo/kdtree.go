@@ -0,0 +1,134 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+// KDTree answers nearest-neighbour queries over a fixed set of points. Points
+// are stored as unit vectors in 3D, where the straight-line (chord) distance
+// grows monotonically with the great-circle distance, so the usual Euclidean
+// pruning is exact and nothing special is needed at the poles or the
+// antimeridian.
+type KDTree struct {
+	nodes []kdNode
+	root  int
+}
+
+type kdNode struct {
+	v           [3]float64
+	index       int
+	axis        int
+	left, right int
+}
+
+// Neighbor is a search result: the index of the point in the slice passed to
+// NewKDTree and its great-circle distance in meters.
+type Neighbor struct {
+	Index  int
+	Meters float64
+}
+
+func toVector(p Point) [3]float64 {
+	lat, lon := radians(p.Lat), radians(p.Lon)
+	return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+// chordToMeters converts a chord length on the unit sphere to meters.
+func chordToMeters(c float64) float64 {
+	return 2 * EarthRadiusMeters * math.Asin(math.Min(c/2, 1))
+}
+
+// metersToChord converts a great-circle distance to a chord on the unit sphere.
+func metersToChord(m float64) float64 {
+	if m >= math.Pi*EarthRadiusMeters {
+		return 2
+	}
+	return 2 * math.Sin(m/(2*EarthRadiusMeters))
+}
+
+func NewKDTree(points []Point) *KDTree {
+	t := &KDTree{nodes: make([]kdNode, len(points)), root: -1}
+	idx := make([]int, len(points))
+	for i, p := range points {
+		t.nodes[i] = kdNode{v: toVector(p), index: i, left: -1, right: -1}
+		idx[i] = i
+	}
+	t.root = t.build(idx, 0)
+	return t
+}
+
+func (t *KDTree) build(idx []int, depth int) int {
+	if len(idx) == 0 {
+		return -1
+	}
+	axis := depth % 3
+	sort.Slice(idx, func(i, j int) bool { return t.nodes[idx[i]].v[axis] < t.nodes[idx[j]].v[axis] })
+	mid := len(idx) / 2
+	n := idx[mid]
+	t.nodes[n].axis = axis
+	t.nodes[n].left = t.build(idx[:mid], depth+1)
+	t.nodes[n].right = t.build(idx[mid+1:], depth+1)
+	return n
+}
+
+// Nearest returns up to k points closest to p, nearest first. A positive
+// maxMeters excludes points farther than that.
+func (t *KDTree) Nearest(p Point, k int, maxMeters float64) []Neighbor {
+	if k <= 0 || t.root < 0 {
+		return nil
+	}
+	q := toVector(p)
+	limit := 2.0 // the longest chord on the unit sphere
+	if maxMeters > 0 {
+		limit = metersToChord(maxMeters)
+	}
+
+	// best holds the k closest candidates so far as chord lengths, sorted
+	type candidate struct {
+		node  int
+		chord float64
+	}
+	var best []candidate
+	bound := func() float64 {
+		if len(best) < k {
+			return limit
+		}
+		return best[len(best)-1].chord
+	}
+
+	var visit func(n int)
+	visit = func(n int) {
+		if n < 0 {
+			return
+		}
+		node := &t.nodes[n]
+		dx, dy, dz := node.v[0]-q[0], node.v[1]-q[1], node.v[2]-q[2]
+		if c := math.Sqrt(dx*dx + dy*dy + dz*dz); c <= bound() {
+			i := sort.Search(len(best), func(i int) bool { return best[i].chord > c })
+			best = append(best, candidate{})
+			copy(best[i+1:], best[i:])
+			best[i] = candidate{node: n, chord: c}
+			if len(best) > k {
+				best = best[:k]
+			}
+		}
+
+		diff := q[node.axis] - node.v[node.axis]
+		near, far := node.left, node.right
+		if diff > 0 {
+			near, far = far, near
+		}
+		visit(near)
+		if math.Abs(diff) <= bound() {
+			visit(far)
+		}
+	}
+	visit(t.root)
+
+	res := make([]Neighbor, len(best))
+	for i, c := range best {
+		res[i] = Neighbor{Index: t.nodes[c.node].index, Meters: chordToMeters(c.chord)}
+	}
+	return res
+}
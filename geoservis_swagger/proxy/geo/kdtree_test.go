@@ -0,0 +1,55 @@
+package geo
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestKDTreeNearest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	points := make([]Point, 2000)
+	for i := range points {
+		points[i] = Point{Lat: rnd.Float64()*180 - 90, Lon: rnd.Float64()*360 - 180}
+	}
+	// two points straddling the antimeridian
+	points = append(points, Point{Lat: 10, Lon: 179.99}, Point{Lat: 10, Lon: -179.99})
+	tree := NewKDTree(points)
+
+	queries := []Point{{55.75, 37.61}, {10, 179.995}, {-89.9, 0}, {0, 0}}
+	for _, q := range queries {
+		for _, tc := range []struct {
+			k         int
+			maxMeters float64
+		}{{1, 0}, {5, 0}, {10, 1500000}, {3, 1}} {
+			got := tree.Nearest(q, tc.k, tc.maxMeters)
+
+			// brute force reference
+			var want []Neighbor
+			for i, p := range points {
+				d := Haversine(q, p)
+				if tc.maxMeters <= 0 || d <= tc.maxMeters {
+					want = append(want, Neighbor{Index: i, Meters: d})
+				}
+			}
+			sort.Slice(want, func(i, j int) bool { return want[i].Meters < want[j].Meters })
+			if len(want) > tc.k {
+				want = want[:tc.k]
+			}
+
+			if len(got) != len(want) {
+				t.Fatalf("query %+v k=%d max=%v: expected %d results, got %d", q, tc.k, tc.maxMeters, len(want), len(got))
+			}
+			for i := range got {
+				if got[i].Index != want[i].Index || math.Abs(got[i].Meters-want[i].Meters) > 0.01 {
+					t.Errorf("query %+v k=%d max=%v result %d: expected %+v, got %+v", q, tc.k, tc.maxMeters, i, want[i], got[i])
+				}
+			}
+		}
+	}
+
+	if got := NewKDTree(nil).Nearest(Point{}, 3, 0); len(got) != 0 {
+		t.Errorf("empty tree returned %v", got)
+	}
+}
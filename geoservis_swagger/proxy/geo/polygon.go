@@ -0,0 +1,126 @@
+package geo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Polygon is a list of closed rings: the outer boundary followed by holes.
+type Polygon [][]Point
+
+// Rect is an axis-aligned bounding box in degrees.
+type Rect struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+func (r Rect) Contains(p Point) bool {
+	return p.Lat >= r.MinLat && p.Lat <= r.MaxLat && p.Lon >= r.MinLon && p.Lon <= r.MaxLon
+}
+
+func (r Rect) union(o Rect) Rect {
+	return Rect{
+		MinLat: math.Min(r.MinLat, o.MinLat),
+		MinLon: math.Min(r.MinLon, o.MinLon),
+		MaxLat: math.Max(r.MaxLat, o.MaxLat),
+		MaxLon: math.Max(r.MaxLon, o.MaxLon),
+	}
+}
+
+// Bounds returns the bounding box of the outer ring.
+func (pg Polygon) Bounds() Rect {
+	outer := pg[0]
+	r := Rect{MinLat: outer[0].Lat, MinLon: outer[0].Lon, MaxLat: outer[0].Lat, MaxLon: outer[0].Lon}
+	for _, p := range outer[1:] {
+		r = r.union(Rect{MinLat: p.Lat, MinLon: p.Lon, MaxLat: p.Lat, MaxLon: p.Lon})
+	}
+	return r
+}
+
+// Contains reports whether p is inside the outer ring and outside every hole.
+// Points exactly on an edge may fall either way.
+func (pg Polygon) Contains(p Point) bool {
+	if !ringContains(pg[0], p) {
+		return false
+	}
+	for _, hole := range pg[1:] {
+		if ringContains(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains is the even-odd ray casting test, treating lon/lat as planar.
+func ringContains(ring []Point, p Point) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			in = !in
+		}
+	}
+	return in
+}
+
+// ParsePolygons decodes a GeoJSON Polygon or MultiPolygon geometry.
+// Positions are [lon, lat] as in RFC 7946.
+func ParsePolygons(geometry []byte) ([]Polygon, error) {
+	var g struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	err := json.Unmarshal(geometry, &g)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw [][][][]float64
+	switch g.Type {
+	case "Polygon":
+		var rings [][][]float64
+		err = json.Unmarshal(g.Coordinates, &rings)
+		raw = [][][][]float64{rings}
+	case "MultiPolygon":
+		err = json.Unmarshal(g.Coordinates, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %q, want Polygon or MultiPolygon", g.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("geometry has no polygons")
+	}
+
+	polygons := make([]Polygon, 0, len(raw))
+	for _, rings := range raw {
+		if len(rings) == 0 {
+			return nil, errors.New("polygon has no rings")
+		}
+		pg := make(Polygon, 0, len(rings))
+		for _, ring := range rings {
+			if len(ring) < 4 {
+				return nil, errors.New("ring needs at least 4 positions")
+			}
+			pts := make([]Point, len(ring))
+			for i, pos := range ring {
+				if len(pos) < 2 {
+					return nil, errors.New("position needs lon and lat")
+				}
+				if pos[0] < -180 || pos[0] > 180 || pos[1] < -90 || pos[1] > 90 {
+					return nil, fmt.Errorf("position %v is out of range", pos)
+				}
+				pts[i] = Point{Lat: pos[1], Lon: pos[0]}
+			}
+			if pts[0] != pts[len(pts)-1] {
+				return nil, errors.New("ring is not closed")
+			}
+			pg = append(pg, pts)
+		}
+		polygons = append(polygons, pg)
+	}
+	return polygons, nil
+}
@@ -0,0 +1,113 @@
+package geo
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+const squareWithHole = `{"type":"Polygon","coordinates":[
+	[[0,0],[10,0],[10,10],[0,10],[0,0]],
+	[[4,4],[6,4],[6,6],[4,6],[4,4]]
+]}`
+
+func TestParsePolygons(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry string
+		want     int
+		wantErr  bool
+	}{
+		{"polygon", squareWithHole, 1, false},
+		{"multipolygon", `{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[5,5],[6,5],[6,6],[5,5]]]]}`, 2, false},
+		{"point", `{"type":"Point","coordinates":[0,0]}`, 0, true},
+		{"open ring", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`, 0, true},
+		{"too few positions", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,0]]]}`, 0, true},
+		{"latitude out of range", `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,91],[0,0]]]}`, 0, true},
+		{"no rings", `{"type":"Polygon","coordinates":[]}`, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePolygons([]byte(tt.geometry))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePolygons() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("expected %d polygons, got %d", tt.want, len(got))
+			}
+		})
+	}
+}
+
+func TestPolygonContains(t *testing.T) {
+	polygons, err := ParsePolygons([]byte(squareWithHole))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := polygons[0]
+
+	tests := []struct {
+		name string
+		p    Point
+		want bool
+	}{
+		{"inside", Point{Lat: 2, Lon: 2}, true},
+		{"in the hole", Point{Lat: 5, Lon: 5}, false},
+		{"outside", Point{Lat: 11, Lon: 5}, false},
+		{"between hole and edge", Point{Lat: 5, Lon: 8}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pg.Contains(tt.p); got != tt.want {
+				t.Errorf("Contains(%+v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+
+	if b := pg.Bounds(); b != (Rect{MinLat: 0, MinLon: 0, MaxLat: 10, MaxLon: 10}) {
+		t.Errorf("wrong bounds %+v", b)
+	}
+}
+
+func TestRTree(t *testing.T) {
+	if got := NewRTree(nil).Search(Point{}); len(got) != 0 {
+		t.Errorf("empty tree returned %v", got)
+	}
+
+	// a 40x40 grid of 1x1 cells, deep enough for several levels
+	var items []RTreeItem
+	for i := 0; i < 40; i++ {
+		for j := 0; j < 40; j++ {
+			items = append(items, RTreeItem{
+				Bounds: Rect{MinLat: float64(i), MinLon: float64(j), MaxLat: float64(i + 1), MaxLon: float64(j + 1)},
+				Value:  fmt.Sprintf("%d,%d", i, j),
+			})
+		}
+	}
+	tree := NewRTree(items)
+
+	tests := []struct {
+		name string
+		p    Point
+		want []string
+	}{
+		{"inside one cell", Point{Lat: 12.5, Lon: 30.5}, []string{"12,30"}},
+		{"on a corner", Point{Lat: 1, Lon: 1}, []string{"0,0", "0,1", "1,0", "1,1"}},
+		{"outside", Point{Lat: -1, Lon: 5}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range tree.Search(tt.p) {
+				got = append(got, v.(string))
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Search(%+v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+// rtreeFanout is the maximum number of children of an R-tree node.
+const rtreeFanout = 16
+
+// RTree is a static R-tree over rectangles, bulk-loaded with the
+// Sort-Tile-Recursive algorithm. It is immutable once built, so a changed
+// item set means building a new tree.
+type RTree struct {
+	root *rtreeNode
+}
+
+type rtreeNode struct {
+	bounds   Rect
+	children []*rtreeNode
+	// set on leaves only
+	value interface{}
+}
+
+// RTreeItem is one rectangle stored in the tree with its value.
+type RTreeItem struct {
+	Bounds Rect
+	Value  interface{}
+}
+
+// NewRTree bulk-loads the items into a new tree.
+func NewRTree(items []RTreeItem) *RTree {
+	if len(items) == 0 {
+		return &RTree{}
+	}
+	nodes := make([]*rtreeNode, len(items))
+	for i, it := range items {
+		nodes[i] = &rtreeNode{bounds: it.Bounds, value: it.Value}
+	}
+	for len(nodes) > 1 {
+		nodes = strPack(nodes)
+	}
+	return &RTree{root: nodes[0]}
+}
+
+// strPack groups nodes into parents of at most rtreeFanout children: sorted
+// into vertical slices by longitude, then into runs by latitude.
+func strPack(nodes []*rtreeNode) []*rtreeNode {
+	parents := int(math.Ceil(float64(len(nodes)) / rtreeFanout))
+	slices := int(math.Ceil(math.Sqrt(float64(parents))))
+	sliceSize := slices * rtreeFanout
+
+	center := func(r Rect) (lat, lon float64) { return (r.MinLat + r.MaxLat) / 2, (r.MinLon + r.MaxLon) / 2 }
+	sort.Slice(nodes, func(i, j int) bool {
+		_, a := center(nodes[i].bounds)
+		_, b := center(nodes[j].bounds)
+		return a < b
+	})
+
+	var res []*rtreeNode
+	for s := 0; s < len(nodes); s += sliceSize {
+		slice := nodes[s:minInt(s+sliceSize, len(nodes))]
+		sort.Slice(slice, func(i, j int) bool {
+			a, _ := center(slice[i].bounds)
+			b, _ := center(slice[j].bounds)
+			return a < b
+		})
+		for g := 0; g < len(slice); g += rtreeFanout {
+			children := slice[g:minInt(g+rtreeFanout, len(slice))]
+			parent := &rtreeNode{bounds: children[0].bounds, children: append([]*rtreeNode(nil), children...)}
+			for _, c := range children[1:] {
+				parent.bounds = parent.bounds.union(c.bounds)
+			}
+			res = append(res, parent)
+		}
+	}
+	return res
+}
+
+// Search returns the values of all items whose rectangle contains p.
+func (t *RTree) Search(p Point) []interface{} {
+	var res []interface{}
+	if t.root == nil {
+		return res
+	}
+	stack := []*rtreeNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !n.bounds.Contains(p) {
+			continue
+		}
+		if n.children == nil {
+			res = append(res, n.value)
+			continue
+		}
+		stack = append(stack, n.children...)
+	}
+	return res
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
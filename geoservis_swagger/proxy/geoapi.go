@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"test/geo"
+)
+
+const maxMatrixSide = 100
+
+// GeoInput is a point given either as {"lat": .., "lon": ..} or as an
+// address string that is geocoded through the provider.
+type GeoInput struct {
+	Point   *geo.Point
+	Address string
+}
+
+func (in *GeoInput) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &in.Address)
+	}
+	var p struct {
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return errors.New("point must be an address string or {\"lat\": .., \"lon\": ..}")
+	}
+	if p.Lat == nil || p.Lon == nil {
+		return errors.New("point needs lat and lon")
+	}
+	if math.IsNaN(*p.Lat) || *p.Lat < -90 || *p.Lat > 90 || math.IsNaN(*p.Lon) || *p.Lon < -180 || *p.Lon > 180 {
+		return fmt.Errorf("point %v, %v is out of range", *p.Lat, *p.Lon)
+	}
+	in.Point = &geo.Point{Lat: *p.Lat, Lon: *p.Lon}
+	return nil
+}
+
+// swagger:parameters GeoDistance
+type DistanceRequest struct {
+	// a point or an address string
+	From GeoInput `json:"from"`
+	// a point or an address string
+	To GeoInput `json:"to"`
+	// "haversine" (default) or "vincenty"
+	Method string `json:"method"`
+}
+
+//swagger:model
+type DistanceResponse struct {
+	From geo.Point `json:"from"`
+	To   geo.Point `json:"to"`
+	// rounded to millimeters
+	DistanceMeters float64 `json:"distance_meters"`
+	// degrees clockwise from north
+	InitialBearing float64   `json:"initial_bearing"`
+	Midpoint       geo.Point `json:"midpoint"`
+	Method         string    `json:"method"`
+}
+
+// swagger:parameters GeoMatrix
+type MatrixRequest struct {
+	// points or address strings, at most 100
+	Origins []GeoInput `json:"origins"`
+	// points or address strings, at most 100
+	Destinations []GeoInput `json:"destinations"`
+	// "haversine" (default) or "vincenty"
+	Method string `json:"method"`
+}
+
+//swagger:model
+type MatrixResponse struct {
+	Origins      []geo.Point `json:"origins"`
+	Destinations []geo.Point `json:"destinations"`
+	// distances in meters, one row per origin
+	Distances [][]float64 `json:"distances"`
+	Method    string      `json:"method"`
+}
+
+// distanceFunc returns the distance function for the method parameter.
+func distanceFunc(method string) (string, func(a, b geo.Point) (float64, error), error) {
+	switch method {
+	case "", "haversine":
+		return "haversine", func(a, b geo.Point) (float64, error) { return geo.Haversine(a, b), nil }, nil
+	case "vincenty":
+		return "vincenty", geo.Vincenty, nil
+	}
+	return "", nil, fmt.Errorf("unknown method %q", method)
+}
+
+func roundMillimeters(d float64) float64 {
+	return math.Round(d*1000) / 1000
+}
+
+// unresolvedError is returned when an address input can't be geocoded.
+type unresolvedError struct {
+	Address string
+	Reason  string
+}
+
+func (e *unresolvedError) Error() string {
+	return fmt.Sprintf("address %q: %s", e.Address, e.Reason)
+}
+
+// resolvePoints turns the inputs into points, geocoding each distinct
+// address string once.
+func (app *application) resolvePoints(inputs []GeoInput, cache map[string]geo.Point) ([]geo.Point, error) {
+	points := make([]geo.Point, len(inputs))
+	for i, in := range inputs {
+		if in.Point != nil {
+			points[i] = *in.Point
+			continue
+		}
+		p, ok := cache[in.Address]
+		if !ok {
+			addresses, err := app.geo.AddressSearch(SearchParams{Query: in.Address, Count: 1})
+			if err != nil {
+				return nil, err
+			}
+			if len(addresses) == 0 {
+				return nil, &unresolvedError{Address: in.Address, Reason: "not found"}
+			}
+			lat, err1 := strconv.ParseFloat(addresses[0].Lat, 64)
+			lon, err2 := strconv.ParseFloat(addresses[0].Lon, 64)
+			if err1 != nil || err2 != nil {
+				return nil, &unresolvedError{Address: in.Address, Reason: "no coordinates"}
+			}
+			p = geo.Point{Lat: lat, Lon: lon}
+			cache[in.Address] = p
+		}
+		points[i] = p
+	}
+	return points, nil
+}
+
+// resolveError writes the response for a resolvePoints error.
+func (app *application) resolveError(w http.ResponseWriter, err error) {
+	var unresolved *unresolvedError
+	if errors.As(err, &unresolved) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.geoError(w, err)
+}
+
+func (app *application) DistanceHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /geo/distance GeoDistance
+	// swagger:operation POST /geo/distance GeoDistance
+	//
+	// returns the distance, initial bearing and midpoint between two points or addresses
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: request
+	//   in: body
+	//   type: object
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: distance between the points
+	//     schema:
+	//         "$ref": "#/definitions/DistanceResponse"
+	//   '400':
+	//      description: invalid point, unknown method or address not found
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	var req DistanceRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.From.Point == nil && req.From.Address == "" || req.To.Point == nil && req.To.Address == "" {
+		http.Error(w, "from and to are required", http.StatusBadRequest)
+		return
+	}
+	method, distance, err := distanceFunc(req.Method)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := app.resolvePoints([]GeoInput{req.From, req.To}, map[string]geo.Point{})
+	if err != nil {
+		app.resolveError(w, err)
+		return
+	}
+	from, to := points[0], points[1]
+	d, err := distance(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mid := geo.Midpoint(from, to)
+
+	response := DistanceResponse{
+		From:           from,
+		To:             to,
+		DistanceMeters: roundMillimeters(d),
+		InitialBearing: roundCoord(geo.InitialBearing(from, to)),
+		Midpoint:       geo.Point{Lat: roundCoord(mid.Lat), Lon: roundCoord(mid.Lon)},
+		Method:         method,
+	}
+	responseJSON, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func (app *application) MatrixHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /geo/matrix GeoMatrix
+	// swagger:operation POST /geo/matrix GeoMatrix
+	//
+	// returns the distances between every origin and every destination
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: request
+	//   in: body
+	//   type: object
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: N×M distance matrix
+	//     schema:
+	//         "$ref": "#/definitions/MatrixResponse"
+	//   '400':
+	//      description: invalid point, unknown method, too many points or address not found
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	var req MatrixRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Origins) == 0 || len(req.Destinations) == 0 {
+		http.Error(w, "origins and destinations are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Origins) > maxMatrixSide || len(req.Destinations) > maxMatrixSide {
+		http.Error(w, fmt.Sprintf("at most %d origins and %d destinations", maxMatrixSide, maxMatrixSide), http.StatusBadRequest)
+		return
+	}
+	method, distance, err := distanceFunc(req.Method)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cache := map[string]geo.Point{}
+	origins, err := app.resolvePoints(req.Origins, cache)
+	if err != nil {
+		app.resolveError(w, err)
+		return
+	}
+	destinations, err := app.resolvePoints(req.Destinations, cache)
+	if err != nil {
+		app.resolveError(w, err)
+		return
+	}
+
+	distances := make([][]float64, len(origins))
+	for i, o := range origins {
+		distances[i] = make([]float64, len(destinations))
+		for j, d := range destinations {
+			m, err := distance(o, d)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("origin %d, destination %d: %s", i, j, err), http.StatusBadRequest)
+				return
+			}
+			distances[i][j] = roundMillimeters(m)
+		}
+	}
+
+	response := MatrixResponse{Origins: origins, Destinations: destinations, Distances: distances, Method: method}
+	responseJSON, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func geoTestApp(calls *int) *application {
+	return &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+				*calls++
+				switch params.Query {
+				case "Москва":
+					return []*Address{{City: "Москва", Lat: "55.7558", Lon: "37.6173"}}, nil
+				case "без координат":
+					return []*Address{{City: "Нигде"}}, nil
+				}
+				return nil, nil
+			},
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+}
+
+func postGeo(app *application, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestDistanceHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantMeters float64
+	}{
+		{"points", `{"from": {"lat": 0, "lon": 0}, "to": {"lat": 0, "lon": 1}, "method": "vincenty"}`, http.StatusOK, 111319.491},
+		{"address and point", `{"from": "Москва", "to": {"lat": 59.9311, "lon": 30.3609}}`, http.StatusOK, 631740.823},
+		{"unknown method", `{"from": {"lat": 0, "lon": 0}, "to": {"lat": 0, "lon": 1}, "method": "manhattan"}`, http.StatusBadRequest, 0},
+		{"out of range", `{"from": {"lat": 91, "lon": 0}, "to": {"lat": 0, "lon": 1}}`, http.StatusBadRequest, 0},
+		{"missing to", `{"from": {"lat": 0, "lon": 0}}`, http.StatusBadRequest, 0},
+		{"address not found", `{"from": "Атлантида", "to": "Москва"}`, http.StatusBadRequest, 0},
+		{"address without coordinates", `{"from": "без координат", "to": "Москва"}`, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			w := postGeo(geoTestApp(&calls), "/api/v1/geo/distance", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status code %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp DistanceResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.DistanceMeters != tt.wantMeters {
+				t.Errorf("distance = %v, want %v", resp.DistanceMeters, tt.wantMeters)
+			}
+		})
+	}
+}
+
+func TestMatrixHandler(t *testing.T) {
+	var calls int
+	app := geoTestApp(&calls)
+	body := `{"origins": ["Москва", {"lat": 0, "lon": 0}], "destinations": [{"lat": 0, "lon": 1}, "Москва", "Москва"]}`
+	w := postGeo(app, "/api/v1/geo/matrix", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if calls != 1 {
+		t.Errorf("expected repeated addresses to be geocoded once, got %d calls", calls)
+	}
+
+	var resp MatrixResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Distances) != 2 || len(resp.Distances[0]) != 3 {
+		t.Fatalf("expected a 2x3 matrix, got %v", resp.Distances)
+	}
+	if resp.Distances[0][1] != 0 || resp.Distances[1][0] != 111195.08 || resp.Method != "haversine" {
+		t.Errorf("wrong matrix %s", w.Body.String())
+	}
+
+	tooMany := `{"origins": [` + strings.Repeat(`{"lat": 0, "lon": 0},`, maxMatrixSide) + `{"lat": 0, "lon": 0}], "destinations": [{"lat": 0, "lon": 1}]}`
+	w = postGeo(app, "/api/v1/geo/matrix", tooMany)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for an oversized matrix but got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
 
 func UnmarshalGeoCode(data []byte) (GeoCode, error) {
 	var r GeoCode
@@ -12,6 +16,7 @@ func (r *GeoCode) Marshal() ([]byte, error) {
 	return json.Marshal(r)
 }
 
+// GeoCode is the response of both DaData suggest/address and geolocate/address.
 type GeoCode struct {
 	Suggestions []Suggestion `json:"suggestions"`
 }
@@ -22,194 +27,198 @@ type Suggestion struct {
 	Data              Data   `json:"data"`
 }
 
+// Data is the address part of a suggestion. DaData sends null for every level
+// the address doesn't have, so all optional fields are pointers.
 type Data struct {
-	PostalCode           string          `json:"postal_code"`
-	Country              Country         `json:"country"`
-	CountryISOCode       CountryISOCode  `json:"country_iso_code"`
-	FederalDistrict      FederalDistrict `json:"federal_district"`
-	RegionFiasID         string          `json:"region_fias_id"`
-	RegionKladrID        string          `json:"region_kladr_id"`
-	RegionISOCode        RegionISOCode   `json:"region_iso_code"`
-	RegionWithType       WithType        `json:"region_with_type"`
-	RegionType           Type            `json:"region_type"`
-	RegionTypeFull       TypeFull        `json:"region_type_full"`
-	Region               City            `json:"region"`
-	AreaFiasID           interface{}     `json:"area_fias_id"`
-	AreaKladrID          interface{}     `json:"area_kladr_id"`
-	AreaWithType         interface{}     `json:"area_with_type"`
-	AreaType             interface{}     `json:"area_type"`
-	AreaTypeFull         interface{}     `json:"area_type_full"`
-	Area                 interface{}     `json:"area"`
-	CityFiasID           string          `json:"city_fias_id"`
-	CityKladrID          string          `json:"city_kladr_id"`
-	CityWithType         WithType        `json:"city_with_type"`
-	CityType             Type            `json:"city_type"`
-	CityTypeFull         TypeFull        `json:"city_type_full"`
-	City                 City            `json:"city"`
-	CityArea             interface{}     `json:"city_area"`
-	CityDistrictFiasID   interface{}     `json:"city_district_fias_id"`
-	CityDistrictKladrID  interface{}     `json:"city_district_kladr_id"`
-	CityDistrictWithType interface{}     `json:"city_district_with_type"`
-	CityDistrictType     interface{}     `json:"city_district_type"`
-	CityDistrictTypeFull interface{}     `json:"city_district_type_full"`
-	CityDistrict         interface{}     `json:"city_district"`
-	SettlementFiasID     interface{}     `json:"settlement_fias_id"`
-	SettlementKladrID    interface{}     `json:"settlement_kladr_id"`
-	SettlementWithType   interface{}     `json:"settlement_with_type"`
-	SettlementType       interface{}     `json:"settlement_type"`
-	SettlementTypeFull   interface{}     `json:"settlement_type_full"`
-	Settlement           interface{}     `json:"settlement"`
-	StreetFiasID         string          `json:"street_fias_id"`
-	StreetKladrID        string          `json:"street_kladr_id"`
-	StreetWithType       StreetWithType  `json:"street_with_type"`
-	StreetType           StreetType      `json:"street_type"`
-	StreetTypeFull       StreetTypeFull  `json:"street_type_full"`
-	Street               Street          `json:"street"`
-	SteadFiasID          interface{}     `json:"stead_fias_id"`
-	SteadCadnum          interface{}     `json:"stead_cadnum"`
-	SteadType            interface{}     `json:"stead_type"`
-	SteadTypeFull        interface{}     `json:"stead_type_full"`
-	Stead                interface{}     `json:"stead"`
+	PostalCode           *string         `json:"postal_code"`
+	Country              string          `json:"country"`
+	CountryISOCode       string          `json:"country_iso_code"`
+	FederalDistrict      *string         `json:"federal_district"`
+	RegionFiasID         *string         `json:"region_fias_id"`
+	RegionKladrID        *string         `json:"region_kladr_id"`
+	RegionISOCode        *string         `json:"region_iso_code"`
+	RegionWithType       *string         `json:"region_with_type"`
+	RegionType           *string         `json:"region_type"`
+	RegionTypeFull       *string         `json:"region_type_full"`
+	Region               *string         `json:"region"`
+	AreaFiasID           *string         `json:"area_fias_id"`
+	AreaKladrID          *string         `json:"area_kladr_id"`
+	AreaWithType         *string         `json:"area_with_type"`
+	AreaType             *string         `json:"area_type"`
+	AreaTypeFull         *string         `json:"area_type_full"`
+	Area                 *string         `json:"area"`
+	CityFiasID           *string         `json:"city_fias_id"`
+	CityKladrID          *string         `json:"city_kladr_id"`
+	CityWithType         *string         `json:"city_with_type"`
+	CityType             *string         `json:"city_type"`
+	CityTypeFull         *string         `json:"city_type_full"`
+	City                 *string         `json:"city"`
+	CityArea             *string         `json:"city_area"`
+	CityDistrictFiasID   *string         `json:"city_district_fias_id"`
+	CityDistrictKladrID  *string         `json:"city_district_kladr_id"`
+	CityDistrictWithType *string         `json:"city_district_with_type"`
+	CityDistrictType     *string         `json:"city_district_type"`
+	CityDistrictTypeFull *string         `json:"city_district_type_full"`
+	CityDistrict         *string         `json:"city_district"`
+	SettlementFiasID     *string         `json:"settlement_fias_id"`
+	SettlementKladrID    *string         `json:"settlement_kladr_id"`
+	SettlementWithType   *string         `json:"settlement_with_type"`
+	SettlementType       *string         `json:"settlement_type"`
+	SettlementTypeFull   *string         `json:"settlement_type_full"`
+	Settlement           *string         `json:"settlement"`
+	StreetFiasID         *string         `json:"street_fias_id"`
+	StreetKladrID        *string         `json:"street_kladr_id"`
+	StreetWithType       *string         `json:"street_with_type"`
+	StreetType           *string         `json:"street_type"`
+	StreetTypeFull       *string         `json:"street_type_full"`
+	Street               *string         `json:"street"`
+	SteadFiasID          *string         `json:"stead_fias_id"`
+	SteadCadnum          *string         `json:"stead_cadnum"`
+	SteadType            *string         `json:"stead_type"`
+	SteadTypeFull        *string         `json:"stead_type_full"`
+	Stead                *string         `json:"stead"`
 	HouseFiasID          *string         `json:"house_fias_id"`
 	HouseKladrID         *string         `json:"house_kladr_id"`
-	HouseCadnum          interface{}     `json:"house_cadnum"`
-	HouseType            HouseType       `json:"house_type"`
-	HouseTypeFull        HouseTypeFull   `json:"house_type_full"`
-	House                string          `json:"house"`
+	HouseCadnum          *string         `json:"house_cadnum"`
+	HouseType            *string         `json:"house_type"`
+	HouseTypeFull        *string         `json:"house_type_full"`
+	House                *string         `json:"house"`
 	BlockType            *string         `json:"block_type"`
 	BlockTypeFull        *string         `json:"block_type_full"`
 	Block                *string         `json:"block"`
-	Entrance             interface{}     `json:"entrance"`
-	Floor                interface{}     `json:"floor"`
-	FlatFiasID           interface{}     `json:"flat_fias_id"`
-	FlatCadnum           interface{}     `json:"flat_cadnum"`
-	FlatType             interface{}     `json:"flat_type"`
-	FlatTypeFull         interface{}     `json:"flat_type_full"`
-	Flat                 interface{}     `json:"flat"`
-	FlatArea             interface{}     `json:"flat_area"`
-	SquareMeterPrice     interface{}     `json:"square_meter_price"`
-	FlatPrice            interface{}     `json:"flat_price"`
-	RoomFiasID           interface{}     `json:"room_fias_id"`
-	RoomCadnum           interface{}     `json:"room_cadnum"`
-	RoomType             interface{}     `json:"room_type"`
-	RoomTypeFull         interface{}     `json:"room_type_full"`
-	Room                 interface{}     `json:"room"`
-	PostalBox            interface{}     `json:"postal_box"`
-	FiasID               string          `json:"fias_id"`
-	FiasCode             interface{}     `json:"fias_code"`
-	FiasLevel            string          `json:"fias_level"`
-	FiasActualityState   string          `json:"fias_actuality_state"`
-	KladrID              string          `json:"kladr_id"`
-	GeonameID            string          `json:"geoname_id"`
-	CapitalMarker        string          `json:"capital_marker"`
-	Okato                string          `json:"okato"`
-	Oktmo                string          `json:"oktmo"`
-	TaxOffice            string          `json:"tax_office"`
-	TaxOfficeLegal       string          `json:"tax_office_legal"`
-	Timezone             interface{}     `json:"timezone"`
-	GeoLat               string          `json:"geo_lat"`
-	GeoLon               string          `json:"geo_lon"`
-	BeltwayHit           interface{}     `json:"beltway_hit"`
-	BeltwayDistance      interface{}     `json:"beltway_distance"`
-	Metro                interface{}     `json:"metro"`
-	Divisions            interface{}     `json:"divisions"`
-	QcGeo                string          `json:"qc_geo"`
-	QcComplete           interface{}     `json:"qc_complete"`
-	QcHouse              interface{}     `json:"qc_house"`
+	Entrance             *string         `json:"entrance"`
+	Floor                *string         `json:"floor"`
+	FlatFiasID           *string         `json:"flat_fias_id"`
+	FlatCadnum           *string         `json:"flat_cadnum"`
+	FlatType             *string         `json:"flat_type"`
+	FlatTypeFull         *string         `json:"flat_type_full"`
+	Flat                 *string         `json:"flat"`
+	FlatArea             *string         `json:"flat_area"`
+	SquareMeterPrice     *string         `json:"square_meter_price"`
+	FlatPrice            *string         `json:"flat_price"`
+	RoomFiasID           *string         `json:"room_fias_id"`
+	RoomCadnum           *string         `json:"room_cadnum"`
+	RoomType             *string         `json:"room_type"`
+	RoomTypeFull         *string         `json:"room_type_full"`
+	Room                 *string         `json:"room"`
+	PostalBox            *string         `json:"postal_box"`
+	FiasID               *string         `json:"fias_id"`
+	FiasCode             *string         `json:"fias_code"`
+	FiasLevel            *string         `json:"fias_level"`
+	FiasActualityState   *string         `json:"fias_actuality_state"`
+	KladrID              *string         `json:"kladr_id"`
+	GeonameID            *string         `json:"geoname_id"`
+	CapitalMarker        *string         `json:"capital_marker"`
+	Okato                *string         `json:"okato"`
+	Oktmo                *string         `json:"oktmo"`
+	TaxOffice            *string         `json:"tax_office"`
+	TaxOfficeLegal       *string         `json:"tax_office_legal"`
+	Timezone             *string         `json:"timezone"`
+	GeoLat               *string         `json:"geo_lat"`
+	GeoLon               *string         `json:"geo_lon"`
+	BeltwayHit           *string         `json:"beltway_hit"`
+	BeltwayDistance      *string         `json:"beltway_distance"`
+	Metro                []MetroStation  `json:"metro"`
+	Divisions            json.RawMessage `json:"divisions"`
+	QcGeo                *QualityCode    `json:"qc_geo"`
+	QcComplete           *QualityCode    `json:"qc_complete"`
+	QcHouse              *QualityCode    `json:"qc_house"`
 	HistoryValues        []string        `json:"history_values"`
-	UnparsedParts        interface{}     `json:"unparsed_parts"`
-	Source               interface{}     `json:"source"`
-	Qc                   interface{}     `json:"qc"`
+	UnparsedParts        *string         `json:"unparsed_parts"`
+	Source               *string         `json:"source"`
+	Qc                   *QualityCode    `json:"qc"`
 }
 
-type City string
-
-const (
-	СанктПетербург City = "Санкт-Петербург"
-)
-
-type Type string
-
-const (
-	Г Type = "г"
-)
-
-type TypeFull string
-
-const (
-	Город TypeFull = "город"
-)
-
-type WithType string
-
-const (
-	ГСанктПетербург WithType = "г Санкт-Петербург"
-)
-
-type Country string
-
-const (
-	Россия Country = "Россия"
-)
-
-type CountryISOCode string
-
-const (
-	Ru CountryISOCode = "RU"
-)
-
-type FederalDistrict string
-
-const (
-	СевероЗападный FederalDistrict = "Северо-Западный"
-)
-
-type HouseType string
-
-const (
-	Д HouseType = "д"
-)
-
-type HouseTypeFull string
-
-const (
-	Дом HouseTypeFull = "дом"
-)
-
-type RegionISOCode string
-
-const (
-	RuSpe RegionISOCode = "RU-SPE"
-)
-
-type Street string
-
-const (
-	Казанская        Street = "Казанская"
-	КаналаГрибоедова Street = "Канала Грибоедова"
-	Фонарный         Street = "Фонарный"
-)
-
-type StreetType string
-
-const (
-	Наб StreetType = "наб"
-	Пер StreetType = "пер"
-	Ул  StreetType = "ул"
-)
+// QualityCode is one of the DaData qc* codes. Suggestions send them as
+// strings ("0".."5") while the clean API sends numbers, so both are accepted.
+type QualityCode int
+
+func (q *QualityCode) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if len(s) >= 2 && s[0] == '"' {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return err
+		}
+		s = unquoted
+	}
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid quality code %s", b)
+	}
+	*q = QualityCode(n)
+	return nil
+}
 
-type StreetTypeFull string
+func (q QualityCode) String() string {
+	return strconv.Itoa(int(q))
+}
 
-const (
-	Набережная StreetTypeFull = "набережная"
-	Переулок   StreetTypeFull = "переулок"
-	Улица      StreetTypeFull = "улица"
-)
+// Address converts the suggestion into the API address representation.
+func (s *Suggestion) Address() *Address {
+	d := s.Data
+	details := &AddressDetails{
+		Value:              s.Value,
+		UnrestrictedValue:  s.UnrestrictedValue,
+		PostalCode:         deref(d.PostalCode),
+		Country:            d.Country,
+		Region:             deref(d.Region),
+		RegionWithType:     deref(d.RegionWithType),
+		Area:               deref(d.Area),
+		AreaWithType:       deref(d.AreaWithType),
+		Settlement:         deref(d.Settlement),
+		SettlementWithType: deref(d.SettlementWithType),
+		CityDistrict:       deref(d.CityDistrict),
+		StreetWithType:     deref(d.StreetWithType),
+		Block:              deref(d.Block),
+		BlockType:          deref(d.BlockType),
+		Flat:               deref(d.Flat),
+		FlatType:           deref(d.FlatType),
+		RegionFiasID:       deref(d.RegionFiasID),
+		AreaFiasID:         deref(d.AreaFiasID),
+		CityFiasID:         deref(d.CityFiasID),
+		SettlementFiasID:   deref(d.SettlementFiasID),
+		StreetFiasID:       deref(d.StreetFiasID),
+		HouseFiasID:        deref(d.HouseFiasID),
+		FiasID:             deref(d.FiasID),
+		FiasLevel:          deref(d.FiasLevel),
+		KladrID:            deref(d.KladrID),
+		Okato:              deref(d.Okato),
+		Oktmo:              deref(d.Oktmo),
+		Timezone:           deref(d.Timezone),
+		Metro:              d.Metro,
+	}
+	if d.QcGeo != nil {
+		details.QcGeo = d.QcGeo.String()
+	}
+
+	return &Address{
+		City:           d.Locality(),
+		Street:         deref(d.Street),
+		House:          deref(d.House),
+		Lat:            deref(d.GeoLat),
+		Lon:            deref(d.GeoLon),
+		AddressDetails: details,
+	}
+}
 
-type StreetWithType string
+// Locality is the most specific populated place of the address: the city,
+// or the settlement, area or region for rural and federal city addresses.
+func (d *Data) Locality() string {
+	for _, l := range []*string{d.City, d.Settlement, d.Area, d.Region} {
+		if deref(l) != "" {
+			return *l
+		}
+	}
+	return ""
+}
 
-const (
-	НабКаналаГрибоедова StreetWithType = "наб Канала Грибоедова"
-	УлКазанская         StreetWithType = "ул Казанская"
-	ФонарныйПер         StreetWithType = "Фонарный пер"
-)
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestUnmarshalGeoCode_golden(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(t *testing.T, g GeoCode)
+	}{
+		{"suggest_rural_settlement", func(t *testing.T, g GeoCode) {
+			d := g.Suggestions[0].Data
+			if d.City != nil || d.Street != nil {
+				t.Error("city and street should be null")
+			}
+			if deref(d.Settlement) != "Жуковка" {
+				t.Errorf("wrong settlement %q", deref(d.Settlement))
+			}
+		}},
+		{"suggest_missing_house", func(t *testing.T, g GeoCode) {
+			d := g.Suggestions[0].Data
+			if d.House != nil || d.HouseFiasID != nil {
+				t.Error("house should be null")
+			}
+			if d.QcGeo == nil || *d.QcGeo != 2 {
+				t.Errorf("wrong qc_geo %v", d.QcGeo)
+			}
+		}},
+		{"geolocate_metro", func(t *testing.T, g GeoCode) {
+			d := g.Suggestions[0].Data
+			if len(d.Metro) != 3 || d.Metro[0].Name != "Бибирево" {
+				t.Errorf("wrong metro %+v", d.Metro)
+			}
+			if d.QcGeo == nil || *d.QcGeo != 0 {
+				t.Errorf("numeric qc_geo not decoded: %v", d.QcGeo)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", tt.name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			geocode, err := UnmarshalGeoCode(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(geocode.Suggestions) == 0 {
+				t.Fatal("no suggestions")
+			}
+			tt.check(t, geocode)
+
+			var addresses []*Address
+			for _, s := range geocode.Suggestions {
+				addresses = append(addresses, s.Address())
+			}
+			got, err := json.MarshalIndent(addresses, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("address mismatch for %s, run with -update to regenerate:\n%s", tt.name, got)
+			}
+		})
+	}
+}
+
+func TestQualityCode(t *testing.T) {
+	var d struct {
+		A *QualityCode `json:"a"`
+		B *QualityCode `json:"b"`
+		C *QualityCode `json:"c"`
+	}
+	err := json.NewDecoder(strings.NewReader(`{"a": "3", "b": 4, "c": null}`)).Decode(&d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *d.A != 3 || *d.B != 4 || d.C != nil {
+		t.Errorf("wrong quality codes %v %v %v", d.A, d.B, d.C)
+	}
+	if err := json.Unmarshal([]byte(`"x"`), new(QualityCode)); err == nil {
+		t.Error("expected error for invalid quality code")
+	}
+}
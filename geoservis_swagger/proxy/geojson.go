@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const geoJSONMediaType = "application/geo+json"
+
+// FeatureCollection is an RFC 7946 GeoJSON feature collection.
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	Geometry   *Point                 `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type Point struct {
+	Type string `json:"type"`
+	// longitude, latitude
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// NewFeatureCollection converts addresses into Point features with the
+// address fields as properties. Addresses without valid coordinates get a
+// null geometry, as allowed by RFC 7946.
+func NewFeatureCollection(addresses []*Address) (*FeatureCollection, error) {
+	fc := &FeatureCollection{Type: "FeatureCollection", Features: make([]*Feature, 0, len(addresses))}
+	for _, a := range addresses {
+		raw, err := json.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		var props map[string]interface{}
+		err = json.Unmarshal(raw, &props)
+		if err != nil {
+			return nil, err
+		}
+		delete(props, "lat")
+		delete(props, "lon")
+
+		f := &Feature{Type: "Feature", Properties: props}
+		lat, err1 := strconv.ParseFloat(a.Lat, 64)
+		lon, err2 := strconv.ParseFloat(a.Lon, 64)
+		if err1 == nil && err2 == nil {
+			f.Geometry = &Point{Type: "Point", Coordinates: [2]float64{lon, lat}}
+		}
+		fc.Features = append(fc.Features, f)
+	}
+	return fc, nil
+}
+
+// wantsGeoJSON picks the response format from ?format= or, failing that, the
+// Accept header, in which case it tells caches that the response varies by
+// Accept. A media range with q=0 is not acceptable.
+func wantsGeoJSON(w http.ResponseWriter, r *http.Request) (bool, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "geojson":
+		return true, nil
+	case "json":
+		return false, nil
+	case "":
+	default:
+		return false, fmt.Errorf("unknown format %q", format)
+	}
+	w.Header().Add("Vary", "Accept")
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != geoJSONMediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (app *application) writeGeoJSON(w http.ResponseWriter, addresses []*Address) {
+	fc, err := NewFeatureCollection(addresses)
+	if err != nil {
+		app.logger.Error(err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	responseJSON, _ := json.Marshal(fc)
+
+	w.Header().Set("Content-Type", geoJSONMediaType)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewFeatureCollection(t *testing.T) {
+	fc, err := NewFeatureCollection([]*Address{
+		{City: "Москва", Street: "Сухонская", House: "11", Lat: "55.8782557", Lon: "37.65372"},
+		{City: "Москва", Lat: "", Lon: ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 2 {
+		t.Fatalf("wrong collection %+v", fc)
+	}
+
+	f := fc.Features[0]
+	if f.Geometry == nil || f.Geometry.Type != "Point" || f.Geometry.Coordinates != [2]float64{37.65372, 55.8782557} {
+		t.Errorf("wrong geometry %+v", f.Geometry)
+	}
+	if f.Properties["street"] != "Сухонская" {
+		t.Errorf("wrong properties %v", f.Properties)
+	}
+	if _, ok := f.Properties["lat"]; ok {
+		t.Error("coordinates should not be duplicated in properties")
+	}
+	if fc.Features[1].Geometry != nil {
+		t.Error("address without coordinates should have null geometry")
+	}
+}
+
+func TestWantsGeoJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		accept  string
+		want    bool
+		wantErr bool
+	}{
+		{"default", "/", "", false, false},
+		{"format param", "/?format=geojson", "", true, false},
+		{"format json wins over accept", "/?format=json", "application/geo+json", false, false},
+		{"accept header", "/", "text/html, application/geo+json;q=0.9", true, false},
+		{"plain json accept", "/", "application/json", false, false},
+		{"refused", "/", "application/geo+json;q=0, application/json", false, false},
+		{"refused with a decimal point", "/", "application/json, application/geo+json; q=0.000", false, false},
+		{"low but acceptable", "/", "application/geo+json;q=0.001", true, false},
+		{"unknown format", "/?format=kml", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			got, err := wantsGeoJSON(w, req)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("wantsGeoJSON() = %v, %v; want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+			// only a response chosen by Accept varies by it
+			wantVary := !strings.Contains(tt.path, "format=")
+			if vary := w.Header().Get("Vary"); (vary == "Accept") != wantVary {
+				t.Errorf("Vary %q", vary)
+			}
+		})
+	}
+}
+
+func TestGeoJSONResponses(t *testing.T) {
+	addresses := []*Address{{City: "Москва", Street: "Сухонская", House: "11", Lat: "55.87", Lon: "37.65"}}
+	app := &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) { return addresses, nil },
+			GeoCode_field:       func(params GeocodeParams) ([]*Address, error) { return addresses, nil },
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+
+	for _, path := range []string{"/api/address/search?query=test", "/api/address/geocode?lat=55.87&lng=37.65"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, path, nil)
+			req.Header.Set("Accept", "application/geo+json")
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app.setupRouter().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/geo+json" {
+				t.Errorf("wrong content type %q", ct)
+			}
+			var fc FeatureCollection
+			if err := json.Unmarshal(w.Body.Bytes(), &fc); err != nil {
+				t.Fatal(err)
+			}
+			if len(fc.Features) != 1 || fc.Features[0].Geometry.Coordinates[0] != 37.65 {
+				t.Errorf("wrong feature collection %s", w.Body.String())
+			}
+		})
+	}
+}
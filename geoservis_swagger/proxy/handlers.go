@@ -5,15 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"test/models"
 	"time"
 )
 
 // swagger:parameters GetAddress
 type SearchRequest struct {
-	//A search request in JSON format
-	//example: Москва Обуховская 11
-	Query string `json:"query"`
+	SearchParams
+	//Response detail level: "compact" (default) or "full"
+	//example: full
+	Detail string `json:"detail"`
+	// include the zones containing each address
+	Zones bool `json:"zones"`
 }
 
 //
@@ -25,10 +29,11 @@ type SearchResponse struct {
 
 // swagger:parameters GetAddressByGeocode
 type GeocodeRequest struct {
-	//latitude
-	Lat string `json:"lat"`
-	//longitude
-	Lng string `json:"lng"`
+	GeocodeParams
+	//Response detail level: "compact" (default) or "full"
+	Detail string `json:"detail"`
+	// include the zones containing each address
+	Zones bool `json:"zones"`
 }
 
 //swagger:model
@@ -38,8 +43,8 @@ type GeocodeResponse struct {
 }
 
 func (app *application) Register(w http.ResponseWriter, r *http.Request) {
-	//swagger:route POST /api/register SignUp
-	// swagger:operation POST /api/register SignUp
+	//swagger:route POST /register SignUp
+	// swagger:operation POST /register SignUp
 	//
 	// signup handler
 	//
@@ -96,8 +101,8 @@ func (app *application) Register(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) Login(w http.ResponseWriter, r *http.Request) {
-	//swagger:route POST /api/login Login
-	// swagger:operation POST /api/login Login
+	//swagger:route POST /login Login
+	// swagger:operation POST /login Login
 	//
 	// login handler
 	//
@@ -164,7 +169,7 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 
 	http.SetCookie(w, &http.Cookie{
 		HttpOnly: true,
-		Expires:  time.Now().Add(7 * 24 * time.Hour),
+		Expires:  time.Now().Add(tokenLifetime),
 		SameSite: http.SameSiteLaxMode,
 		Name:     "jwt",
 		Value:    token,
@@ -175,8 +180,8 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) SearchHandler(w http.ResponseWriter, r *http.Request) {
-	//swagger:route POST /api/address/search GetAddress
-	// swagger:operation POST /api/address/search GetAddress
+	//swagger:route POST /address/search GetAddress
+	// swagger:operation POST /address/search GetAddress
 	//
 	// gets addresses either from URL query param or request body
 	//
@@ -185,13 +190,35 @@ func (app *application) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	// ---
 	// produces:
 	// - application/json
+	// - application/geo+json
 	// parameters:
+	// - name: format
+	//   in: query
+	//   type: string
+	//   enum: [json, geojson]
 	// - name: addr_query
 	//   in: query
 	//   type: string
 	// - name: addr_query
 	//   in: body
 	//   type: string
+	// - name: detail
+	//   in: query
+	//   type: string
+	//   enum: [compact, full]
+	// - name: count
+	//   in: query
+	//   type: integer
+	// - name: from_bound
+	//   in: query
+	//   type: string
+	// - name: to_bound
+	//   in: query
+	//   type: string
+	// - name: language
+	//   in: query
+	//   type: string
+	//   enum: [ru, en]
 	// responses:
 	//   '200':
 	//     description: an array of addresses
@@ -199,44 +226,102 @@ func (app *application) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	//         items:
 	//         "$ref": "#/definitions/SearchResponse"
 	//   '400':
-	//      description: invalid request body
+	//      description: invalid request body or parameter not supported by the provider
 	//      schema:
 	//	        type: string
 	//   '500':
 	//        description: internal server error
 	//        schema:
 	//	        type: string
+	//   '502':
+	//        description: the address provider rejected the request
+	//        schema:
+	//	        type: string
+	//   '503':
+	//        description: the address provider is rate limiting or failing
+	//        schema:
+	//	        type: string
+
+	addresses, geoJSON, ok := app.search(w, r)
+	if !ok {
+		return
+	}
+	if geoJSON {
+		app.writeGeoJSON(w, addresses)
+		return
+	}
+	response := SearchResponse{Addresses: addresses}
+	responseJSON, _ := json.Marshal(response)
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Accept", "application/json")
+	w.Write(responseJSON)
+
+}
+
+// search parses the search request, queries the provider and applies the
+// requested detail level. On failure it writes the error response and
+// returns ok == false.
+func (app *application) search(w http.ResponseWriter, r *http.Request) (addresses []*Address, geoJSON bool, ok bool) {
 	var req SearchRequest
-	req.Query = r.URL.Query().Get("query")
+	q := r.URL.Query()
+	req.Query = q.Get("query")
+	req.Detail = q.Get("detail")
+	req.FromBound = q.Get("from_bound")
+	req.ToBound = q.Get("to_bound")
+	req.Language = q.Get("language")
+	if c := q.Get("count"); c != "" {
+		count, err := strconv.Atoi(c)
+		if err != nil {
+			http.Error(w, "Invalid count", http.StatusBadRequest)
+			return nil, false, false
+		}
+		req.Count = count
+	}
+	if err := parseZonesParam(r, &req.Zones); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
 	if req.Query == "" {
 
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
 			app.logger.Error(err.Error())
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
+			return nil, false, false
 		}
 	}
+	full, err := isFullDetail(req.Detail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	geoJSON, err = wantsGeoJSON(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	err = req.SearchParams.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
 	fmt.Println(req.Query)
-	addresses, err := app.geo.AddressSearch(req.Query)
+	addresses, err = app.geo.AddressSearch(req.SearchParams)
 	if err != nil {
-		app.logger.Error(err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		app.geoError(w, err)
+		return nil, false, false
 	}
-	response := SearchResponse{Addresses: addresses}
-	responseJSON, _ := json.Marshal(response)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Accept", "application/json")
-	w.Write(responseJSON)
-
+	addresses = withDetail(addresses, full)
+	if req.Zones {
+		app.tagZones(addresses)
+	}
+	return addresses, geoJSON, true
 }
 
 func (app *application) GeocodeHandler(w http.ResponseWriter, r *http.Request) {
-	//swagger:route POST /api/address/geocode GetAddressByGeocode
-	// swagger:operation POST /api/address/geocode GetAddressByGeocode
+	//swagger:route POST /address/geocode GetAddressByGeocode
+	// swagger:operation POST /address/geocode GetAddressByGeocode
 	//
 	// gets addresses based on geographic coordinates submitted in URL query param or request body
 	//
@@ -245,7 +330,12 @@ func (app *application) GeocodeHandler(w http.ResponseWriter, r *http.Request) {
 	// ---
 	// produces:
 	// - application/json
+	// - application/geo+json
 	// parameters:
+	// - name: format
+	//   in: query
+	//   type: string
+	//   enum: [json, geojson]
 	// - name: lat
 	//   in: query
 	//   type: string
@@ -255,6 +345,16 @@ func (app *application) GeocodeHandler(w http.ResponseWriter, r *http.Request) {
 	// - name: lat_lng
 	//   in: body
 	//   type: string
+	// - name: detail
+	//   in: query
+	//   type: string
+	//   enum: [compact, full]
+	// - name: radius_meters
+	//   in: query
+	//   type: integer
+	// - name: count
+	//   in: query
+	//   type: integer
 	// responses:
 	//  '200':
 	//     description: an array of addresses
@@ -269,12 +369,24 @@ func (app *application) GeocodeHandler(w http.ResponseWriter, r *http.Request) {
 	//        description: internal server error
 	//        schema:
 	//	        type: string
+	//  '502':
+	//        description: the address provider rejected the request
+	//        schema:
+	//	        type: string
+	//  '503':
+	//        description: the address provider is rate limiting or failing
+	//        schema:
+	//	        type: string
 
 	//
 
 	var req GeocodeRequest
-	req.Lat = r.URL.Query().Get("lat")
-	req.Lng = r.URL.Query().Get("lng")
+	q := r.URL.Query()
+	req.Lat = q.Get("lat")
+	req.Lng = q.Get("lng")
+	if !app.parseGeocodeQuery(w, r, &req) {
+		return
+	}
 	if req.Lat == "" || req.Lng == "" {
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
@@ -283,10 +395,12 @@ func (app *application) GeocodeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	addresses, err := app.geo.GeoCode(req.Lat, req.Lng)
-	if err != nil {
-		app.logger.Error(err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	addresses, geoJSON, ok := app.geocode(w, r, &req)
+	if !ok {
+		return
+	}
+	if geoJSON {
+		app.writeGeoJSON(w, addresses)
 		return
 	}
 	response := GeocodeResponse{Addresses: addresses}
@@ -297,3 +411,77 @@ func (app *application) GeocodeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Accept", "application/json")
 	w.Write(responseJSON)
 }
+
+// parseGeocodeQuery reads the optional geocode parameters from the URL query.
+func (app *application) parseGeocodeQuery(w http.ResponseWriter, r *http.Request, req *GeocodeRequest) bool {
+	q := r.URL.Query()
+	req.Detail = q.Get("detail")
+	for name, dst := range map[string]*int{"radius_meters": &req.RadiusMeters, "count": &req.Count} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return false
+			}
+			*dst = n
+		}
+	}
+	if err := parseZonesParam(r, &req.Zones); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// geocode validates a parsed geocode request, queries the provider and
+// applies the requested detail level. On failure it writes the error
+// response and returns ok == false.
+func (app *application) geocode(w http.ResponseWriter, r *http.Request, req *GeocodeRequest) (addresses []*Address, geoJSON bool, ok bool) {
+	full, err := isFullDetail(req.Detail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	geoJSON, err = wantsGeoJSON(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	err = req.GeocodeParams.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	addresses, err = app.geo.GeoCode(req.GeocodeParams)
+	if err != nil {
+		app.geoError(w, err)
+		return nil, false, false
+	}
+	addresses = withDetail(addresses, full)
+	if req.Zones {
+		app.tagZones(addresses)
+	}
+	return addresses, geoJSON, true
+}
+
+// geoError writes the response for an error of the address provider: bad
+// parameters are the client's fault, a failing provider is reported as a bad
+// or unavailable gateway.
+func (app *application) geoError(w http.ResponseWriter, err error) {
+	var unsupported *UnsupportedParamError
+	if errors.As(err, &unsupported) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.logger.Error(err.Error())
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		if upstream.Temporary() {
+			http.Error(w, "Address provider unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Address provider error", http.StatusBadGateway)
+		return
+	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
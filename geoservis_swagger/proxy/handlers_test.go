@@ -18,22 +18,33 @@ import (
 )
 
 type MockGeoService struct {
-	AddressSearch_field func(input string) ([]*Address, error)
-	GeoCode_field       func(lat, lng string) ([]*Address, error)
+	AddressSearch_field func(params SearchParams) ([]*Address, error)
+	GeoCode_field       func(params GeocodeParams) ([]*Address, error)
 }
 
-func (m *MockGeoService) AddressSearch(input string) ([]*Address, error) {
-	return m.AddressSearch_field(input)
+func (m *MockGeoService) AddressSearch(params SearchParams) ([]*Address, error) {
+	return m.AddressSearch_field(params)
 }
 
-func (m *MockGeoService) GeoCode(lat, lng string) ([]*Address, error) {
-	return m.GeoCode_field(lat, lng)
+func (m *MockGeoService) GeoCode(params GeocodeParams) ([]*Address, error) {
+	return m.GeoCode_field(params)
+}
+
+// dadataService is the real DaData client, keyed by DADATA_API_KEY. Tests
+// that need it are skipped without the key.
+func dadataService(t *testing.T) *GeoService {
+	t.Helper()
+	apiKey := os.Getenv("DADATA_API_KEY")
+	if apiKey == "" {
+		t.Skip("DADATA_API_KEY is not set")
+	}
+	return NewGeoService(apiKey)
 }
 
 func newApp(mock *mocks.MockUserModel) *application {
 
 	app := &application{
-		geo:    NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9"),
+		geo:    NewGeoService(""),
 		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
 		user:   mock,
 	}
@@ -44,8 +55,8 @@ func newApp(mock *mocks.MockUserModel) *application {
 
 func TestAddressSearch(t *testing.T) {
 
-	geo := NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9")
-	addresses, err := geo.AddressSearch("Москва, ул Сухонская")
+	geo := dadataService(t)
+	addresses, err := geo.AddressSearch(SearchParams{Query: "Москва, ул Сухонская"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -53,7 +64,7 @@ func TestAddressSearch(t *testing.T) {
 		t.Error("no addresses")
 	}
 
-	empty, err := geo.AddressSearch("Босква, ул Бухонская")
+	empty, err := geo.AddressSearch(SearchParams{Query: "Босква, ул Бухонская"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -64,8 +75,8 @@ func TestAddressSearch(t *testing.T) {
 }
 
 func TestGeoCode(t *testing.T) {
-	geo := NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9")
-	geoCode, err := geo.GeoCode("55.878", "37.653")
+	geo := dadataService(t)
+	geoCode, err := geo.GeoCode(GeocodeParams{Lat: "55.878", Lng: "37.653"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -73,7 +84,7 @@ func TestGeoCode(t *testing.T) {
 		t.Error("no addresses")
 	}
 
-	empty, err := geo.GeoCode("-7575", "-867868")
+	empty, err := geo.GeoCode(GeocodeParams{Lat: "-7575", Lng: "-867868"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -81,7 +92,7 @@ func TestGeoCode(t *testing.T) {
 		t.Error("should be empty")
 	}
 
-	empty2, err := geo.GeoCode("sdfsfsfsf", "fsfsf")
+	empty2, err := geo.GeoCode(GeocodeParams{Lat: "sdfsfsfsf", Lng: "fsfsf"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -91,7 +102,7 @@ func TestGeoCode(t *testing.T) {
 }
 
 func TestMarshalUnMarshalGeoCode(t *testing.T) {
-	client := NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9")
+	client := dadataService(t)
 	lat, lng := "55.878", "37.653"
 	httpClient := &http.Client{}
 	var data = strings.NewReader(fmt.Sprintf(`{"lat": %s, "lon": %s}`, lat, lng))
@@ -117,7 +128,7 @@ func TestMarshalUnMarshalGeoCode(t *testing.T) {
 		t.Error(err)
 	}
 
-	if geocode.Suggestions[0].Data.City != "Москва" {
+	if deref(geocode.Suggestions[0].Data.City) != "Москва" {
 		t.Error("wrong city")
 	}
 
@@ -156,8 +167,12 @@ func TestSearchHandler(t *testing.T) {
 			req.Header.Set("Content-Type", "application/json")
 			w := httptest.NewRecorder()
 			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+			geo := NewGeoService("")
+			if tt.statusCode == http.StatusOK {
+				geo = dadataService(t)
+			}
 			app := &application{
-				geo:    NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9"),
+				geo:    geo,
 				logger: logger,
 			}
 			r := app.setupRouter()
@@ -198,8 +213,12 @@ func TestGeoCodeHandler(t *testing.T) {
 			req.AddCookie(cookie)
 			w := httptest.NewRecorder()
 			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+			geo := NewGeoService("")
+			if tt.statusCode == http.StatusOK {
+				geo = dadataService(t)
+			}
 			app := &application{
-				geo:    NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9"),
+				geo:    geo,
 				logger: logger,
 			}
 			r := app.setupRouter()
@@ -231,8 +250,8 @@ func TestSearchHandler_500(t *testing.T) {
 		logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 		app := &application{
 			geo: &MockGeoService{
-				AddressSearch_field: func(input string) ([]*Address, error) { return nil, errors.New("some error") },
-				GeoCode_field:       func(lat, lng string) ([]*Address, error) { return nil, errors.New("some error") },
+				AddressSearch_field: func(params SearchParams) ([]*Address, error) { return nil, errors.New("some error") },
+				GeoCode_field:       func(params GeocodeParams) ([]*Address, error) { return nil, errors.New("some error") },
 			},
 			logger: logger,
 		}
@@ -265,8 +284,8 @@ func TestGeoCodeHandler_500(t *testing.T) {
 		logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 		app := &application{
 			geo: &MockGeoService{
-				AddressSearch_field: func(input string) ([]*Address, error) { return nil, errors.New("some error") },
-				GeoCode_field:       func(lat, lng string) ([]*Address, error) { return nil, errors.New("some error") },
+				AddressSearch_field: func(params SearchParams) ([]*Address, error) { return nil, errors.New("some error") },
+				GeoCode_field:       func(params GeocodeParams) ([]*Address, error) { return nil, errors.New("some error") },
 			},
 			logger: logger,
 		}
@@ -309,7 +328,7 @@ func TestFileHandler(t *testing.T) {
 			w := httptest.NewRecorder()
 			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 			app := &application{
-				geo:    NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9"),
+				geo:    NewGeoService(""),
 				logger: logger,
 			}
 			r := app.setupRouter()
@@ -552,3 +571,128 @@ func TestRegisterHandler(t *testing.T) {
 	})
 
 }
+
+func TestSearchHandler_detail(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		statusCode int
+		full       bool
+	}{
+		{"compact by default", "/api/address/search?query=test", http.StatusOK, false},
+		{"full detail", "/api/address/search?query=test&detail=full", http.StatusOK, true},
+		{"unknown detail", "/api/address/search?query=test&detail=huge", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := GenerateToken("test")
+
+			req := httptest.NewRequest("POST", tt.path, nil)
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+			w := httptest.NewRecorder()
+			app := &application{
+				geo: &MockGeoService{
+					AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+						return []*Address{{City: "Москва", Street: "Сухонская", House: "11", AddressDetails: &AddressDetails{PostalCode: "127642", QcGeo: "0"}}}, nil
+					},
+				},
+				logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			}
+			r := app.setupRouter()
+
+			r.ServeHTTP(w, req)
+			if w.Code != tt.statusCode {
+				t.Fatalf("expected status code %d but got %d", tt.statusCode, w.Code)
+			}
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+			if got := strings.Contains(w.Body.String(), `"postal_code":"127642"`); got != tt.full {
+				t.Errorf("postal_code present = %v, want %v: %s", got, tt.full, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSearchHandler_params(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{"valid query params", "/api/address/search?query=test&count=5&from_bound=street&to_bound=house", "", http.StatusOK},
+		{"valid body params", "/api/address/search", `{"query":"test","count":3,"locations":[{"city":"Москва"}]}`, http.StatusOK},
+		{"invalid count", "/api/address/search?query=test&count=many", "", http.StatusBadRequest},
+		{"count out of range", "/api/address/search?query=test&count=100", "", http.StatusBadRequest},
+		{"unknown bound", "/api/address/search", `{"query":"test","from_bound":"galaxy"}`, http.StatusBadRequest},
+		{"unsupported by provider", "/api/address/search?query=test&language=en", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app := &application{
+				geo: &MockGeoService{
+					AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+						if err := params.Require("mock", "count", "locations", "from_bound", "to_bound"); err != nil {
+							return nil, err
+						}
+						return []*Address{}, nil
+					},
+				},
+				logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			}
+			r := app.setupRouter()
+
+			r.ServeHTTP(w, req)
+			if w.Code != tt.statusCode {
+				t.Errorf("expected status code %d but got %d: %s", tt.statusCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGeoCodeHandler_params(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{"query params", "/api/address/geocode?lat=55.878&lng=37.653&radius_meters=50&count=2", "", http.StatusOK},
+		{"body params", "/api/address/geocode", `{"lat":"55.878","lng":"37.653","radius_meters":500}`, http.StatusOK},
+		{"invalid radius", "/api/address/geocode?lat=55.878&lng=37.653&radius_meters=far", "", http.StatusBadRequest},
+		{"radius out of range", "/api/address/geocode?lat=55.878&lng=37.653&radius_meters=5000", "", http.StatusBadRequest},
+		{"count out of range", "/api/address/geocode", `{"lat":"55.878","lng":"37.653","count":21}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app := &application{
+				geo: &MockGeoService{
+					GeoCode_field: func(params GeocodeParams) ([]*Address, error) {
+						d := 12.0
+						return []*Address{{City: "Москва", Distance: &d}}, nil
+					},
+				},
+				logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			}
+			r := app.setupRouter()
+
+			r.ServeHTTP(w, req)
+			if w.Code != tt.statusCode {
+				t.Fatalf("expected status code %d but got %d: %s", tt.statusCode, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"distance_meters":12`) {
+				t.Errorf("distance missing from compact response: %s", w.Body.String())
+			}
+		})
+	}
+}
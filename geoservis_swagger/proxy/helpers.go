@@ -1,6 +1,42 @@
 package main
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// tokenLifetime is how long a session token and its cookie are valid.
+const tokenLifetime = 7 * 24 * time.Hour
+
 func GenerateToken(name string) string {
-	_, tokenString, _ := tokenAuth.Encode(map[string]interface{}{"username": name})
+	claims := map[string]interface{}{"username": name}
+	jwtauth.SetIssuedNow(claims)
+	jwtauth.SetExpiryIn(claims, tokenLifetime)
+	_, tokenString, _ := tokenKeys.Load().current.Encode(claims)
 	return tokenString
 }
+
+// isFullDetail validates the detail request parameter.
+func isFullDetail(detail string) (bool, error) {
+	switch detail {
+	case "", "compact":
+		return false, nil
+	case "full":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown detail level %q", detail)
+}
+
+// withDetail strips the extended address fields unless full detail was requested.
+func withDetail(addresses []*Address, full bool) []*Address {
+	if full {
+		return addresses
+	}
+	res := make([]*Address, 0, len(addresses))
+	for _, a := range addresses {
+		res = append(res, a.Compact())
+	}
+	return res
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"test/models"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	defaultJobWorkers   = 2
+	jobPollInterval     = time.Second
+	defaultJobRetry     = 10 * time.Second
+	maxJobRetryDelay    = 5 * time.Minute
+	maxJobAttempts      = 5
+	jobChunkSize        = 100
+	maxJobUploadSize    = 64 << 20
+	jobFormMemory       = 1 << 20
+	defaultJobColumn    = "address"
+	jobResultPageLength = 1000
+)
+
+// startJobWorkers resumes jobs interrupted by the previous shutdown and
+// starts the background workers. They stop when ctx is cancelled.
+func (app *application) startJobWorkers(ctx context.Context) {
+	if app.jobs == nil {
+		return
+	}
+	n, err := app.jobs.Requeue()
+	if err != nil {
+		app.logger.Error("failed to requeue jobs", "error", err.Error())
+	} else if n > 0 {
+		app.logger.Info("resuming jobs", "count", n)
+	}
+
+	workers := app.jobWorkers
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go app.jobWorker(ctx)
+	}
+}
+
+func (app *application) jobWorker(ctx context.Context) {
+	for {
+		job, err := app.jobs.Claim()
+		if err != nil {
+			if !errors.Is(err, models.ErrNoJob) {
+				app.logger.Error("failed to claim job", "error", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jobPollInterval):
+				continue
+			}
+		}
+
+		app.logger.Info("processing job", "id", job.ID)
+		err = app.processJob(ctx, job)
+		switch {
+		case errors.Is(err, context.Canceled):
+			// left running, Requeue picks it up after restart
+			return
+		case err != nil:
+			app.logger.Error("job failed", "id", job.ID, "error", err.Error())
+			app.jobs.Finish(job.ID, models.JobFailed, err.Error())
+		default:
+			app.jobs.Finish(job.ID, models.JobDone, "")
+		}
+	}
+}
+
+// runningJob registers a context for a claimed job that CancelJobHandler
+// cancels. The returned function unregisters it.
+func (app *application) runningJob(ctx context.Context, id int64) (context.Context, func()) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	app.jobCancelsMu.Lock()
+	defer app.jobCancelsMu.Unlock()
+	if app.jobCancels == nil {
+		app.jobCancels = make(map[int64]context.CancelFunc)
+	}
+	app.jobCancels[id] = cancel
+	return jobCtx, func() {
+		app.jobCancelsMu.Lock()
+		defer app.jobCancelsMu.Unlock()
+		delete(app.jobCancels, id)
+		cancel()
+	}
+}
+
+// stopJob cancels the context of a job if it is running here.
+func (app *application) stopJob(id int64) {
+	app.jobCancelsMu.Lock()
+	defer app.jobCancelsMu.Unlock()
+	if cancel, ok := app.jobCancels[id]; ok {
+		cancel()
+	}
+}
+
+func (app *application) processJob(ctx context.Context, job *models.Job) error {
+	jobCtx, done := app.runningJob(ctx, job.ID)
+	defer done()
+	// a cancelled job ends quietly, a worker shutting down leaves it running
+	// for Requeue
+	stopped := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		app.logger.Info("job cancelled", "id", job.ID)
+		return nil
+	}
+
+	col := -1
+	for i, name := range job.Header {
+		if name == job.Column {
+			col = i
+		}
+	}
+	if col < 0 {
+		return fmt.Errorf("column %q not found", job.Column)
+	}
+
+	for {
+		current, err := app.jobs.Get(job.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status == models.JobCancelled {
+			// cancelled before it was registered, or by another process
+			app.logger.Info("job cancelled", "id", job.ID)
+			return nil
+		}
+
+		rows, err := app.jobs.PendingRows(job.ID, jobChunkSize)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for _, row := range rows {
+			if jobCtx.Err() != nil {
+				return stopped()
+			}
+			var rowErr error
+			if col < len(row.Record) {
+				rowErr = app.geocodeRow(jobCtx, row, row.Record[col])
+			} else {
+				row.Error = "missing address column"
+			}
+			if jobCtx.Err() != nil {
+				// the lookup was aborted, the row stays pending
+				return stopped()
+			}
+			if rowErr != nil && row.Attempts+1 < maxJobAttempts {
+				// the row stays pending and is tried again, after a restart too
+				err = app.jobs.RetryRow(job.ID, row.Index)
+				if err != nil {
+					return err
+				}
+				delay := app.jobRetryDelay(row.Attempts + 1)
+				app.logger.Warn("job row will be retried", "id", job.ID, "row", row.Index,
+					"attempt", row.Attempts+1, "retry_in", delay.String(), "error", rowErr.Error())
+				select {
+				case <-jobCtx.Done():
+					return stopped()
+				case <-time.After(delay):
+				}
+				break
+			}
+			if rowErr != nil {
+				// out of attempts, so the job can still finish
+				row.Error = rowErr.Error()
+			}
+			err = app.jobs.SaveRow(job.ID, row)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// jobRetryDelay doubles the wait after every failed attempt of a row, up to
+// maxJobRetryDelay.
+func (app *application) jobRetryDelay(attempt int) time.Duration {
+	delay := app.jobRetry
+	if delay <= 0 {
+		delay = defaultJobRetry
+	}
+	for i := 1; i < attempt && delay < maxJobRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxJobRetryDelay {
+		delay = maxJobRetryDelay
+	}
+	return delay
+}
+
+// retryable reports whether a failed lookup may succeed later: the provider
+// is rate limiting or overloaded, or the network failed. Anything else, an
+// answer that can't be decoded included, fails the same way next time.
+func retryable(err error) bool {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// geocodeRow fills in the result of row. Permanent failures are recorded in
+// the row; transient ones are returned so the row can be retried.
+func (app *application) geocodeRow(ctx context.Context, row *models.JobRow, query string) error {
+	addresses, err := app.searchContext(ctx, SearchParams{Query: query, Count: 1})
+	if err != nil {
+		if retryable(err) {
+			return err
+		}
+		row.Error = err.Error()
+		return nil
+	}
+	if len(addresses) == 0 {
+		row.Error = "not found"
+		return nil
+	}
+	a := addresses[0]
+	row.Lat, row.Lon, row.City, row.Street, row.House = a.Lat, a.Lon, a.City, a.Street, a.House
+	return nil
+}
+
+// ownJob returns the job in the URL if it belongs to the user of the request.
+// Jobs of other users are reported as missing, so their ids reveal nothing.
+func (app *application) ownJob(w http.ResponseWriter, r *http.Request) (*models.Job, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid job id", http.StatusBadRequest)
+		return nil, false
+	}
+	job, err := app.jobs.Get(id)
+	if err == nil && (job.Owner == "" || job.Owner != tokenUser(r)) {
+		err = models.ErrNoJob
+	}
+	if err != nil {
+		app.jobError(w, err)
+		return nil, false
+	}
+	return job, true
+}
+
+func (app *application) jobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNoJob) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	app.logger.Error(err.Error())
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// uploadError writes the response for an error reading an uploaded CSV file.
+func (app *application) uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	var parseErr *csv.ParseError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Upload exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, models.ErrEmptyJob):
+		http.Error(w, "CSV needs a header and at least one row", http.StatusBadRequest)
+	case errors.As(err, &parseErr):
+		http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+	default:
+		app.jobError(w, err)
+	}
+}
+
+func (app *application) CreateJobHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /jobs CreateJob
+	// swagger:operation POST /jobs CreateJob
+	//
+	// uploads a CSV file with an address column and queues it for geocoding
+	//
+	//
+	//
+	// ---
+	// consumes:
+	// - multipart/form-data
+	// - text/csv
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: file
+	//   in: formData
+	//   type: file
+	// - name: column
+	//   in: query
+	//   type: string
+	// responses:
+	//   '202':
+	//     description: the queued job
+	//     schema:
+	//         "$ref": "#/definitions/Job"
+	//   '400':
+	//      description: invalid CSV or missing address column
+	//      schema:
+	//	        type: string
+	//   '413':
+	//      description: upload larger than 64 MiB
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJobUploadSize)
+	column := r.URL.Query().Get("column")
+
+	var file io.Reader = r.Body
+	// a file beyond jobFormMemory is buffered on disk, not in memory
+	err := r.ParseMultipartForm(jobFormMemory)
+	switch {
+	case err == nil:
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Missing file", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		file = f
+		if column == "" {
+			column = r.FormValue("column")
+		}
+	case !errors.Is(err, http.ErrNotMultipart):
+		app.uploadError(w, err)
+		return
+	}
+	if column == "" {
+		column = defaultJobColumn
+	}
+
+	records := csv.NewReader(file)
+	header, err := records.Read()
+	if errors.Is(err, io.EOF) {
+		err = models.ErrEmptyJob
+	}
+	if err != nil {
+		app.uploadError(w, err)
+		return
+	}
+	found := false
+	for _, name := range header {
+		if name == column {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("Column %q not found", column), http.StatusBadRequest)
+		return
+	}
+
+	id, err := app.jobs.Create(tokenUser(r), column, header, records)
+	if err != nil {
+		app.uploadError(w, err)
+		return
+	}
+	job, err := app.jobs.Get(id)
+	if err != nil {
+		app.jobError(w, err)
+		return
+	}
+
+	responseJSON, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/jobs/%d", id))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(responseJSON)
+}
+
+func (app *application) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route GET /jobs/{id} GetJob
+	// swagger:operation GET /jobs/{id} GetJob
+	//
+	// returns the status and progress of a geocoding job
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: integer
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: the job
+	//     schema:
+	//         "$ref": "#/definitions/Job"
+	//   '404':
+	//      description: job not found
+	//      schema:
+	//	        type: string
+
+	job, ok := app.ownJob(w, r)
+	if !ok {
+		return
+	}
+
+	responseJSON, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func (app *application) CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route DELETE /jobs/{id} CancelJob
+	// swagger:operation DELETE /jobs/{id} CancelJob
+	//
+	// cancels a queued or running job
+	//
+	//
+	//
+	// ---
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: integer
+	//   required: true
+	// responses:
+	//   '204':
+	//     description: cancelled
+	//   '404':
+	//      description: job not found
+	//      schema:
+	//	        type: string
+
+	job, ok := app.ownJob(w, r)
+	if !ok {
+		return
+	}
+	err := app.jobs.Cancel(job.ID)
+	if err != nil {
+		app.jobError(w, err)
+		return
+	}
+	app.stopJob(job.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) JobResultHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route GET /jobs/{id}/result GetJobResult
+	// swagger:operation GET /jobs/{id}/result GetJobResult
+	//
+	// downloads the uploaded CSV enriched with lat, lon, city, street and house columns
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - text/csv
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: integer
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: enriched CSV
+	//     schema:
+	//         type: file
+	//   '404':
+	//      description: job not found
+	//      schema:
+	//	        type: string
+	//   '409':
+	//      description: job is not finished
+	//      schema:
+	//	        type: string
+
+	job, ok := app.ownJob(w, r)
+	if !ok {
+		return
+	}
+	id := job.ID
+	if job.Status != models.JobDone {
+		http.Error(w, fmt.Sprintf("Job is %s", job.Status), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job-%d.csv"`, id))
+	out := csv.NewWriter(w)
+	out.Write(append(job.Header, "lat", "lon", "city", "street", "house", "geocode_error"))
+
+	after := -1
+	for {
+		rows, err := app.jobs.Rows(id, after, jobResultPageLength)
+		if err != nil {
+			app.logger.Error("failed to read job rows", "id", id, "error", err.Error())
+			return
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			out.Write(append(row.Record, row.Lat, row.Lon, row.City, row.Street, row.House, row.Error))
+			after = row.Index
+		}
+		out.Flush()
+	}
+	out.Flush()
+}
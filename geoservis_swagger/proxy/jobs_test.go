@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"test/models"
+	"testing"
+	"time"
+)
+
+func newJobsApp(search func(params SearchParams) ([]*Address, error)) *application {
+	return &application{
+		geo:        &MockGeoService{AddressSearch_field: search},
+		logger:     slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		jobs:       &models.JobModel{DB: inmemory_DB()},
+		jobWorkers: 1,
+	}
+}
+
+func doJobRequest(app *application, method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+	return doJobRequestAs(app, "test", method, path, contentType, body)
+}
+
+func doJobRequestAs(app *application, user, method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken(user)})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, req)
+	return w
+}
+
+func waitJob(t *testing.T, app *application, id int64, status string) *models.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w := doJobRequest(app, http.MethodGet, fmt.Sprintf("/api/jobs/%d", id), "", nil)
+		var job models.Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.Status == status {
+			return &job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %d didn't reach status %s", id, status)
+	return nil
+}
+
+func TestJobs(t *testing.T) {
+	app := newJobsApp(func(params SearchParams) ([]*Address, error) {
+		if params.Query == "nowhere" {
+			return nil, nil
+		}
+		return []*Address{{City: params.Query, Street: "Ленина", House: "1", Lat: "55.1", Lon: "37.1"}}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.startJobWorkers(ctx)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("column", "addr")
+	fw, _ := mw.CreateFormFile("file", "addresses.csv")
+	fw.Write([]byte("id,addr\n1,Москва\n2,nowhere\n3,Казань\n"))
+	mw.Close()
+
+	w := doJobRequest(app, http.MethodPost, "/api/jobs", mw.FormDataContentType(), body.Bytes())
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code %d but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	var job models.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	if loc := w.Header().Get("Location"); loc != fmt.Sprintf("/api/v1/jobs/%d", job.ID) {
+		t.Errorf("unexpected Location %q", loc)
+	}
+	if job.Total != 3 {
+		t.Errorf("expected 3 rows but got %d", job.Total)
+	}
+
+	done := waitJob(t, app, job.ID, models.JobDone)
+	if done.Processed != 3 {
+		t.Errorf("expected 3 processed rows but got %d", done.Processed)
+	}
+
+	w = doJobRequest(app, http.MethodGet, fmt.Sprintf("/api/jobs/%d/result", job.ID), "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != "id,addr,lat,lon,city,street,house,geocode_error" {
+		t.Fatalf("wrong result CSV %v", records)
+	}
+	if records[1][4] != "Москва" || records[2][7] != "not found" || records[3][2] != "55.1" {
+		t.Errorf("wrong enriched rows %v", records[1:])
+	}
+}
+
+func TestJobs_errors(t *testing.T) {
+	app := newJobsApp(func(params SearchParams) ([]*Address, error) { return nil, nil })
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{"missing column", http.MethodPost, "/api/jobs?column=street", "id,address\n1,Москва\n", http.StatusBadRequest},
+		{"header only", http.MethodPost, "/api/jobs", "id,address\n", http.StatusBadRequest},
+		{"empty", http.MethodPost, "/api/jobs", "", http.StatusBadRequest},
+		{"ragged rows", http.MethodPost, "/api/jobs", "id,address\n1,Москва\n2\n", http.StatusBadRequest},
+		{"invalid csv", http.MethodPost, "/api/jobs", "id,address\n1,\"Моск", http.StatusBadRequest},
+		{"unknown job", http.MethodGet, "/api/jobs/42", "", http.StatusNotFound},
+		{"invalid id", http.MethodGet, "/api/jobs/abc", "", http.StatusBadRequest},
+		{"cancel unknown job", http.MethodDelete, "/api/jobs/42", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doJobRequest(app, tt.method, tt.path, "text/csv", []byte(tt.body))
+			if w.Code != tt.statusCode {
+				t.Errorf("expected status code %d but got %d: %s", tt.statusCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestJobs_cancel(t *testing.T) {
+	app := newJobsApp(func(params SearchParams) ([]*Address, error) { return nil, nil })
+
+	w := doJobRequest(app, http.MethodPost, "/api/jobs", "text/csv", []byte("address\nМосква\n"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code %d but got %d", http.StatusAccepted, w.Code)
+	}
+	var job models.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+
+	w = doJobRequest(app, http.MethodDelete, fmt.Sprintf("/api/jobs/%d", job.ID), "", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status code %d but got %d", http.StatusNoContent, w.Code)
+	}
+	waitJob(t, app, job.ID, models.JobCancelled)
+
+	w = doJobRequest(app, http.MethodGet, fmt.Sprintf("/api/jobs/%d/result", job.ID), "", nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status code %d but got %d", http.StatusConflict, w.Code)
+	}
+}
+
+// TestJobs_cancelRunning cancels a job while its only worker is waiting for
+// the provider or for a retry, and checks that the worker moves on at once.
+func TestJobs_cancelRunning(t *testing.T) {
+	tests := []struct {
+		name   string
+		lookup func(release chan struct{}) ([]*Address, error)
+	}{
+		{"lookup in flight", func(release chan struct{}) ([]*Address, error) {
+			<-release
+			return nil, nil
+		}},
+		{"waiting to retry", func(release chan struct{}) ([]*Address, error) {
+			return nil, &UpstreamError{Provider: "dadata", Status: http.StatusServiceUnavailable}
+		}},
+	}
+	for _, tt := range tests {
+		// the aborted lookup outlives the subtest
+		lookup := tt.lookup
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			var mu sync.Mutex
+			calls := 0
+			called := make(chan struct{}, 1)
+			app := newJobsApp(func(params SearchParams) ([]*Address, error) {
+				if params.Query != "Москва" {
+					return []*Address{{City: params.Query}}, nil
+				}
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				select {
+				case called <- struct{}{}:
+				default:
+				}
+				return lookup(release)
+			})
+			app.jobRetry = time.Hour
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			app.startJobWorkers(ctx)
+
+			w := doJobRequest(app, http.MethodPost, "/api/jobs", "text/csv", []byte("address\nМосква\nМосква\nМосква\n"))
+			var job models.Job
+			json.Unmarshal(w.Body.Bytes(), &job)
+			select {
+			case <-called:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the job never started")
+			}
+			w = doJobRequest(app, http.MethodDelete, fmt.Sprintf("/api/jobs/%d", job.ID), "", nil)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("expected status code %d but got %d", http.StatusNoContent, w.Code)
+			}
+
+			// the only worker is free for the next job
+			w = doJobRequest(app, http.MethodPost, "/api/jobs", "text/csv", []byte("address\nКазань\n"))
+			var next models.Job
+			json.Unmarshal(w.Body.Bytes(), &next)
+			waitJob(t, app, next.ID, models.JobDone)
+			if got := waitJob(t, app, job.ID, models.JobCancelled); got.Processed != 0 {
+				t.Errorf("cancelled job processed %d rows", got.Processed)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if calls != 1 {
+				t.Errorf("the provider was called %d times after the job was cancelled", calls-1)
+			}
+		})
+	}
+}
+
+func TestJobs_owner(t *testing.T) {
+	app := newJobsApp(func(params SearchParams) ([]*Address, error) { return nil, nil })
+
+	w := doJobRequestAs(app, "alice", http.MethodPost, "/api/jobs", "text/csv", []byte("address\nМосква\n"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code %d but got %d", http.StatusAccepted, w.Code)
+	}
+	var job models.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, fmt.Sprintf("/api/v1/jobs/%d", job.ID)},
+		{http.MethodGet, fmt.Sprintf("/api/v1/jobs/%d/result", job.ID)},
+		{http.MethodDelete, fmt.Sprintf("/api/v1/jobs/%d", job.ID)},
+	} {
+		if w := doJobRequestAs(app, "bob", req.method, req.path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s by another user: got %d", req.method, req.path, w.Code)
+		}
+	}
+	if w := doJobRequestAs(app, "alice", http.MethodGet, fmt.Sprintf("/api/v1/jobs/%d", job.ID), "", nil); w.Code != http.StatusOK {
+		t.Errorf("owner: got %d", w.Code)
+	}
+	if got, _ := app.jobs.Get(job.ID); got.Status != models.JobQueued {
+		t.Errorf("another user cancelled the job: %s", got.Status)
+	}
+}
+
+func TestJobs_transientErrors(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	app := newJobsApp(func(params SearchParams) ([]*Address, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[params.Query]++
+		switch {
+		case params.Query == "Тверь" && calls[params.Query] < 3:
+			return nil, &UpstreamError{Provider: "dadata", Status: http.StatusTooManyRequests}
+		case params.Query == "Казань" && calls[params.Query] < 2:
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		case params.Query == "Бологое":
+			return nil, &UpstreamError{Provider: "dadata", Status: http.StatusForbidden}
+		case params.Query == "Ржев":
+			return nil, &UpstreamError{Provider: "dadata", Status: http.StatusServiceUnavailable}
+		case params.Query == "Тула":
+			return nil, json.Unmarshal([]byte(`{"suggestions": [`), new(GeoCode))
+		}
+		return []*Address{{City: params.Query}}, nil
+	})
+	app.jobRetry = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.startJobWorkers(ctx)
+
+	w := doJobRequest(app, http.MethodPost, "/api/jobs", "text/csv", []byte("address\nТверь\nКазань\nБологое\nРжев\nТула\n"))
+	var job models.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	waitJob(t, app, job.ID, models.JobDone)
+
+	w = doJobRequest(app, http.MethodGet, fmt.Sprintf("/api/jobs/%d/result", job.ID), "", nil)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// address, lat, lon, city, street, house, geocode_error
+	if records[1][3] != "Тверь" || records[1][6] != "" || records[2][3] != "Казань" || records[2][6] != "" {
+		t.Errorf("transiently failed rows were not retried: %v", records[1:])
+	}
+	if !strings.Contains(records[3][6], "403") || records[5][6] == "" {
+		t.Errorf("permanent errors not recorded: %v", records[3:])
+	}
+	if !strings.Contains(records[4][6], "503") {
+		t.Errorf("row out of attempts not recorded: %v", records[4])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["Бологое"] != 1 || calls["Тула"] != 1 {
+		t.Errorf("permanently failed rows were retried: %v", calls)
+	}
+	if calls["Ржев"] != maxJobAttempts {
+		t.Errorf("expected %d attempts of a failing row, got %d", maxJobAttempts, calls["Ржев"])
+	}
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	app := &application{jobRetry: time.Minute}
+	for attempt, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 3: 4 * time.Minute, 4: maxJobRetryDelay, 40: maxJobRetryDelay} {
+		if got := app.jobRetryDelay(attempt); got != want {
+			t.Errorf("attempt %d: got %v, want %v", attempt, got, want)
+		}
+	}
+}
@@ -18,34 +18,67 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"database/sql"
 
-	"github.com/go-chi/jwtauth/v5"
-
 	_ "github.com/mattn/go-sqlite3"
 
 	"test/models"
 )
 
-var tokenAuth *jwtauth.JWTAuth
+const schema = `
+CREATE TABLE IF NOT EXISTS users (id SERIAL PRIMARY KEY, email VARCHAR(100), hashed_password VARCHAR(100));
+CREATE TABLE IF NOT EXISTS jobs (id INTEGER PRIMARY KEY AUTOINCREMENT, owner VARCHAR(100), status VARCHAR(20), address_column VARCHAR(100), header TEXT, total INTEGER, processed INTEGER, error TEXT, created_at DATETIME);
+CREATE TABLE IF NOT EXISTS job_rows (job_id INTEGER, idx INTEGER, record TEXT, done INTEGER, lat VARCHAR(20), lon VARCHAR(20), city VARCHAR(100), street VARCHAR(100), house VARCHAR(50), error TEXT, attempts INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (job_id, idx));
+CREATE TABLE IF NOT EXISTS zones (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(100), geometry TEXT, updated_at DATETIME);
+CREATE TABLE IF NOT EXISTS pois (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(200), lat REAL, lon REAL, tags TEXT);
+`
 
-func init() {
-	tokenAuth = jwtauth.New("HS256", []byte("secret"), nil)
+// migrations add the columns missing from tables created by older versions.
+// Once applied they fail with "duplicate column name", which is ignored.
+var migrations = []string{
+	`ALTER TABLE jobs ADD COLUMN owner VARCHAR(100)`,
+	`ALTER TABLE job_rows ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+}
 
-	_, tokenString, _ := tokenAuth.Encode(map[string]interface{}{"user_id": 123})
-	fmt.Printf("DEBUG: a sample jwt is %s\n\n", tokenString)
+// openDB opens the SQLite database dsn and creates missing tables.
+func openDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory") {
+		// every connection to :memory: is a separate database
+		db.SetMaxOpenConns(1)
+	}
+	_, err = db.Exec(schema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, m := range migrations {
+		_, err = db.Exec(m)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
 }
 
 func inmemory_DB() *sql.DB {
-	db, _ := sql.Open("sqlite3", ":memory:")
-
-	_, err := db.Exec("CREATE TABLE users (id SERIAL PRIMARY KEY, email VARCHAR(100), hashed_password VARCHAR(100))")
+	db, err := openDB(":memory:")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -56,17 +89,139 @@ type application struct {
 	geo    GeoProvider
 	logger *slog.Logger
 	user   models.UserModelInterface
+	jobs   models.JobModelInterface
+	zones  models.ZoneModelInterface
+	// spatial index over zones, swapped on every zone change; zonesMu
+	// serializes the rebuilds so an older list never replaces a newer one
+	zoneIndex atomic.Pointer[zoneIndex]
+	zonesMu   sync.Mutex
+	pois      models.POIModelInterface
+	poiIndex  atomic.Pointer[poiIndex]
+	// held from reading or replacing the dataset until its index is stored
+	poisMu sync.Mutex
+	// background workers processing geocoding jobs, and how long they wait
+	// before the first retry of a row that failed transiently
+	jobWorkers int
+	jobRetry   time.Duration
+	// cancel functions of the running jobs by id, so cancelling a job stops
+	// its worker at once
+	jobCancels   map[int64]context.CancelFunc
+	jobCancelsMu sync.Mutex
+	// how long an autocomplete socket may stay silent, pongs included,
+	// before it is dropped; zero means autocompletePongWait
+	pongWait time.Duration
+	// worker pool size and item limit of the batch endpoints
+	batchWorkers  int
+	batchMaxItems int
+	// routing table for everything not served by the API
+	proxy *ReverseProxy
+	// emails of users allowed to administer the proxy
+	admins map[string]bool
+	// listen address and how long requests may finish on shutdown
+	addr            string
+	shutdownTimeout time.Duration
+	// rotates the secrets while serving, if a provider is configured
+	secrets *secretWatcher
 }
 
 func main() {
+	cfg, printOnly, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printOnly {
+		err = printConfig(os.Stdout, cfg)
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	fmt.Println("starting server")
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger.Info("configuration loaded", "config", cfg)
+	secrets := appSecrets{
+		JWTSecret:    cfg.JWTSecret.Value(),
+		DaDataAPIKey: cfg.DaData.APIKey.Value(),
+	}
+	provider := cfg.secretProvider()
+	if provider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		secrets, err = fetchSecrets(ctx, provider)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	setJWTSecret(secrets.JWTSecret)
+	geo := NewGeoService(secrets.DaDataAPIKey)
+	geo.Filter = cfg.Filter
+	db, err := openDB(cfg.DatabaseDSN)
+	if err != nil {
+		log.Fatal(err)
+	}
 	app := &application{
-		geo:    NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9"),
+		geo:    geo,
 		logger: logger,
-		user:   &models.UserModel{DB: inmemory_DB()},
+		user:   &models.UserModel{DB: db},
+		jobs:   &models.JobModel{DB: db},
+		zones:  &models.ZoneModel{DB: db},
+		pois:   &models.POIModel{DB: db},
+
+		jobWorkers: cfg.Workers.Jobs,
+
+		batchWorkers:  cfg.Workers.Batch,
+		batchMaxItems: cfg.Workers.BatchMaxItems,
+
+		admins:          map[string]bool{},
+		addr:            cfg.Listen,
+		shutdownTimeout: time.Duration(cfg.ShutdownTimeout),
+	}
+	if provider != nil && cfg.Secrets.Refresh > 0 {
+		app.secrets = &secretWatcher{
+			provider: provider,
+			interval: time.Duration(cfg.Secrets.Refresh),
+			logger:   logger,
+			current:  secrets,
+			apply: func(s appSecrets) {
+				setJWTSecret(s.JWTSecret)
+				geo.SetAPIKey(s.DaDataAPIKey)
+			},
+		}
+	}
+	for _, email := range cfg.Admins {
+		app.admins[email] = true
+	}
+	switch {
+	case cfg.Proxy.Routes != "":
+		// reloaded on SIGHUP
+		app.proxy, err = NewReverseProxyFromFile(cfg.Proxy.Routes)
+	case cfg.Proxy.StaticDir != "":
+		app.proxy = newReverseProxy("")
+		err = app.proxy.Load(StaticProxyConfig(cfg.Proxy.StaticDir))
+	default:
+		host, port, _ := net.SplitHostPort(cfg.Proxy.Upstream)
+		app.proxy = NewReverseProxy(host, port)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = app.rebuildZones()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = app.rebuildPOIs()
+	if err != nil {
+		log.Fatal(err)
 	}
-	err := app.serve()
+	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/csv"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"test/models"
 	"testing"
 	"time"
 
@@ -11,6 +17,12 @@ import (
 )
 
 func TestMainfunc(t *testing.T) {
+	// main reads its flags from os.Args, which holds the test binary's own
+	// -test.* flags; main's flag set would reject them and exit
+	os.Args = os.Args[:1]
+	t.Setenv("JWT_SECRET", "test-secret-of-32-characters-xx")
+	t.Setenv("DADATA_API_KEY", "test")
+	t.Setenv("DB_DSN", ":memory:")
 	go func() {
 		main()
 	}()
@@ -18,6 +30,44 @@ func TestMainfunc(t *testing.T) {
 	t.Log("main finished")
 }
 
+func TestOpenDB_migrations(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "geo.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tables as created before jobs had owners and rows counted attempts
+	_, err = db.Exec(`CREATE TABLE jobs (id INTEGER PRIMARY KEY AUTOINCREMENT, status VARCHAR(20), address_column VARCHAR(100), header TEXT, total INTEGER, processed INTEGER, error TEXT, created_at DATETIME);
+CREATE TABLE job_rows (job_id INTEGER, idx INTEGER, record TEXT, done INTEGER, lat VARCHAR(20), lon VARCHAR(20), city VARCHAR(100), street VARCHAR(100), house VARCHAR(50), error TEXT, PRIMARY KEY (job_id, idx))`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// twice: the second run finds the columns already there
+	for i := 0; i < 2; i++ {
+		db, err = openDB(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs := &models.JobModel{DB: db}
+		id, err := jobs.Create("alice", "address", []string{"address"}, csv.NewReader(strings.NewReader("Москва\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job, err := jobs.Get(id); err != nil || job.Owner != "alice" {
+			t.Errorf("got %+v %v", job, err)
+		}
+		if err := jobs.RetryRow(id, 0); err != nil {
+			t.Fatal(err)
+		}
+		if rows, err := jobs.PendingRows(id, 1); err != nil || len(rows) != 1 || rows[0].Attempts != 1 {
+			t.Errorf("got %+v %v", rows, err)
+		}
+		db.Close()
+	}
+}
+
 func TestReverseProxy_proxy(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/api", nil)
 	w := httptest.NewRecorder()
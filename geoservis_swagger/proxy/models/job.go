@@ -0,0 +1,269 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNoJob = errors.New("job doesn't exist")
+
+// ErrEmptyJob is returned by Create when there are no records.
+var ErrEmptyJob = errors.New("job has no records")
+
+// RecordReader yields records until io.EOF, as *csv.Reader does.
+type RecordReader interface {
+	Read() ([]string, error)
+}
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+type JobModelInterface interface {
+	Create(owner, column string, header []string, records RecordReader) (int64, error)
+	Get(id int64) (*Job, error)
+	Cancel(id int64) error
+	Claim() (*Job, error)
+	Requeue() (int64, error)
+	PendingRows(id int64, limit int) ([]*JobRow, error)
+	SaveRow(id int64, row *JobRow) error
+	RetryRow(id int64, idx int) error
+	Finish(id int64, status, errMsg string) error
+	Rows(id int64, after, limit int) ([]*JobRow, error)
+}
+
+// Job is an uploaded CSV file being geocoded. Only its Owner, the user who
+// uploaded it, can see it.
+type Job struct {
+	ID        int64     `json:"id"`
+	Owner     string    `json:"-"`
+	Status    string    `json:"status"`
+	Column    string    `json:"column"`
+	Header    []string  `json:"-"`
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// JobRow is one CSV record of a job together with its geocoding result.
+type JobRow struct {
+	Index  int
+	Record []string
+	Done   bool
+	Lat    string
+	Lon    string
+	City   string
+	Street string
+	House  string
+	Error  string
+	// failed attempts that are worth retrying
+	Attempts int
+}
+
+type JobModel struct {
+	DB *sql.DB
+}
+
+// Create stores a queued job, reading its records one at a time so an upload
+// is never held in memory as a whole.
+func (m *JobModel) Create(owner, column string, header []string, records RecordReader) (int64, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO jobs (owner, status, address_column, header, total, processed, created_at)
+	 VALUES(?, ?, ?, ?, 0, 0, ?)`, owner, JobQueued, column, string(headerJSON), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO job_rows (job_id, idx, record, done) VALUES(?, ?, ?, 0)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	total := 0
+	for ; ; total++ {
+		rec, err := records.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		recJSON, err := json.Marshal(rec)
+		if err != nil {
+			return 0, err
+		}
+		_, err = stmt.Exec(id, total, string(recJSON))
+		if err != nil {
+			return 0, err
+		}
+	}
+	if total == 0 {
+		return 0, ErrEmptyJob
+	}
+	_, err = tx.Exec(`UPDATE jobs SET total = ? WHERE id = ?`, total, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func (m *JobModel) Get(id int64) (*Job, error) {
+	var job Job
+	var header string
+	var owner, errMsg sql.NullString
+
+	stmt := `SELECT id, owner, status, address_column, header, total, processed, error, created_at FROM jobs WHERE id = ?`
+	err := m.DB.QueryRow(stmt, id).Scan(&job.ID, &owner, &job.Status, &job.Column, &header, &job.Total, &job.Processed, &errMsg, &job.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoJob
+		}
+		return nil, err
+	}
+	job.Owner, job.Error = owner.String, errMsg.String
+
+	err = json.Unmarshal([]byte(header), &job.Header)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Cancel stops a queued or running job. Finished jobs are left untouched.
+func (m *JobModel) Cancel(id int64) error {
+	_, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.Exec(`UPDATE jobs SET status = ? WHERE id = ? AND status IN (?, ?)`, JobCancelled, id, JobQueued, JobRunning)
+	return err
+}
+
+// Claim marks the oldest queued job as running and returns it, or ErrNoJob.
+func (m *JobModel) Claim() (*Job, error) {
+	for {
+		var id int64
+		err := m.DB.QueryRow(`SELECT id FROM jobs WHERE status = ? ORDER BY id LIMIT 1`, JobQueued).Scan(&id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrNoJob
+			}
+			return nil, err
+		}
+
+		res, err := m.DB.Exec(`UPDATE jobs SET status = ? WHERE id = ? AND status = ?`, JobRunning, id, JobQueued)
+		if err != nil {
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			return m.Get(id)
+		}
+		// another worker claimed it first
+	}
+}
+
+// Requeue puts jobs interrupted by a shutdown back in the queue. Rows that
+// were already processed are kept, so the job resumes where it stopped.
+func (m *JobModel) Requeue() (int64, error) {
+	res, err := m.DB.Exec(`UPDATE jobs SET status = ? WHERE status = ?`, JobQueued, JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (m *JobModel) PendingRows(id int64, limit int) ([]*JobRow, error) {
+	return m.queryRows(`SELECT idx, record, done, lat, lon, city, street, house, error, attempts FROM job_rows
+	 WHERE job_id = ? AND done = 0 ORDER BY idx LIMIT ?`, id, limit)
+}
+
+func (m *JobModel) SaveRow(id int64, row *JobRow) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE job_rows SET done = 1, lat = ?, lon = ?, city = ?, street = ?, house = ?, error = ?
+	 WHERE job_id = ? AND idx = ?`, row.Lat, row.Lon, row.City, row.Street, row.House, row.Error, id, row.Index)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE jobs SET processed = processed + 1 WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RetryRow counts a failed attempt of a row that stays pending.
+func (m *JobModel) RetryRow(id int64, idx int) error {
+	_, err := m.DB.Exec(`UPDATE job_rows SET attempts = attempts + 1 WHERE job_id = ? AND idx = ?`, id, idx)
+	return err
+}
+
+// Finish sets the final status of a running job. A job cancelled in the
+// meantime stays cancelled.
+func (m *JobModel) Finish(id int64, status, errMsg string) error {
+	_, err := m.DB.Exec(`UPDATE jobs SET status = ?, error = ? WHERE id = ? AND status = ?`, status, errMsg, id, JobRunning)
+	return err
+}
+
+// Rows returns up to limit rows with an index greater than after.
+func (m *JobModel) Rows(id int64, after, limit int) ([]*JobRow, error) {
+	return m.queryRows(`SELECT idx, record, done, lat, lon, city, street, house, error, attempts FROM job_rows
+	 WHERE job_id = ? AND idx > ? ORDER BY idx LIMIT ?`, id, after, limit)
+}
+
+func (m *JobModel) queryRows(query string, args ...interface{}) ([]*JobRow, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*JobRow
+	for rows.Next() {
+		var row JobRow
+		var record string
+		var lat, lon, city, street, house, errMsg sql.NullString
+		err = rows.Scan(&row.Index, &record, &row.Done, &lat, &lon, &city, &street, &house, &errMsg, &row.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(record), &row.Record)
+		if err != nil {
+			return nil, err
+		}
+		row.Lat, row.Lon, row.City, row.Street, row.House, row.Error = lat.String, lon.String, city.String, street.String, house.String, errMsg.String
+		res = append(res, &row)
+	}
+	return res, rows.Err()
+}
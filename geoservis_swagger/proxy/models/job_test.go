@@ -0,0 +1,131 @@
+package models
+
+import (
+	"encoding/csv"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestJobModel(t *testing.T) {
+	model := &JobModel{DB: inmemory_DB()}
+
+	id, err := model.Create("test", "address", []string{"id", "address"}, csv.NewReader(strings.NewReader("1,Москва\n2,Казань\n3,Тверь\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("created", func(t *testing.T) {
+		job, err := model.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != JobQueued || job.Owner != "test" || job.Total != 3 || job.Header[1] != "address" {
+			t.Errorf("wrong job %+v", job)
+		}
+	})
+
+	t.Run("empty and invalid", func(t *testing.T) {
+		if _, err := model.Create("test", "address", []string{"address"}, csv.NewReader(strings.NewReader(""))); !errors.Is(err, ErrEmptyJob) {
+			t.Errorf("empty: got %v", err)
+		}
+		var parseErr *csv.ParseError
+		if _, err := model.Create("test", "address", []string{"address"}, csv.NewReader(strings.NewReader("Москва\n\"Каз"))); !errors.As(err, &parseErr) {
+			t.Errorf("invalid: got %v", err)
+		}
+		// neither left a job behind
+		if _, err := model.Get(id + 1); !errors.Is(err, ErrNoJob) {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("nonexistent job", func(t *testing.T) {
+		_, err := model.Get(id + 100)
+		if !errors.Is(err, ErrNoJob) {
+			t.Error(err)
+		}
+		if err := model.Cancel(id + 100); !errors.Is(err, ErrNoJob) {
+			t.Error(err)
+		}
+	})
+
+	t.Run("claim and process", func(t *testing.T) {
+		job, err := model.Claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.ID != id || job.Status != JobRunning {
+			t.Fatalf("wrong claimed job %+v", job)
+		}
+		if _, err := model.Claim(); !errors.Is(err, ErrNoJob) {
+			t.Errorf("expected no queued jobs, got %v", err)
+		}
+
+		rows, err := model.PendingRows(id, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[1].Record[1] != "Казань" {
+			t.Fatalf("wrong pending rows %+v", rows)
+		}
+		if rows[1].Attempts != 0 {
+			t.Errorf("new row has %d attempts", rows[1].Attempts)
+		}
+		if err := model.RetryRow(id, rows[1].Index); err != nil {
+			t.Fatal(err)
+		}
+		rows[0].Lat, rows[0].City = "55.75", "Москва"
+		if err := model.SaveRow(id, rows[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		job, _ = model.Get(id)
+		if job.Processed != 1 {
+			t.Errorf("expected 1 processed row, got %d", job.Processed)
+		}
+	})
+
+	t.Run("requeue resumes", func(t *testing.T) {
+		n, err := model.Requeue()
+		if err != nil || n != 1 {
+			t.Fatalf("requeue: %d, %v", n, err)
+		}
+		if _, err := model.Claim(); err != nil {
+			t.Fatal(err)
+		}
+		rows, _ := model.PendingRows(id, 10)
+		if len(rows) != 2 || rows[0].Index != 1 {
+			t.Errorf("processed rows should be kept after requeue: %+v", rows)
+		}
+		if rows[0].Attempts != 1 {
+			t.Errorf("attempts should be kept after requeue: %+v", rows[0])
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		if err := model.Cancel(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := model.Finish(id, JobDone, ""); err != nil {
+			t.Fatal(err)
+		}
+		job, _ := model.Get(id)
+		if job.Status != JobCancelled {
+			t.Errorf("cancelled job finished as %s", job.Status)
+		}
+	})
+
+	t.Run("result rows", func(t *testing.T) {
+		rows, err := model.Rows(id, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0].Index != 1 {
+			t.Errorf("wrong rows after index 0: %+v", rows)
+		}
+		all, _ := model.Rows(id, -1, 10)
+		if !all[0].Done || all[0].City != "Москва" {
+			t.Errorf("saved row not returned: %+v", all[0])
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+type POIModelInterface interface {
+	Replace(pois []*POI) error
+	List() ([]*POI, error)
+}
+
+// POI is one of our own points of interest, such as a pickup point.
+type POI struct {
+	ID   int64    `json:"id"`
+	Name string   `json:"name"`
+	Lat  float64  `json:"lat"`
+	Lon  float64  `json:"lon"`
+	Tags []string `json:"tags"`
+}
+
+type POIModel struct {
+	DB *sql.DB
+}
+
+// Replace swaps the whole dataset for pois in one transaction and assigns
+// their ids.
+func (m *POIModel) Replace(pois []*POI) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM pois`)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO pois (name, lat, lon, tags) VALUES(?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range pois {
+		tags, err := json.Marshal(p.Tags)
+		if err != nil {
+			return err
+		}
+		res, err := stmt.Exec(p.Name, p.Lat, p.Lon, string(tags))
+		if err != nil {
+			return err
+		}
+		p.ID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *POIModel) List() ([]*POI, error) {
+	rows, err := m.DB.Query(`SELECT id, name, lat, lon, tags FROM pois ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pois := []*POI{}
+	for rows.Next() {
+		var p POI
+		var tags string
+		err = rows.Scan(&p.ID, &p.Name, &p.Lat, &p.Lon, &tags)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(tags), &p.Tags)
+		if err != nil {
+			return nil, err
+		}
+		pois = append(pois, &p)
+	}
+	return pois, rows.Err()
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestPOIModel(t *testing.T) {
+	model := &POIModel{DB: inmemory_DB()}
+
+	first := []*POI{{Name: "a", Lat: 1, Lon: 2, Tags: []string{"x"}}, {Name: "b", Lat: 3, Lon: 4}}
+	if err := model.Replace(first); err != nil {
+		t.Fatal(err)
+	}
+	if first[0].ID == 0 || first[1].ID == first[0].ID {
+		t.Errorf("ids not assigned: %+v %+v", first[0], first[1])
+	}
+
+	if err := model.Replace([]*POI{{Name: "c", Lat: 5, Lon: 6, Tags: []string{"y", "z"}}}); err != nil {
+		t.Fatal(err)
+	}
+	pois, err := model.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pois) != 1 || pois[0].Name != "c" || pois[0].Lat != 5 || len(pois[0].Tags) != 2 {
+		t.Errorf("expected the dataset to be replaced, got %+v", pois)
+	}
+}
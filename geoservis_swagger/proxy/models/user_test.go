@@ -9,10 +9,19 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const schema = `
+CREATE TABLE users (id SERIAL PRIMARY KEY, email VARCHAR(100), hashed_password VARCHAR(100));
+CREATE TABLE jobs (id INTEGER PRIMARY KEY AUTOINCREMENT, owner VARCHAR(100), status VARCHAR(20), address_column VARCHAR(100), header TEXT, total INTEGER, processed INTEGER, error TEXT, created_at DATETIME);
+CREATE TABLE job_rows (job_id INTEGER, idx INTEGER, record TEXT, done INTEGER, lat VARCHAR(20), lon VARCHAR(20), city VARCHAR(100), street VARCHAR(100), house VARCHAR(50), error TEXT, attempts INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (job_id, idx));
+CREATE TABLE zones (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(100), geometry TEXT, updated_at DATETIME);
+CREATE TABLE pois (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(200), lat REAL, lon REAL, tags TEXT);
+`
+
 func inmemory_DB() *sql.DB {
 	db, _ := sql.Open("sqlite3", ":memory:")
+	db.SetMaxOpenConns(1)
 
-	_, err := db.Exec("CREATE TABLE users (id SERIAL PRIMARY KEY, email VARCHAR(100), hashed_password VARCHAR(100))")
+	_, err := db.Exec(schema)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrNoZone = errors.New("zone doesn't exist")
+
+type ZoneModelInterface interface {
+	Create(name string, geometry json.RawMessage) (int64, error)
+	Get(id int64) (*Zone, error)
+	List() ([]*Zone, error)
+	Update(id int64, name string, geometry json.RawMessage) error
+	Delete(id int64) error
+}
+
+// Zone is a named area stored as a GeoJSON Polygon or MultiPolygon geometry.
+type Zone struct {
+	ID        int64           `json:"id"`
+	Name      string          `json:"name"`
+	Geometry  json.RawMessage `json:"geometry"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+type ZoneModel struct {
+	DB *sql.DB
+}
+
+func (m *ZoneModel) Create(name string, geometry json.RawMessage) (int64, error) {
+	res, err := m.DB.Exec(`INSERT INTO zones (name, geometry, updated_at) VALUES(?, ?, ?)`, name, string(geometry), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (m *ZoneModel) Get(id int64) (*Zone, error) {
+	var zone Zone
+	var geometry string
+	err := m.DB.QueryRow(`SELECT id, name, geometry, updated_at FROM zones WHERE id = ?`, id).Scan(&zone.ID, &zone.Name, &geometry, &zone.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoZone
+		}
+		return nil, err
+	}
+	zone.Geometry = json.RawMessage(geometry)
+	return &zone, nil
+}
+
+func (m *ZoneModel) List() ([]*Zone, error) {
+	rows, err := m.DB.Query(`SELECT id, name, geometry, updated_at FROM zones ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []*Zone{}
+	for rows.Next() {
+		var zone Zone
+		var geometry string
+		err = rows.Scan(&zone.ID, &zone.Name, &geometry, &zone.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		zone.Geometry = json.RawMessage(geometry)
+		zones = append(zones, &zone)
+	}
+	return zones, rows.Err()
+}
+
+func (m *ZoneModel) Update(id int64, name string, geometry json.RawMessage) error {
+	res, err := m.DB.Exec(`UPDATE zones SET name = ?, geometry = ?, updated_at = ? WHERE id = ?`, name, string(geometry), time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	return noZoneIfUnchanged(res)
+}
+
+func (m *ZoneModel) Delete(id int64) error {
+	res, err := m.DB.Exec(`DELETE FROM zones WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return noZoneIfUnchanged(res)
+}
+
+func noZoneIfUnchanged(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoZone
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestZoneModel(t *testing.T) {
+	model := &ZoneModel{DB: inmemory_DB()}
+	square := json.RawMessage(`{"type":"Polygon","coordinates":[[[37,55],[38,55],[38,56],[37,56],[37,55]]]}`)
+
+	id, err := model.Create("центр", square)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone, err := model.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Name != "центр" || string(zone.Geometry) != string(square) {
+		t.Errorf("wrong zone %+v", zone)
+	}
+
+	err = model.Update(id, "север", square)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones, err := model.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 1 || zones[0].Name != "север" {
+		t.Errorf("wrong zones after update %+v", zones)
+	}
+
+	err = model.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Get(id); !errors.Is(err, ErrNoZone) {
+		t.Errorf("expected ErrNoZone after delete, got %v", err)
+	}
+	if err := model.Delete(id); !errors.Is(err, ErrNoZone) {
+		t.Errorf("expected ErrNoZone deleting twice, got %v", err)
+	}
+	if err := model.Update(id, "x", square); !errors.Is(err, ErrNoZone) {
+		t.Errorf("expected ErrNoZone updating a deleted zone, got %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"test/geo"
+	"test/models"
+)
+
+const (
+	maxPOIUploadSize = 32 << 20
+	defaultPOICount  = 5
+	maxPOICount      = 100
+)
+
+// poiIndex is an immutable snapshot of the POI dataset, swapped on upload.
+type poiIndex struct {
+	tree *geo.KDTree
+	pois []*models.POI
+}
+
+// NearbyPOI is a point of interest with its distance from the query point.
+type NearbyPOI struct {
+	*models.POI
+	// rounded to whole meters
+	Distance float64 `json:"distance_meters"`
+}
+
+//swagger:model
+type NearestPOIResponse struct {
+	// the query point, geocoded when an address was given
+	Origin geo.Point    `json:"origin"`
+	POIs   []*NearbyPOI `json:"pois"`
+}
+
+// rebuildPOIs loads the dataset from the store into a new index.
+func (app *application) rebuildPOIs() error {
+	if app.pois == nil {
+		return nil
+	}
+	app.poisMu.Lock()
+	defer app.poisMu.Unlock()
+	pois, err := app.pois.List()
+	if err != nil {
+		return err
+	}
+	app.setPOIs(pois)
+	return nil
+}
+
+func (app *application) setPOIs(pois []*models.POI) {
+	points := make([]geo.Point, len(pois))
+	for i, p := range pois {
+		points[i] = geo.Point{Lat: p.Lat, Lon: p.Lon}
+	}
+	app.poiIndex.Store(&poiIndex{tree: geo.NewKDTree(points), pois: pois})
+}
+
+// nearestPOIs returns up to k points nearest to p, closest first. A positive
+// radius in meters excludes anything farther.
+func (app *application) nearestPOIs(p geo.Point, k int, radius float64) []*NearbyPOI {
+	res := []*NearbyPOI{}
+	idx := app.poiIndex.Load()
+	if idx == nil {
+		return res
+	}
+	for _, n := range idx.tree.Nearest(p, k, radius) {
+		res = append(res, &NearbyPOI{POI: idx.pois[n.Index], Distance: math.Round(n.Meters)})
+	}
+	return res
+}
+
+// parsePOIs reads a GeoJSON FeatureCollection of points, or a CSV with name,
+// lat and lon columns and an optional tags column separated by semicolons.
+func parsePOIs(r io.Reader) ([]*models.POI, error) {
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, errors.New("empty upload")
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.Discard(1)
+		case '{':
+			return parsePOIGeoJSON(br)
+		default:
+			return parsePOICSV(br)
+		}
+	}
+}
+
+func parsePOICSV(r io.Reader) ([]*models.POI, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, errors.New("CSV needs a header and at least one row")
+	}
+	cols := map[string]int{"tags": -1}
+	for i, name := range records[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "lat", "lon"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("column %q not found", name)
+		}
+	}
+
+	pois := make([]*models.POI, 0, len(records)-1)
+	for i, rec := range records[1:] {
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(rec[cols["lat"]]), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(rec[cols["lon"]]), 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("row %d: invalid coordinates", i+1)
+		}
+		p := &models.POI{Name: rec[cols["name"]], Lat: lat, Lon: lon, Tags: []string{}}
+		if c := cols["tags"]; c >= 0 {
+			p.Tags = splitTags(rec[c])
+		}
+		if err := validatePOI(p); err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		pois = append(pois, p)
+	}
+	return pois, nil
+}
+
+func parsePOIGeoJSON(r io.Reader) ([]*models.POI, error) {
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				Name string          `json:"name"`
+				Tags json.RawMessage `json:"tags"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	err := json.NewDecoder(r).Decode(&fc)
+	if err != nil {
+		return nil, err
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, errors.New("GeoJSON upload must be a FeatureCollection")
+	}
+
+	pois := make([]*models.POI, 0, len(fc.Features))
+	for i, f := range fc.Features {
+		if f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) < 2 {
+			return nil, fmt.Errorf("feature %d: geometry must be a Point", i)
+		}
+		p := &models.POI{
+			Name: f.Properties.Name,
+			Lat:  f.Geometry.Coordinates[1],
+			Lon:  f.Geometry.Coordinates[0],
+			Tags: []string{},
+		}
+		if t := bytes.TrimSpace(f.Properties.Tags); len(t) > 0 && string(t) != "null" {
+			var s string
+			if json.Unmarshal(t, &s) == nil {
+				p.Tags = splitTags(s)
+			} else if json.Unmarshal(t, &p.Tags) != nil {
+				return nil, fmt.Errorf("feature %d: tags must be a string or an array of strings", i)
+			}
+		}
+		if err := validatePOI(p); err != nil {
+			return nil, fmt.Errorf("feature %d: %w", i, err)
+		}
+		pois = append(pois, p)
+	}
+	return pois, nil
+}
+
+func splitTags(s string) []string {
+	tags := []string{}
+	for _, t := range strings.Split(s, ";") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func validatePOI(p *models.POI) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	return validateCoords(&p.Lat, &p.Lon)
+}
+
+func (app *application) UploadPOIHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /poi UploadPOI
+	// swagger:operation POST /poi UploadPOI
+	//
+	// replaces the points of interest with an uploaded CSV or GeoJSON FeatureCollection
+	//
+	//
+	//
+	// ---
+	// consumes:
+	// - multipart/form-data
+	// - text/csv
+	// - application/geo+json
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: file
+	//   in: formData
+	//   type: file
+	// responses:
+	//   '200':
+	//     description: number of points loaded
+	//     schema:
+	//         type: object
+	//   '400':
+	//      description: invalid CSV or GeoJSON
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPOIUploadSize)
+	var file io.Reader = r.Body
+	if f, _, err := r.FormFile("file"); err == nil {
+		defer f.Close()
+		file = f
+	}
+
+	pois, err := parsePOIs(file)
+	if err != nil {
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// two uploads must store their indexes in the order they replaced the
+	// dataset
+	app.poisMu.Lock()
+	err = app.pois.Replace(pois)
+	if err == nil {
+		app.setPOIs(pois)
+	}
+	app.poisMu.Unlock()
+	if err != nil {
+		app.logger.Error(err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	responseJSON, _ := json.Marshal(map[string]int{"count": len(pois)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func (app *application) NearestPOIHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route GET /poi/nearest NearestPOI
+	// swagger:operation GET /poi/nearest NearestPOI
+	//
+	// returns the points of interest nearest to coordinates or an address, closest first
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: lat
+	//   in: query
+	//   type: number
+	// - name: lng
+	//   in: query
+	//   type: number
+	// - name: address
+	//   in: query
+	//   type: string
+	// - name: k
+	//   in: query
+	//   type: integer
+	// - name: radius
+	//   in: query
+	//   type: number
+	// responses:
+	//   '200':
+	//     description: nearest points of interest
+	//     schema:
+	//         "$ref": "#/definitions/NearestPOIResponse"
+	//   '400':
+	//      description: missing or invalid parameters, or address not found
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	q := r.URL.Query()
+	k := defaultPOICount
+	if v := q.Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPOICount {
+			http.Error(w, fmt.Sprintf("k must be between 1 and %d", maxPOICount), http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	var radius float64
+	if v := q.Get("radius"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f > 0) || math.IsInf(f, 0) {
+			http.Error(w, "radius must be a positive number of meters", http.StatusBadRequest)
+			return
+		}
+		radius = f
+	}
+
+	var origin geo.Point
+	switch {
+	case q.Get("lat") != "" || q.Get("lng") != "":
+		lat, err1 := strconv.ParseFloat(q.Get("lat"), 64)
+		lng, err2 := strconv.ParseFloat(q.Get("lng"), 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Invalid lat or lng", http.StatusBadRequest)
+			return
+		}
+		if err := validateCoords(&lat, &lng); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		origin = geo.Point{Lat: lat, Lon: lng}
+	case q.Get("address") != "":
+		points, err := app.resolvePoints([]GeoInput{{Address: q.Get("address")}}, map[string]geo.Point{})
+		if err != nil {
+			app.resolveError(w, err)
+			return
+		}
+		origin = points[0]
+	default:
+		http.Error(w, "lat and lng or address are required", http.StatusBadRequest)
+		return
+	}
+
+	response := NearestPOIResponse{Origin: origin, POIs: app.nearestPOIs(origin, k, radius)}
+	responseJSON, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
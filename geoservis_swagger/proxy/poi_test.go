@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"test/models"
+	"testing"
+	"time"
+)
+
+const poiCSV = "\xef\xbb\xbfname,lat,lon,tags\n" +
+	"Сухонская,55.8782,37.6537,pickup;24h\n" +
+	"Тверская,55.7600,37.6100,pickup\n" +
+	"Пулково,59.8003,30.2625,\n"
+
+func TestParsePOIs(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{"csv", poiCSV, 3, false},
+		{"geojson", `  {"type": "FeatureCollection", "features": [
+			{"type": "Feature", "geometry": {"type": "Point", "coordinates": [37.6537, 55.8782]}, "properties": {"name": "a", "tags": ["pickup"]}},
+			{"type": "Feature", "geometry": {"type": "Point", "coordinates": [37.61, 55.76]}, "properties": {"name": "b", "tags": "pickup; 24h"}}
+		]}`, 2, false},
+		{"csv missing lon", "name,lat\nx,1\n", 0, true},
+		{"csv bad coordinates", "name,lat,lon\nx,abc,1\n", 0, true},
+		{"csv out of range", "name,lat,lon\nx,91,1\n", 0, true},
+		{"csv no name", "name,lat,lon\n ,1,1\n", 0, true},
+		{"geojson not points", `{"type": "FeatureCollection", "features": [{"geometry": {"type": "LineString", "coordinates": [[0,0],[1,1]]}, "properties": {"name": "x"}}]}`, 0, true},
+		{"geojson feature", `{"type": "Feature"}`, 0, true},
+		{"empty", "  \n", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePOIs(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePOIs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("expected %d points, got %d", tt.want, len(got))
+			}
+		})
+	}
+
+	pois, _ := parsePOIs(strings.NewReader(poiCSV))
+	if pois[0].Name != "Сухонская" || len(pois[0].Tags) != 2 || pois[0].Tags[1] != "24h" || len(pois[2].Tags) != 0 {
+		t.Errorf("wrong parsed points %+v %+v", pois[0], pois[2])
+	}
+}
+
+func TestPOIHandlers(t *testing.T) {
+	var geocoded int
+	app := &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+				geocoded++
+				return []*Address{{City: "Москва", Lat: "55.7558", Lon: "37.6173"}}, nil
+			},
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		pois:   &models.POIModel{DB: inmemory_DB()},
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "points.csv")
+	fw.Write([]byte(poiCSV))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/poi", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"count":3`) {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantNames  []string
+		geocodes   int
+	}{
+		{"by coordinates", "lat=55.76&lng=37.61&k=2", http.StatusOK, []string{"Тверская", "Сухонская"}, 0},
+		{"within radius", "lat=55.76&lng=37.61&radius=1000", http.StatusOK, []string{"Тверская"}, 0},
+		{"default k", "lat=55.76&lng=37.61", http.StatusOK, []string{"Тверская", "Сухонская", "Пулково"}, 0},
+		{"by address", "address=Москва&k=1", http.StatusOK, []string{"Тверская"}, 1},
+		{"no origin", "k=1", http.StatusBadRequest, nil, 0},
+		{"bad k", "lat=55.76&lng=37.61&k=0", http.StatusBadRequest, nil, 0},
+		{"bad radius", "lat=55.76&lng=37.61&radius=-5", http.StatusBadRequest, nil, 0},
+		{"lat out of range", "lat=95&lng=37.61", http.StatusBadRequest, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			geocoded = 0
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/poi/nearest?"+tt.query, nil)
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app.setupRouter().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status code %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if geocoded != tt.geocodes {
+				t.Errorf("expected %d provider calls, got %d", tt.geocodes, geocoded)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp NearestPOIResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			prev := -1.0
+			for _, p := range resp.POIs {
+				names = append(names, p.Name)
+				if p.Distance < prev {
+					t.Errorf("results not sorted by distance: %s", w.Body.String())
+				}
+				prev = p.Distance
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("expected %v, got %v", tt.wantNames, names)
+			}
+		})
+	}
+
+	// the index survives a restart
+	restarted := &application{pois: app.pois, logger: app.logger}
+	if err := restarted.rebuildPOIs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(restarted.poiIndex.Load().pois); got != 3 {
+		t.Errorf("expected 3 points after rebuild, got %d", got)
+	}
+}
+
+// slowPOIs holds the first List until release is closed, so a rebuild can be
+// overtaken by an upload.
+type slowPOIs struct {
+	models.POIModelInterface
+	calls   atomic.Int32
+	listed  chan struct{}
+	release chan struct{}
+}
+
+func (s *slowPOIs) List() ([]*models.POI, error) {
+	pois, err := s.POIModelInterface.List()
+	if s.calls.Add(1) == 1 {
+		close(s.listed)
+		<-s.release
+	}
+	return pois, err
+}
+
+func TestRebuildPOIs_concurrent(t *testing.T) {
+	store := &slowPOIs{
+		POIModelInterface: &models.POIModel{DB: inmemory_DB()},
+		listed:            make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	app := &application{logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), pois: store}
+
+	done := make(chan error)
+	go func() { done <- app.rebuildPOIs() }()
+	<-store.listed
+
+	// the rebuild listed no points, the upload must win
+	uploaded := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		app.UploadPOIHandler(w, httptest.NewRequest(http.MethodPost, "/api/v1/poi", strings.NewReader(poiCSV)))
+		uploaded <- w.Code
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if code := <-uploaded; code != http.StatusOK {
+		t.Fatalf("upload: %d", code)
+	}
+
+	if got := len(app.poiIndex.Load().pois); got != 3 {
+		t.Errorf("stale index: expected 3 points, got %d", got)
+	}
+}
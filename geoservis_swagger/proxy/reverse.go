@@ -1,23 +1,444 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// RouteConfig maps requests matching Host and Prefix to a pool of upstreams.
+type RouteConfig struct {
+	// matched case-insensitively without the port; empty matches any host
+	Host string `json:"host"`
+	// matched on path segment boundaries; empty means "/"
+	Prefix string `json:"prefix"`
+	// base URLs such as http://hugo_task:1313
+	Upstreams []string `json:"upstreams"`
+	// round_robin (default), least_conn or consistent_hash
+	Strategy string `json:"strategy"`
+	// what consistent_hash keys on: ip (default), path or a header name
+	HashKey string `json:"hash_key"`
+	// probes upstreams and takes failing ones out of rotation
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+	// ejects upstreams that fail requests in a row
+	Outlier *OutlierConfig `json:"outlier"`
+	// served by this application instead of an upstream
+	Local bool `json:"local"`
+	// directory of a built Hugo site served instead of an upstream, or
+	// "embed" for the site compiled into the binary
+	Static string `json:"static"`
+	// file of the static site served for missing paths without an
+	// extension, e.g. /index.html for a single-page application
+	Fallback string `json:"fallback"`
+	// removes Prefix from the path before forwarding
+	StripPrefix bool `json:"strip_prefix"`
+	// replaces Prefix in the path before forwarding
+	Rewrite string `json:"rewrite"`
+	// set on the forwarded request; an empty value removes the header
+	Headers map[string]string `json:"headers"`
+	// set on the response; an empty value removes the header
+	ResponseHeaders map[string]string `json:"response_headers"`
+	// forwards the client's Host instead of the upstream's
+	PreserveHost bool `json:"preserve_host"`
+	// bypasses the response cache
+	NoCache bool `json:"no_cache"`
+}
+
+// ProxyConfig is the routing table of the reverse proxy. Requests that match
+// no route are served by the application.
+type ProxyConfig struct {
+	Routes []RouteConfig `json:"routes"`
+	// addresses or CIDR prefixes of proxies in front of this one whose
+	// X-Forwarded-* and Forwarded headers are kept
+	TrustedProxies []string `json:"trusted_proxies"`
+	// caches proxied responses when set
+	Cache *CacheConfig `json:"cache"`
+}
+
+// DefaultProxyConfig serves /api and /swagger locally and proxies everything
+// else to host:port through the cache.
+func DefaultProxyConfig(host, port string) *ProxyConfig {
+	return &ProxyConfig{
+		Routes: []RouteConfig{
+			{Prefix: "/api", Local: true},
+			{Prefix: "/swagger", Local: true},
+			{Prefix: "/", Upstreams: []string{fmt.Sprintf("http://%s:%s", host, port)}},
+		},
+		Cache: &CacheConfig{},
+	}
+}
+
+// LoadProxyConfig reads a routing table from a JSON file.
+func LoadProxyConfig(path string) (*ProxyConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg ProxyConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// route is a validated RouteConfig.
+type route struct {
+	host      string
+	prefix    string
+	local     bool
+	static    *staticSite
+	rewrite   string
+	strip     bool
+	upstreams []*upstream
+	strategy  string
+	hashKey   string
+	ring      []ringPoint
+	next      uint64
+	health    *HealthCheckConfig
+	outlier   *OutlierConfig
+	headers   map[string]string
+	response  map[string]string
+	// keeps the client's Host header
+	preserveHost bool
+	noCache      bool
+}
+
+// routeTable is an immutable snapshot of the routing table. Requests keep the
+// snapshot they started with, so a reload never disturbs them.
+type routeTable struct {
+	// host-specific routes first, then longer prefixes first
+	routes []*route
+	// stops the health checks of this table
+	stop context.CancelFunc
+	// peers whose forwarding headers are kept
+	trusted []netip.Prefix
+	// shared with the previous table, nil when caching is off
+	cache *responseCache
+}
+
+func (cfg *ProxyConfig) compile() (*routeTable, error) {
+	trusted, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	t := &routeTable{trusted: trusted}
+	for i, rc := range cfg.Routes {
+		rt := &route{
+			host:     strings.ToLower(rc.Host),
+			prefix:   rc.Prefix,
+			local:    rc.Local,
+			rewrite:  rc.Rewrite,
+			strip:    rc.StripPrefix || rc.Rewrite != "",
+			strategy: rc.Strategy,
+			hashKey:  rc.HashKey,
+			headers:  rc.Headers,
+			response: rc.ResponseHeaders,
+
+			preserveHost: rc.PreserveHost,
+			noCache:      rc.NoCache,
+		}
+		if rt.prefix == "" {
+			rt.prefix = "/"
+		}
+		if !strings.HasPrefix(rt.prefix, "/") {
+			return nil, fmt.Errorf("route %d: prefix must start with /", i)
+		}
+		if rt.rewrite != "" && !strings.HasPrefix(rt.rewrite, "/") {
+			return nil, fmt.Errorf("route %d: rewrite must start with /", i)
+		}
+		kinds := 0
+		for _, set := range []bool{rt.local, len(rc.Upstreams) > 0, rc.Static != ""} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("route %d: set one of local, upstreams or static", i)
+		}
+		if rc.Static != "" {
+			rt.static, err = openStaticSite(rc.Static, rc.Fallback)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			if rc.Fallback != "" {
+				name, ok := staticName(rc.Fallback)
+				if !strings.HasPrefix(rc.Fallback, "/") || !ok {
+					return nil, fmt.Errorf("route %d: invalid fallback %q", i, rc.Fallback)
+				}
+				if _, err := fs.Stat(rt.static.fsys, name); err != nil {
+					return nil, fmt.Errorf("route %d: fallback: %w", i, err)
+				}
+			}
+		} else if rc.Fallback != "" {
+			return nil, fmt.Errorf("route %d: fallback needs static", i)
+		}
+		for _, u := range rc.Upstreams {
+			uri, err := url.Parse(u)
+			if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+				return nil, fmt.Errorf("route %d: invalid upstream %q", i, u)
+			}
+			rt.upstreams = append(rt.upstreams, newUpstream(uri))
+		}
+
+		switch rt.strategy {
+		case "":
+			rt.strategy = strategyRoundRobin
+		case strategyRoundRobin, strategyLeastConn:
+		case strategyConsistentHash:
+			rt.ring = buildRing(rt.upstreams)
+		default:
+			return nil, fmt.Errorf("route %d: unknown strategy %q", i, rt.strategy)
+		}
+		if hc := rc.HealthCheck; hc != nil && len(rt.upstreams) > 0 {
+			if !strings.HasPrefix(hc.Path, "/") {
+				return nil, fmt.Errorf("route %d: health check path must start with /", i)
+			}
+			if hc.Interval < 0 || hc.Timeout < 0 {
+				return nil, fmt.Errorf("route %d: negative health check duration", i)
+			}
+			rt.health = &HealthCheckConfig{Path: hc.Path, ExpectedStatus: hc.ExpectedStatus, Interval: hc.Interval, Timeout: hc.Timeout}
+			if rt.health.ExpectedStatus == 0 {
+				rt.health.ExpectedStatus = http.StatusOK
+			}
+			if rt.health.Interval == 0 {
+				rt.health.Interval = Duration(defaultHealthInterval)
+			}
+			if rt.health.Timeout == 0 {
+				rt.health.Timeout = Duration(defaultHealthTimeout)
+			}
+		}
+		if o := rc.Outlier; o != nil && len(rt.upstreams) > 0 {
+			if o.MaxFails < 0 || o.EjectFor < 0 {
+				return nil, fmt.Errorf("route %d: negative outlier setting", i)
+			}
+			rt.outlier = &OutlierConfig{MaxFails: o.MaxFails, EjectFor: o.EjectFor}
+			if rt.outlier.MaxFails == 0 {
+				rt.outlier.MaxFails = defaultMaxFails
+			}
+			if rt.outlier.EjectFor == 0 {
+				rt.outlier.EjectFor = Duration(defaultEjectFor)
+			}
+		}
+		t.routes = append(t.routes, rt)
+	}
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		a, b := t.routes[i], t.routes[j]
+		if (a.host != "") != (b.host != "") {
+			return a.host != ""
+		}
+		return len(a.prefix) > len(b.prefix)
+	})
+	return t, nil
+}
+
+// matchPrefix reports whether path is prefix or lies below it, so /api
+// matches /api/v1 but not /apis.
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (t *routeTable) match(r *http.Request) *route {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, rt := range t.routes {
+		if (rt.host == "" || rt.host == host) && matchPrefix(r.URL.Path, rt.prefix) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// forwardPath applies prefix stripping or rewriting to path.
+func (rt *route) forwardPath(path string) string {
+	if !rt.strip {
+		return path
+	}
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(rt.prefix, "/"))
+	if rt.rewrite != "" {
+		rest = strings.TrimSuffix(rt.rewrite, "/") + rest
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+func setHeaders(h http.Header, values map[string]string) {
+	for k, v := range values {
+		if v == "" {
+			h.Del(k)
+		} else {
+			h.Set(k, v)
+		}
+	}
+}
+
 type ReverseProxy struct {
-	host string
-	port string
+	table atomic.Pointer[routeTable]
+	// the file Reload reads, if any
+	path string
+
+	logger    *slog.Logger
+	transport *http.Transport
+	// shared by every route; the target travels in the request context
+	proxy *httputil.ReverseProxy
+}
+
+func newReverseProxy(path string) *ReverseProxy {
+	rp := &ReverseProxy{path: path, logger: slog.Default(), transport: newProxyTransport()}
+	rp.proxy = &httputil.ReverseProxy{
+		Director:       rp.director,
+		Transport:      rp.transport,
+		ModifyResponse: rp.modifyResponse,
+		ErrorHandler:   rp.errorHandler,
+		ErrorLog:       slog.NewLogLogger(rp.logger.Handler(), slog.LevelError),
+		// event streams and chunked bodies are flushed on every write anyway;
+		// this bounds how long the rest may sit in buffers
+		FlushInterval: proxyFlushInterval,
+	}
+	return rp
 }
 
 func NewReverseProxy(host, port string) *ReverseProxy {
-	return &ReverseProxy{
-		host: host,
-		port: port,
+	rp := newReverseProxy("")
+	// the default table is always valid
+	_ = rp.Load(DefaultProxyConfig(host, port))
+	return rp
+}
+
+// NewReverseProxyFromFile builds a proxy from a routing table file that
+// Reload reads again.
+func NewReverseProxyFromFile(path string) (*ReverseProxy, error) {
+	rp := newReverseProxy(path)
+	err := rp.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// Load validates cfg and swaps it in, starting its health checks and stopping
+// those of the previous table. An invalid table leaves the current one in
+// place.
+func (rp *ReverseProxy) Load(cfg *ProxyConfig) error {
+	t, err := cfg.compile()
+	if err != nil {
+		return err
 	}
+	// the cache and the upstream state outlive reloads, only the cache
+	// limits change
+	prev := rp.table.Load()
+	if prev != nil {
+		t.keepUpstreams(prev)
+	}
+	if cfg.Cache != nil {
+		if prev != nil && prev.cache != nil {
+			t.cache = prev.cache
+			t.cache.setLimits(cfg.Cache)
+		} else {
+			t.cache = newResponseCache(cfg.Cache)
+		}
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	t.stop = stop
+	for _, rt := range t.routes {
+		if rt.health != nil {
+			go rt.healthCheck(ctx, rp.transport)
+		}
+	}
+	if old := rp.table.Swap(t); old != nil {
+		old.stop()
+	}
+	return nil
+}
+
+// Close stops the health checks and closes idle upstream connections.
+func (rp *ReverseProxy) Close() {
+	if t := rp.table.Load(); t != nil {
+		t.stop()
+	}
+	rp.transport.CloseIdleConnections()
+}
+
+// SetLogger sends proxy logs to l.
+func (rp *ReverseProxy) SetLogger(l *slog.Logger) {
+	rp.logger = l
+	rp.proxy.ErrorLog = slog.NewLogLogger(l.Handler(), slog.LevelError)
+}
+
+// Reload reads the routing table file again.
+func (rp *ReverseProxy) Reload() error {
+	if rp.path == "" {
+		return errors.New("routing table was not loaded from a file")
+	}
+	cfg, err := LoadProxyConfig(rp.path)
+	if err != nil {
+		return err
+	}
+	return rp.Load(cfg)
+}
+
+// proxyFlushInterval is how often proxied bodies of known length are flushed
+// to the client.
+const proxyFlushInterval = 100 * time.Millisecond
+
+// newProxyTransport is the transport shared by all upstreams. Upstreams are
+// few and busy, so many idle connections are kept per host.
+func newProxyTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// proxyTarget is where a request is being proxied to.
+type proxyTarget struct {
+	route    *route
+	upstream *upstream
+	// whether the client's forwarding headers are kept
+	trusted bool
+}
+
+type proxyTargetKey struct{}
+
+func targetOf(r *http.Request) *proxyTarget {
+	return r.Context().Value(proxyTargetKey{}).(*proxyTarget)
 }
 
 // hugo:1313/static -> hugo
@@ -25,32 +446,113 @@ func NewReverseProxy(host, port string) *ReverseProxy {
 
 func (rp *ReverseProxy) ReverseProxy(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/api") {
+		table := rp.table.Load()
+		rt := table.match(r)
+		if rt == nil || rt.local {
 			next.ServeHTTP(w, r)
 			return
 		}
-		if strings.HasPrefix(r.URL.Path, "/swagger") {
-			next.ServeHTTP(w, r)
+		if rt.static != nil {
+			setHeaders(w.Header(), rt.response)
+			rt.static.serve(w, r, rt.forwardPath(r.URL.Path))
 			return
 		}
-		link := fmt.Sprintf("http://%s:%s", rp.host, rp.port)
-		uri, _ := url.Parse(link)
-
-		if uri.Host == r.Host {
-			next.ServeHTTP(w, r)
-			return
+		if table.cache != nil && !rt.noCache {
+			if cacheable(r) {
+				rp.serveCached(w, r, table, rt, next)
+				return
+			}
+			w.Header().Set("X-Cache", "BYPASS")
 		}
-		r.Header.Set("Reverse-Proxy", "true")
+		rp.forward(w, r, table, rt, next)
+	})
+}
 
-		//proxy := httputil.NewSingleHostReverseProxy(uri)
+// forward sends r to an upstream of rt.
+func (rp *ReverseProxy) forward(w http.ResponseWriter, r *http.Request, table *routeTable, rt *route, next http.Handler) {
+	up := rt.pick(r)
 
-		proxy := httputil.ReverseProxy{Director: func(r *http.Request) {
-			r.URL.Scheme = uri.Scheme
-			r.URL.Host = uri.Host
-			r.URL.Path = uri.Path + r.URL.Path
-			r.Host = uri.Host
-			fmt.Println("CONNECTING....", r.URL)
-		}}
-		proxy.ServeHTTP(w, r)
-	})
+	if up.url.Host == r.Host {
+		next.ServeHTTP(w, r)
+		return
+	}
+	up.active.Add(1)
+	defer up.active.Add(-1)
+
+	target := &proxyTarget{route: rt, upstream: up, trusted: table.trusts(r)}
+	ctx := context.WithValue(r.Context(), proxyTargetKey{}, target)
+	rp.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (rp *ReverseProxy) director(r *http.Request) {
+	t := targetOf(r)
+	uri := t.upstream.url
+	setForwardingHeaders(r, t.trusted)
+	r.URL.Scheme = uri.Scheme
+	r.URL.Host = uri.Host
+	r.URL.Path = strings.TrimSuffix(uri.Path, "/") + t.route.forwardPath(r.URL.Path)
+	if !t.route.preserveHost {
+		r.Host = uri.Host
+	}
+	setHeaders(r.Header, t.route.headers)
+}
+
+func (rp *ReverseProxy) modifyResponse(resp *http.Response) error {
+	t := targetOf(resp.Request)
+	t.route.done(t.upstream, resp.StatusCode >= http.StatusInternalServerError)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	setHeaders(resp.Header, t.route.response)
+	return nil
+}
+
+// proxyErrors counts failed proxied requests by outcome.
+var proxyErrors = expvar.NewMap("proxy_errors")
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Text}} · Geo API</title>
+<style>
+body { font-family: sans-serif; color: #333; max-width: 40em; margin: 15vh auto; padding: 0 1em; }
+h1 { font-size: 3em; margin: 0; color: #0d6efd; }
+</style>
+</head>
+<body>
+<h1>{{.Status}}</h1>
+<p>{{.Message}}</p>
+<p><a href="/">Geo API</a></p>
+</body>
+</html>
+`))
+
+// errorHandler answers a failed upstream request with a 504 when the
+// upstream timed out and a 502 otherwise.
+func (rp *ReverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	t := targetOf(r)
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		// the client went away, nobody is left to answer
+		proxyErrors.Add("canceled", 1)
+		rp.logger.Debug("proxy request canceled", "upstream", t.upstream.url.String(), "path", r.URL.Path)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	t.route.done(t.upstream, true)
+
+	status, message := http.StatusBadGateway, "Сервис временно недоступен. Попробуйте обновить страницу через минуту."
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status, message = http.StatusGatewayTimeout, "Сервис не ответил вовремя. Попробуйте обновить страницу через минуту."
+	}
+	proxyErrors.Add(strconv.Itoa(status), 1)
+	rp.logger.Error("proxy error", "upstream", t.upstream.url.String(), "path", r.URL.Path,
+		"status", status, "error", err.Error())
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	errorPage.Execute(w, struct {
+		Status        int
+		Text, Message string
+	}{status, http.StatusText(status), message})
 }
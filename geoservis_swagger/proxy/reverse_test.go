@@ -0,0 +1,330 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// echoUpstream replies with its name, the request path and the X-Site header.
+func echoUpstream(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", name)
+		w.Header().Set("Server", "upstream")
+		fmt.Fprintf(w, "%s %s %s", name, r.URL.Path, r.Header.Get("X-Site"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func proxyRouter(rp *ReverseProxy) http.Handler {
+	r := chi.NewRouter()
+	r.Use(rp.ReverseProxy)
+	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local " + r.URL.Path))
+	})
+	return r
+}
+
+func get(h http.Handler, target string) string {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w.Body.String()
+}
+
+func TestReverseProxy_routes(t *testing.T) {
+	hugo := echoUpstream(t, "hugo")
+	docs := echoUpstream(t, "docs")
+	a, b := echoUpstream(t, "a"), echoUpstream(t, "b")
+
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{Routes: []RouteConfig{
+		{Prefix: "/", Upstreams: []string{hugo.URL}},
+		{Prefix: "/api", Local: true},
+		{Prefix: "/docs", Upstreams: []string{docs.URL}, Rewrite: "/content"},
+		{Prefix: "/raw/", Upstreams: []string{docs.URL}, StripPrefix: true},
+		{Host: "Static.example.com", Upstreams: []string{a.URL, b.URL},
+			Headers: map[string]string{"X-Site": "static"}, ResponseHeaders: map[string]string{"Server": ""}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxyRouter(rp)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://localhost:8080/api/v1/zones", "local /api/v1/zones"},
+		{"http://localhost:8080/apis", "hugo /apis "},
+		{"http://localhost:8080/address/search/", "hugo /address/search/ "},
+		{"http://localhost:8080/docs", "docs /content "},
+		{"http://localhost:8080/docs/address/", "docs /content/address/ "},
+		{"http://localhost:8080/raw/a.txt", "docs /a.txt "},
+		{"http://static.example.com:8080/api/v1", "a /api/v1 static"},
+		{"http://static.example.com/x", "b /x static"},
+		{"http://static.example.com/y", "a /y static"},
+	}
+	for _, tt := range tests {
+		if got := get(h, tt.target); got != tt.want {
+			t.Errorf("GET %s: got %q, want %q", tt.target, got, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://static.example.com/", nil))
+	if w.Header().Get("Server") != "" || w.Header().Get("X-Upstream") == "" {
+		t.Errorf("response headers not applied: %v", w.Header())
+	}
+}
+
+func TestReverseProxy_loop(t *testing.T) {
+	upstream := echoUpstream(t, "hugo")
+	u, _ := url.Parse(upstream.URL)
+	rp := NewReverseProxy(u.Hostname(), u.Port())
+	h := proxyRouter(rp)
+
+	if got := get(h, "http://localhost/posts/"); got != "hugo /posts/ " {
+		t.Errorf("got %q", got)
+	}
+	// a request already addressed to the upstream is not proxied to itself
+	if got := get(h, upstream.URL+"/posts/"); got != "local /posts/" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestReverseProxy_reload(t *testing.T) {
+	old, cur := echoUpstream(t, "old"), echoUpstream(t, "new")
+	path := filepath.Join(t.TempDir(), "routes.json")
+	write := func(upstream string) {
+		cfg := fmt.Sprintf(`{"routes": [{"prefix": "/", "upstreams": [%q]}]}`, upstream)
+		if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(old.URL)
+	rp, err := NewReverseProxyFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxyRouter(rp)
+	if got := get(h, "http://localhost/"); !strings.HasPrefix(got, "old") {
+		t.Fatalf("got %q", got)
+	}
+
+	write(cur.URL)
+	if err := rp.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(h, "http://localhost/"); !strings.HasPrefix(got, "new") {
+		t.Errorf("reload not applied, got %q", got)
+	}
+
+	// a broken file keeps the current table
+	os.WriteFile(path, []byte(`{"routes": [{"prefix": "/"}]}`), 0o600)
+	if err := rp.Reload(); err == nil {
+		t.Error("expected an error for a route without upstreams")
+	}
+	if got := get(h, "http://localhost/"); !strings.HasPrefix(got, "new") {
+		t.Errorf("invalid table was applied, got %q", got)
+	}
+
+	if err := NewReverseProxy("hugo_task", "1313").Reload(); err == nil {
+		t.Error("expected an error reloading a table without a file")
+	}
+}
+
+func TestLoadProxyConfig(t *testing.T) {
+	cfg, err := LoadProxyConfig("testdata/routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Routes) != 5 || cfg.Routes[3].Headers["X-Site"] != "static" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if _, err := cfg.compile(); err != nil {
+		t.Error(err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	os.WriteFile(bad, []byte(`{"routes": [{"path": "/"}]}`), 0o600)
+	if _, err := LoadProxyConfig(bad); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestProxyConfig_compile(t *testing.T) {
+	tests := []struct {
+		name  string
+		route RouteConfig
+	}{
+		{"no target", RouteConfig{Prefix: "/"}},
+		{"local and upstreams", RouteConfig{Local: true, Upstreams: []string{"http://hugo:1313"}}},
+		{"relative prefix", RouteConfig{Prefix: "docs", Local: true}},
+		{"relative rewrite", RouteConfig{Local: true, Rewrite: "docs"}},
+		{"bad scheme", RouteConfig{Upstreams: []string{"ftp://hugo"}}},
+		{"no host", RouteConfig{Upstreams: []string{"hugo:1313"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := (&ProxyConfig{Routes: []RouteConfig{tt.route}}).compile()
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRoute_forwardPath(t *testing.T) {
+	tests := []struct {
+		prefix, rewrite string
+		strip           bool
+		path, want      string
+	}{
+		{"/docs", "", false, "/docs/a", "/docs/a"},
+		{"/docs", "", true, "/docs/a", "/a"},
+		{"/docs", "", true, "/docs", "/"},
+		{"/docs/", "", true, "/docs/a", "/a"},
+		{"/docs", "/content/", true, "/docs/a", "/content/a"},
+		{"/", "/site", true, "/a", "/site/a"},
+	}
+	for _, tt := range tests {
+		rt := &route{prefix: tt.prefix, rewrite: tt.rewrite, strip: tt.strip}
+		if got := rt.forwardPath(tt.path); got != tt.want {
+			t.Errorf("%+v: got %q", tt, got)
+		}
+	}
+}
+
+func TestReverseProxy_errors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{Routes: []RouteConfig{
+		{Prefix: "/closed", Upstreams: []string{closed.URL}},
+		{Prefix: "/slow", Upstreams: []string{slow.URL}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.transport.ResponseHeaderTimeout = 50 * time.Millisecond
+	h := proxyRouter(rp)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/closed", http.StatusBadGateway},
+		{"/slow", http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		counter := func() int64 {
+			if v, ok := proxyErrors.Get(fmt.Sprint(tt.status)).(*expvar.Int); ok {
+				return v.Value()
+			}
+			return 0
+		}
+		before := counter()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost"+tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+			!strings.Contains(w.Body.String(), "Geo API") || !strings.Contains(w.Body.String(), fmt.Sprint(tt.status)) {
+			t.Errorf("%s: expected the error page, got %q", tt.path, w.Body.String())
+		}
+		if counter() != before+1 {
+			t.Errorf("%s: failure was not counted", tt.path)
+		}
+	}
+}
+
+// perRequestProxy is how requests used to be proxied: a parsed target, a new
+// ReverseProxy on the default transport and a line on stdout per request.
+func perRequestProxy(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri, _ := url.Parse(target)
+		r.Header.Set("Reverse-Proxy", "true")
+		proxy := httputil.ReverseProxy{Director: func(r *http.Request) {
+			r.URL.Scheme = uri.Scheme
+			r.URL.Host = uri.Host
+			r.URL.Path = uri.Path + r.URL.Path
+			r.Host = uri.Host
+			fmt.Println("CONNECTING....", r.URL)
+		}}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+func BenchmarkReverseProxy(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>hugo</html>"))
+	}))
+	defer upstream.Close()
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	rp := newReverseProxy("")
+	rp.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := rp.Load(&ProxyConfig{Routes: []RouteConfig{{Upstreams: []string{upstream.URL}}}}); err != nil {
+		b.Fatal(err)
+	}
+	defer rp.Close()
+
+	handlers := []struct {
+		name string
+		h    http.Handler
+	}{
+		{"per_request", perRequestProxy(upstream.URL)},
+		{"shared", rp.ReverseProxy(http.NotFoundHandler())},
+	}
+	for _, bb := range handlers {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			// concurrent requests are what exhaust a small idle pool
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w := httptest.NewRecorder()
+					bb.h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/posts/", nil))
+					if w.Code != http.StatusOK {
+						b.Errorf("got %d", w.Code)
+						return
+					}
+				}
+			})
+		})
+	}
+}
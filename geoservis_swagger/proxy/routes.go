@@ -1,7 +1,12 @@
 package main
 
 import (
+	"expvar"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"test/swagger"
 
@@ -15,41 +20,34 @@ import (
 func (app *application) setupRouter() *chi.Mux {
 	r := chi.NewRouter()
 
-	proxy := ReverseProxy{
-		host: "hugo_task",
-		port: "1313",
+	if app.proxy == nil {
+		host, port, _ := net.SplitHostPort(DefaultConfig().Proxy.Upstream)
+		app.proxy = NewReverseProxy(host, port)
 	}
-	r.Use(proxy.ReverseProxy)
-
+	if app.logger != nil {
+		app.proxy.SetLogger(app.logger)
+	}
+	r.Use(compress)
+	r.Use(app.proxy.ReverseProxy)
+
+	r.Route("/api/v1", app.v1Routes)
+	r.Route("/api/v2", app.v2Routes)
+	// unversioned paths are kept as deprecated aliases of v1
+	r.Route("/api", func(r chi.Router) {
+		r.Use(deprecated("/api/v1"))
+		app.v1Routes(r)
+	})
+	// memory stats, the command line and internal upstream addresses are for
+	// admins only
 	r.Group(func(r chi.Router) {
+		r.Use(verifyToken)
+		r.Use(requireToken)
+		r.Use(app.requireAdmin)
 
-		r.Use(jwtauth.Verifier(tokenAuth))
-		r.Use(func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				token, _, err := jwtauth.FromContext(r.Context())
-
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusForbidden)
-					return
-				}
-				if token == nil || jwt.Validate(token) != nil {
-					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-					return
-				}
-
-				next.ServeHTTP(w, r)
-			})
-		})
-		//r.Use(Authenticator(tokenAuth))
-
-		r.Post("/api/address/search", app.SearchHandler)
-		r.Post("/api/address/geocode", app.GeocodeHandler)
-
+		r.Get("/api/debug/vars", expvar.Handler().ServeHTTP)
+		r.Get("/api/debug/upstreams", app.UpstreamStatusHandler)
 	})
 
-	r.Post("/api/login", app.Login)
-	r.Post("/api/register", app.Register)
-
 	fileServer := http.FileServerFS(swagger.Swaggerfile)
 	r.Get("/swagger/*", func(w http.ResponseWriter, r *http.Request) {
 		fs := http.StripPrefix("/swagger", fileServer)
@@ -69,3 +67,109 @@ func (app *application) setupRouter() *chi.Mux {
 
 	return r
 }
+
+func (app *application) v1Routes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(verifyToken)
+		r.Use(requireToken)
+
+		r.Post("/address/search", app.SearchHandler)
+		r.Post("/address/geocode", app.GeocodeHandler)
+		r.Post("/address/clean", app.CleanHandler)
+		r.Get("/address/autocomplete", app.AutocompleteHandler)
+		r.Post("/address/search/batch", app.SearchBatchHandler)
+		r.Post("/address/geocode/batch", app.GeocodeBatchHandler)
+
+		r.Post("/geo/distance", app.DistanceHandler)
+		r.Post("/geo/matrix", app.MatrixHandler)
+
+		r.Post("/poi", app.UploadPOIHandler)
+		r.Get("/poi/nearest", app.NearestPOIHandler)
+
+		r.Post("/zones", app.CreateZoneHandler)
+		r.Get("/zones", app.ListZonesHandler)
+		r.Get("/zones/{id}", app.GetZoneHandler)
+		r.Put("/zones/{id}", app.UpdateZoneHandler)
+		r.Delete("/zones/{id}", app.DeleteZoneHandler)
+
+		r.With(app.requireAdmin).Post("/cache/purge", app.PurgeCacheHandler)
+
+		r.Post("/jobs", app.CreateJobHandler)
+		r.Get("/jobs/{id}", app.GetJobHandler)
+		r.Delete("/jobs/{id}", app.CancelJobHandler)
+		r.Get("/jobs/{id}/result", app.JobResultHandler)
+	})
+
+	r.Post("/login", app.Login)
+	r.Post("/register", app.Register)
+}
+
+func (app *application) v2Routes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(verifyToken)
+		r.Use(requireToken)
+
+		r.Post("/address/search", app.SearchV2Handler)
+		r.Post("/address/geocode", app.GeocodeV2Handler)
+	})
+}
+
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, err := jwtauth.FromContext(r.Context())
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if token == nil || jwt.Validate(token) != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenUser returns the user name in the verified token of r, empty if there
+// is none.
+func tokenUser(r *http.Request) string {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	name, _ := claims["username"].(string)
+	return name
+}
+
+// requireAdmin lets through users listed in app.admins. It runs after
+// requireToken.
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := tokenUser(r)
+		if name == "" || !app.admins[name] {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Unversioned /api paths were deprecated on unversionedDeprecatedAt and stop
+// being served after unversionedSunset.
+var (
+	unversionedDeprecatedAt = time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+	unversionedSunset       = time.Date(2027, time.May, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// deprecated marks responses of a deprecated alias with the Deprecation
+// (RFC 9745) and Sunset (RFC 8594) headers and links the successor path
+// under prefix.
+func deprecated(prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			successor := prefix + strings.TrimPrefix(r.URL.Path, "/api")
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", unversionedDeprecatedAt.Unix()))
+			w.Header().Set("Sunset", unversionedSunset.Format(http.TimeFormat))
+			w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
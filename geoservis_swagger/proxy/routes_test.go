@@ -29,7 +29,7 @@ func TestRoutes(t *testing.T) {
 			w := httptest.NewRecorder()
 			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 			app := &application{
-				geo:    NewGeoService("fc47d9338dbcf9a2199f193ec2e5e57857e37378", "954baf5559aa44c49bde9a4dc572801bf48b69e9"),
+				geo:    NewGeoService(""),
 				logger: logger,
 			}
 			r := app.setupRouter()
@@ -41,3 +41,90 @@ func TestRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionedRoutes(t *testing.T) {
+	app := &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+				return []*Address{{City: "Москва", Lat: "55.87", Lon: "37.65"}}, nil
+			},
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		deprecated bool
+		successor  string
+	}{
+		{"v1", "/api/v1/address/search", false, ""},
+		{"v2", "/api/v2/address/search", false, ""},
+		{"unversioned alias", "/api/address/search", true, "</api/v1/address/search>; rel=\"successor-version\""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader([]byte(`{"query": "Москва"}`)))
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app.setupRouter().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+			}
+			if got := w.Header().Get("Deprecation") != ""; got != tt.deprecated {
+				t.Errorf("Deprecation header present = %v, want %v", got, tt.deprecated)
+			}
+			if tt.deprecated {
+				if w.Header().Get("Sunset") != unversionedSunset.Format(http.TimeFormat) {
+					t.Errorf("wrong Sunset header %q", w.Header().Get("Sunset"))
+				}
+				if w.Header().Get("Link") != tt.successor {
+					t.Errorf("wrong Link header %q", w.Header().Get("Link"))
+				}
+			}
+		})
+	}
+
+	for _, path := range []string{"/swagger/swagger.yaml", "/swagger/v2.yaml"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		app.setupRouter().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status code %d but got %d", path, http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestDebugRoutes_adminOnly(t *testing.T) {
+	app := &application{
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		admins: map[string]bool{"admin": true},
+	}
+	r := app.setupRouter()
+	tests := []struct {
+		name       string
+		user       string
+		statusCode int
+	}{
+		{"anonymous", "", http.StatusForbidden},
+		{"user", "test", http.StatusForbidden},
+		{"admin", "admin", http.StatusOK},
+	}
+	for _, path := range []string{"/api/debug/vars", "/api/debug/upstreams"} {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				if tt.user != "" {
+					req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken(tt.user)})
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				if w.Code != tt.statusCode {
+					t.Errorf("expected status code %d but got %d", tt.statusCode, w.Code)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// Names of the secrets the server reads from a SecretProvider.
+const (
+	secretJWT          = "jwt_secret"
+	secretDaDataAPIKey = "dadata_api_key"
+)
+
+// ErrSecretNotFound is returned by a SecretProvider that has no secret with
+// the requested name.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider looks up secrets by name. Every call reads the current
+// value, so a rotated secret is picked up on the next call.
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// EnvSecrets reads secrets from environment variables named after the
+// secret in upper case, e.g. JWT_SECRET for jwt_secret.
+type EnvSecrets struct {
+	// os.Getenv if nil
+	Getenv func(string) string
+}
+
+func (e EnvSecrets) Secret(ctx context.Context, name string) (string, error) {
+	getenv := e.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	v := getenv(strings.ToUpper(name))
+	if v == "" {
+		return "", fmt.Errorf("%s: %w", strings.ToUpper(name), ErrSecretNotFound)
+	}
+	return v, nil
+}
+
+// FileSecrets reads each secret from a file named after it in Dir, the way
+// Docker and Kubernetes mount secrets. Kubernetes swaps the files on update,
+// so every read sees either the old or the new value.
+type FileSecrets struct {
+	Dir string
+}
+
+func (f FileSecrets) Secret(ctx context.Context, name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	b, err := os.ReadFile(filepath.Join(f.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%s: %w", filepath.Join(f.Dir, name), ErrSecretNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	// editors and echo leave a trailing newline
+	v := strings.TrimRight(string(b), "\r\n")
+	if v == "" {
+		return "", fmt.Errorf("%s is empty", filepath.Join(f.Dir, name))
+	}
+	return v, nil
+}
+
+// VaultSecrets reads secrets from the fields of one secret in a HashiCorp
+// Vault KV version 2 engine.
+type VaultSecrets struct {
+	// e.g. https://vault:8200
+	Addr  string
+	Token string
+	// mount path of the KV engine, "secret" if empty
+	Mount string
+	// path of the secret within the engine
+	Path string
+	// http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (v *VaultSecrets) Secret(ctx context.Context, name string) (string, error) {
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	u := strings.TrimSuffix(v.Addr, "/") + "/v1/" + url.PathEscape(strings.Trim(mount, "/")) +
+		"/data/" + strings.Trim(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("vault %s/%s: %w", mount, v.Path, ErrSecretNotFound)
+	default:
+		// Vault errors carry no secrets, they help tell a bad token from a
+		// sealed server
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("vault %s/%s: %s: %s", mount, v.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("vault %s/%s: %w", mount, v.Path, err)
+	}
+	value, ok := body.Data.Data[name]
+	if !ok {
+		return "", fmt.Errorf("vault %s/%s: %s: %w", mount, v.Path, name, ErrSecretNotFound)
+	}
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("vault %s/%s: %s is not a non-empty string", mount, v.Path, name)
+	}
+	return s, nil
+}
+
+// appSecrets are the secrets the server needs.
+type appSecrets struct {
+	JWTSecret    string
+	DaDataAPIKey string
+}
+
+// fetchSecrets reads every secret the server needs from p.
+func fetchSecrets(ctx context.Context, p SecretProvider) (appSecrets, error) {
+	var s appSecrets
+	var errs []error
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{
+		{secretJWT, &s.JWTSecret},
+		{secretDaDataAPIKey, &s.DaDataAPIKey},
+	} {
+		v, err := p.Secret(ctx, f.name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		*f.dst = v
+	}
+	if s.JWTSecret != "" && len(s.JWTSecret) < 16 {
+		errs = append(errs, fmt.Errorf("%s must be at least 16 characters", secretJWT))
+	}
+	return s, errors.Join(errs...)
+}
+
+// changed lists the names of the secrets that differ between s and o.
+func (s appSecrets) changed(o appSecrets) []string {
+	var names []string
+	if s.JWTSecret != o.JWTSecret {
+		names = append(names, secretJWT)
+	}
+	if s.DaDataAPIKey != o.DaDataAPIKey {
+		names = append(names, secretDaDataAPIKey)
+	}
+	return names
+}
+
+// secretWatcher rereads the secrets periodically and applies the ones that
+// changed, so rotating them needs no restart.
+type secretWatcher struct {
+	provider SecretProvider
+	interval time.Duration
+	logger   *slog.Logger
+	current  appSecrets
+	apply    func(appSecrets)
+}
+
+// watch polls the provider until ctx is done. A failed read keeps the current
+// secrets, a rotation in progress may leave the provider briefly incomplete.
+func (sw *secretWatcher) watch(ctx context.Context) {
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sw.refresh(ctx)
+		}
+	}
+}
+
+func (sw *secretWatcher) refresh(ctx context.Context) {
+	s, err := fetchSecrets(ctx, sw.provider)
+	if err != nil {
+		sw.logger.Error("secrets not refreshed", "error", err.Error())
+		return
+	}
+	names := s.changed(sw.current)
+	if len(names) == 0 {
+		return
+	}
+	sw.apply(s)
+	sw.current = s
+	// only the names, never the values
+	sw.logger.Info("secrets rotated", "secrets", names)
+}
+
+// previousKeyGrace is how long tokens signed before a rotation keep working.
+// A rotated secret may have leaked, so it is much shorter than tokenLifetime:
+// sessions older than that sign in again.
+const previousKeyGrace = 24 * time.Hour
+
+// signingKeys verify session tokens: tokens are signed with current, and
+// those signed before the last rotation still verify with previous until
+// previousUntil.
+type signingKeys struct {
+	secret        string
+	current       *jwtauth.JWTAuth
+	previous      *jwtauth.JWTAuth
+	previousUntil time.Time
+}
+
+var tokenKeys atomic.Pointer[signingKeys]
+
+// init signs with a random key until main sets the configured secret, so no
+// token from outside the process verifies.
+func init() {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	tokenKeys.Store(&signingKeys{secret: string(key), current: jwtauth.New("HS256", key, nil)})
+}
+
+// setJWTSecret makes secret the signing key, keeping the one it replaces
+// for verification during previousKeyGrace.
+func setJWTSecret(secret string) {
+	old := tokenKeys.Load()
+	if old.secret == secret {
+		return
+	}
+	tokenKeys.Store(&signingKeys{
+		secret:        secret,
+		current:       jwtauth.New("HS256", []byte(secret), nil),
+		previous:      old.current,
+		previousUntil: time.Now().Add(previousKeyGrace),
+	})
+}
+
+// verifyToken is jwtauth.Verifier for rotating keys: it reads the signing
+// keys on every request and falls back to the previous one until its grace
+// period ends. Expired tokens fail with either key.
+func verifyToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := tokenKeys.Load()
+		token, err := jwtauth.VerifyRequest(keys.current, r, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie)
+		if err != nil && !errors.Is(err, jwtauth.ErrNoTokenFound) && keys.previous != nil && time.Now().Before(keys.previousUntil) {
+			if t, perr := jwtauth.VerifyRequest(keys.previous, r, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie); perr == nil {
+				token, err = t, nil
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), token, err)))
+	})
+}
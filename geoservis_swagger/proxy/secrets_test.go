@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// fakeVault serves one KV version 2 secret the way Vault does.
+type fakeVault struct {
+	mu    sync.Mutex
+	token string
+	path  string
+	data  map[string]any
+	reads int
+}
+
+func (v *fakeVault) set(name string, value any) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.data[name] = value
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.reads++
+	if r.Header.Get("X-Vault-Token") != v.token {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet || r.URL.Path != v.path {
+		http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		return
+	}
+	data, _ := json.Marshal(v.data)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"request_id":"1","lease_duration":0,"data":{"data":%s,"metadata":{"version":%d}}}`, data, v.reads)
+}
+
+func TestVaultSecrets(t *testing.T) {
+	fv := &fakeVault{token: "s.root", path: "/v1/kv/data/geo/prod", data: map[string]any{
+		secretJWT: "vault-jwt-secret-0123", "port": 8080,
+	}}
+	srv := httptest.NewServer(fv)
+	defer srv.Close()
+
+	v := &VaultSecrets{Addr: srv.URL + "/", Token: "s.root", Mount: "kv", Path: "/geo/prod"}
+	ctx := context.Background()
+	got, err := v.Secret(ctx, secretJWT)
+	if err != nil || got != "vault-jwt-secret-0123" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	fv.set(secretJWT, "rotated-jwt-secret-0123")
+	if got, _ := v.Secret(ctx, secretJWT); got != "rotated-jwt-secret-0123" {
+		t.Errorf("after rotation: got %q", got)
+	}
+
+	if _, err := v.Secret(ctx, secretDaDataAPIKey); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("missing field: got %v", err)
+	}
+	if _, err := v.Secret(ctx, "port"); err == nil || !strings.Contains(err.Error(), "not a non-empty string") {
+		t.Errorf("number field: got %v", err)
+	}
+	other := &VaultSecrets{Addr: srv.URL, Token: "s.root", Path: "geo/prod"}
+	if _, err := other.Secret(ctx, secretJWT); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("default mount: got %v", err)
+	}
+	bad := &VaultSecrets{Addr: srv.URL, Token: "s.wrong", Mount: "kv", Path: "geo/prod"}
+	_, err = bad.Secret(ctx, secretJWT)
+	if err == nil || !strings.Contains(err.Error(), "403") || strings.Contains(err.Error(), "s.wrong") {
+		t.Errorf("bad token: got %v", err)
+	}
+}
+
+func TestFileSecrets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, secretDaDataAPIKey), []byte("file-key\n"), 0o600)
+	os.WriteFile(filepath.Join(dir, secretJWT), []byte("\n"), 0o600)
+	f := FileSecrets{Dir: dir}
+	ctx := context.Background()
+
+	if got, err := f.Secret(ctx, secretDaDataAPIKey); err != nil || got != "file-key" {
+		t.Errorf("got %q %v", got, err)
+	}
+	os.WriteFile(filepath.Join(dir, secretDaDataAPIKey), []byte("rotated-key"), 0o600)
+	if got, _ := f.Secret(ctx, secretDaDataAPIKey); got != "rotated-key" {
+		t.Errorf("after rotation: got %q", got)
+	}
+	if _, err := f.Secret(ctx, "missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("missing file: got %v", err)
+	}
+	if _, err := f.Secret(ctx, secretJWT); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("empty file: got %v", err)
+	}
+	for _, name := range []string{"../passwd", ".hidden", ""} {
+		if _, err := f.Secret(ctx, name); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%q: got %v", name, err)
+		}
+	}
+}
+
+func TestEnvSecrets(t *testing.T) {
+	e := EnvSecrets{Getenv: envOf(map[string]string{"DADATA_API_KEY": "env-key"})}
+	if got, err := e.Secret(context.Background(), secretDaDataAPIKey); err != nil || got != "env-key" {
+		t.Errorf("got %q %v", got, err)
+	}
+	if _, err := e.Secret(context.Background(), secretJWT); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("unset: got %v", err)
+	}
+}
+
+func TestFetchSecrets(t *testing.T) {
+	e := EnvSecrets{Getenv: envOf(map[string]string{"JWT_SECRET": "short"})}
+	_, err := fetchSecrets(context.Background(), e)
+	if err == nil || !strings.Contains(err.Error(), "16 characters") || !strings.Contains(err.Error(), "DADATA_API_KEY") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestSecretWatcher rotates the secrets in a fake Vault and checks that the
+// geo client and the token verifier pick them up without a restart.
+func TestSecretWatcher(t *testing.T) {
+	saved := tokenKeys.Load()
+	t.Cleanup(func() { tokenKeys.Store(saved) })
+
+	fv := &fakeVault{token: "s.root", path: "/v1/secret/data/geoservis", data: map[string]any{
+		secretJWT:          "first-jwt-secret-0123",
+		secretDaDataAPIKey: "first-key",
+	}}
+	vault := httptest.NewServer(fv)
+	defer vault.Close()
+
+	var mu sync.Mutex
+	var auth string
+	dadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = r.Header.Get("Authorization")
+		mu.Unlock()
+		io.WriteString(w, `{"suggestions":[]}`)
+	}))
+	defer dadata.Close()
+	lastAuth := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return auth
+	}
+
+	provider := &VaultSecrets{Addr: vault.URL, Token: "s.root", Path: "geoservis"}
+	secrets, err := fetchSecrets(context.Background(), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setJWTSecret(secrets.JWTSecret)
+	geo := NewGeoService(secrets.DaDataAPIKey)
+	geo.endpoint = dadata.URL + "/"
+
+	var logs strings.Builder
+	sw := &secretWatcher{
+		provider: provider,
+		logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		current:  secrets,
+		apply: func(s appSecrets) {
+			setJWTSecret(s.JWTSecret)
+			geo.SetAPIKey(s.DaDataAPIKey)
+		},
+	}
+	protected := verifyToken(requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	status := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		protected.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	ctx := context.Background()
+	first := GenerateToken("test")
+	geo.suggest(ctx, "suggest/address", map[string]string{"query": "Москва"})
+	if got := lastAuth(); got != "Token first-key" {
+		t.Errorf("before rotation: %q", got)
+	}
+
+	// nothing changed
+	sw.refresh(ctx)
+	if logs.Len() != 0 {
+		t.Errorf("logged without a change: %s", logs.String())
+	}
+
+	fv.set(secretJWT, "second-jwt-secret-0123")
+	fv.set(secretDaDataAPIKey, "second-key")
+	sw.refresh(ctx)
+	geo.suggest(ctx, "suggest/address", map[string]string{"query": "Москва"})
+	if got := lastAuth(); got != "Token second-key" {
+		t.Errorf("after rotation: %q", got)
+	}
+	second := GenerateToken("test")
+	if status(first) != http.StatusOK || status(second) != http.StatusOK {
+		t.Errorf("tokens after the first rotation: %d %d", status(first), status(second))
+	}
+	out := logs.String()
+	if !strings.Contains(out, "secrets rotated") || !strings.Contains(out, secretJWT) || strings.Contains(out, "second-") {
+		t.Errorf("log: %s", out)
+	}
+
+	// a broken provider keeps the current secrets
+	fv.mu.Lock()
+	fv.token = "s.revoked"
+	fv.mu.Unlock()
+	sw.refresh(ctx)
+	if status(second) != http.StatusOK || !strings.Contains(logs.String(), "secrets not refreshed") {
+		t.Errorf("failed refresh changed the keys: %s", logs.String())
+	}
+	fv.mu.Lock()
+	fv.token = "s.root"
+	fv.mu.Unlock()
+
+	// only the previous key is kept
+	fv.set(secretJWT, "third-jwt-secret-01234")
+	sw.refresh(ctx)
+	if status(first) != http.StatusForbidden || status(second) != http.StatusOK || status(GenerateToken("test")) != http.StatusOK {
+		t.Errorf("tokens after the second rotation: %d %d", status(first), status(second))
+	}
+	if status("garbage") != http.StatusForbidden {
+		t.Error("a malformed token was accepted")
+	}
+
+	// the previous key stops verifying after its grace period
+	keys := *tokenKeys.Load()
+	keys.previousUntil = time.Now().Add(-time.Second)
+	tokenKeys.Store(&keys)
+	if status(second) != http.StatusForbidden || status(GenerateToken("test")) != http.StatusOK {
+		t.Errorf("tokens after the grace period: %d", status(second))
+	}
+
+	// issued tokens expire
+	token, err := tokenKeys.Load().current.Decode(GenerateToken("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := time.Until(token.Expiration()); exp <= tokenLifetime-time.Minute || exp > tokenLifetime {
+		t.Errorf("expiry in %v, want %v", exp, tokenLifetime)
+	}
+	claims := map[string]interface{}{"username": "test"}
+	jwtauth.SetExpiry(claims, time.Now().Add(-time.Minute))
+	_, expired, _ := tokenKeys.Load().current.Encode(claims)
+	if status(expired) != http.StatusForbidden {
+		t.Error("an expired token was accepted")
+	}
+}
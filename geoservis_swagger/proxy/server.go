@@ -7,25 +7,34 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 func (app *application) serve() error {
 	server := &http.Server{
-		Addr:    ":8080",
+		Addr:    app.addr,
 		Handler: app.setupRouter(),
 	}
 
 	shutdownErr := make(chan error)
 
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	app.startJobWorkers(workersCtx)
+
+	go app.reloadOnHangup()
+	if app.secrets != nil {
+		go app.secrets.watch(workersCtx)
+	}
+
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		s := <-sigChan
 
 		app.logger.Info("shutting down", "signal", s.String())
+		stopWorkers()
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), app.shutdownTimeout)
 		defer cancel()
 
 		shutdownErr <- server.Shutdown(ctx)
@@ -46,3 +55,18 @@ func (app *application) serve() error {
 	app.logger.Info("graceful exit", "addr", server.Addr)
 	return nil
 }
+
+// reloadOnHangup rereads the proxy routing table on every SIGHUP. Requests in
+// flight finish on the table they started with.
+func (app *application) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := app.proxy.Reload()
+		if err != nil {
+			app.logger.Error("routing table not reloaded", "error", err.Error())
+			continue
+		}
+		app.logger.Info("routing table reloaded")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// staticEmbedded is the value of RouteConfig.Static that serves the site
+// compiled into the binary.
+const staticEmbedded = "embed"
+
+// embeddedSite is the built Hugo site when the binary is built with the
+// embedsite tag, see static_embed.go.
+var embeddedSite fs.FS
+
+// staticTypes are content types missing from the built-in table of the mime
+// package; the system table varies between images, so these are fixed here.
+var staticTypes = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".svg":         "image/svg+xml",
+	".txt":         "text/plain; charset=utf-8",
+	".webmanifest": "application/manifest+json",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "application/xml",
+}
+
+// precompressed are the encodings whose variants are looked up next to each
+// file, in order of preference.
+var precompressed = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// StaticProxyConfig serves /api and /swagger locally and a built Hugo site in
+// dir, or the embedded one, for everything else.
+func StaticProxyConfig(dir string) *ProxyConfig {
+	return &ProxyConfig{
+		Routes: []RouteConfig{
+			{Prefix: "/api", Local: true},
+			{Prefix: "/swagger", Local: true},
+			{Prefix: "/", Static: dir},
+		},
+	}
+}
+
+// staticSite serves files of a built site.
+type staticSite struct {
+	fsys fs.FS
+	// served with 200 for missing paths without an extension, if set
+	fallback string
+	// content hashes of files without a modification time
+	etags sync.Map
+}
+
+func openStaticSite(dir, fallback string) (*staticSite, error) {
+	if dir == staticEmbedded {
+		if embeddedSite == nil {
+			return nil, errors.New("the binary was built without the embedsite tag")
+		}
+		return &staticSite{fsys: embeddedSite, fallback: fallback}, nil
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &staticSite{fsys: os.DirFS(dir), fallback: fallback}, nil
+}
+
+// staticName turns a URL path into a name in the site, rejecting hidden files.
+func staticName(p string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return ".", true
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// serve answers r with the file at p, a path relative to the site root.
+func (s *staticSite) serve(w http.ResponseWriter, r *http.Request, p string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := staticName(p)
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err == nil && fi.IsDir() {
+		// Hugo links to directories with a trailing slash, relative links
+		// in the page depend on it
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		name = path.Join(name, "index.html")
+		fi, err = fs.Stat(s.fsys, name)
+	}
+	if err != nil || fi.IsDir() {
+		if s.fallback != "" && path.Ext(name) == "" {
+			s.serveFile(w, r, strings.TrimPrefix(s.fallback, "/"), http.StatusOK)
+			return
+		}
+		s.notFound(w, r)
+		return
+	}
+	s.serveFile(w, r, name, http.StatusOK)
+}
+
+// notFound serves the site's 404.html, which Hugo generates, or a plain 404.
+func (s *staticSite) notFound(w http.ResponseWriter, r *http.Request) {
+	if _, err := fs.Stat(s.fsys, "404.html"); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, "404.html", http.StatusNotFound)
+}
+
+// serveFile sends name, or its precompressed variant if the client accepts
+// it, with status. Conditional and range requests are handled for 200s.
+func (s *staticSite) serveFile(w http.ResponseWriter, r *http.Request, name string, status int) {
+	h := w.Header()
+	ctype := staticTypes[path.Ext(name)]
+	if ctype == "" {
+		ctype = mime.TypeByExtension(path.Ext(name))
+	}
+
+	served, encoding := name, ""
+	for _, pc := range precompressed {
+		if _, err := fs.Stat(s.fsys, name+pc.ext); err != nil {
+			continue
+		}
+		h.Set("Vary", "Accept-Encoding")
+		if encoding == "" && acceptsEncoding(r, pc.encoding) {
+			served, encoding = name+pc.ext, pc.encoding
+		}
+	}
+
+	f, err := s.fsys.Open(served)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+	}
+	if ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+
+	if status != http.StatusOK {
+		h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, content)
+		}
+		return
+	}
+	etag, err := s.etag(served, encoding, fi, content)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, served, fi.ModTime(), content)
+}
+
+// etag identifies a file by its modification time and size, or by a hash of
+// its content when it has no modification time, as in an embed.FS. Variants
+// are told apart by their encoding.
+func (s *staticSite) etag(name, encoding string, fi fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if encoding != "" {
+		encoding = "-" + encoding
+	}
+	if !fi.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x%s"`, fi.ModTime().UnixNano(), fi.Size(), encoding), nil
+	}
+	if v, ok := s.etags.Load(name); ok {
+		return v.(string), nil
+	}
+	h := fnv.New64a()
+	_, err := io.Copy(h, content)
+	if err != nil {
+		return "", err
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf(`"%x%s"`, h.Sum64(), encoding)
+	s.etags.Store(name, etag)
+	return etag, nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// encoding, either by name or by *.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	return encodingQuality(r, encoding) > 0
+}
+
+// encodingQuality returns the q-value the Accept-Encoding header of r gives
+// encoding, by name or else by *, and 0 if it isn't acceptable.
+func encodingQuality(r *http.Request, encoding string) float64 {
+	star := 0.0
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case encoding:
+				return q
+			case "*":
+				star = q
+			}
+		}
+	}
+	return star
+}
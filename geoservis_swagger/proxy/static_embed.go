@@ -0,0 +1,18 @@
+//go:build embedsite
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// site is the output of `hugo -d proxy/site`, present only in builds with the
+// embedsite tag.
+//
+//go:embed all:site
+var site embed.FS
+
+func init() {
+	embeddedSite, _ = fs.Sub(site, "site")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testSite(fallback string) *staticSite {
+	mod := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s), ModTime: mod} }
+	return &staticSite{
+		fsys: fstest.MapFS{
+			"index.html":           file("<h1>home</h1>"),
+			"index.html.br":        file("br home"),
+			"index.html.gz":        file("gz home"),
+			"404.html":             file("not here"),
+			"posts/index.html":     file("posts"),
+			"css/main.css":         file("body{}"),
+			"js/app.js":            file("app()"),
+			"fonts/a.woff2":        file("font"),
+			"img/logo.svg":         file("<svg/>"),
+			"data.bin":             file("\x00\x01"),
+			"data.bin.gz":          file("gz data"),
+			".git/config":          file("secret"),
+			"empty/readme.txt":     file("no index"),
+			"site.webmanifest":     file("{}"),
+			"embedded/no-mod.html": {Data: []byte("no modtime")},
+		},
+		fallback: fallback,
+	}
+}
+
+func serveStatic(s *staticSite, method, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.serve(w, r, r.URL.Path)
+	return w
+}
+
+func TestStaticSite_serve(t *testing.T) {
+	s := testSite("")
+	tests := []struct {
+		name, path string
+		header     []string
+		status     int
+		body       string
+		ctype      string
+	}{
+		{"root index", "/", nil, 200, "<h1>home</h1>", "text/html; charset=utf-8"},
+		{"directory index", "/posts/", nil, 200, "posts", "text/html; charset=utf-8"},
+		{"css", "/css/main.css", nil, 200, "body{}", "text/css; charset=utf-8"},
+		{"js", "/js/app.js", nil, 200, "app()", "text/javascript; charset=utf-8"},
+		{"font", "/fonts/a.woff2", nil, 200, "font", "font/woff2"},
+		{"svg", "/img/logo.svg", nil, 200, "<svg/>", "image/svg+xml"},
+		{"manifest", "/site.webmanifest", nil, 200, "{}", "application/manifest+json"},
+		{"brotli preferred", "/", []string{"Accept-Encoding", "gzip, br"}, 200, "br home", "text/html; charset=utf-8"},
+		{"gzip", "/", []string{"Accept-Encoding", "gzip, deflate"}, 200, "gz home", "text/html; charset=utf-8"},
+		{"brotli refused", "/", []string{"Accept-Encoding", "br;q=0, *"}, 200, "gz home", "text/html; charset=utf-8"},
+		{"unknown type compressed", "/data.bin", []string{"Accept-Encoding", "gzip"}, 200, "gz data", "application/octet-stream"},
+		{"missing", "/nope", nil, 404, "not here", "text/html; charset=utf-8"},
+		{"directory without index", "/empty/", nil, 404, "not here", "text/html; charset=utf-8"},
+		{"hidden", "/.git/config", nil, 404, "not here", "text/html; charset=utf-8"},
+		{"traversal", "/css/../../.git/config", nil, 404, "not here", "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveStatic(s, "GET", tt.path, tt.header...)
+			if w.Code != tt.status || w.Body.String() != tt.body || w.Header().Get("Content-Type") != tt.ctype {
+				t.Errorf("got %d %q %q", w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	w := serveStatic(s, "GET", "/", "Accept-Encoding", "br")
+	if w.Header().Get("Content-Encoding") != "br" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("variant headers: %v", w.Header())
+	}
+	if w := serveStatic(s, "GET", "/"); w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("identity headers: %v", w.Header())
+	}
+	if w := serveStatic(s, "GET", "/css/main.css"); w.Header().Get("Vary") != "" {
+		t.Errorf("Vary without variants: %q", w.Header().Get("Vary"))
+	}
+
+	w = serveStatic(s, "GET", "/posts?page=2")
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/posts/?page=2" {
+		t.Errorf("directory redirect: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := serveStatic(s, "POST", "/"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: got %d", w.Code)
+	}
+	if w := serveStatic(s, "HEAD", "/nope"); w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Errorf("HEAD of a missing page: got %d %q", w.Code, w.Body.String())
+	}
+	if w := serveStatic(&staticSite{fsys: fstest.MapFS{}}, "GET", "/nope"); w.Code != http.StatusNotFound {
+		t.Errorf("site without 404.html: got %d", w.Code)
+	}
+}
+
+func TestStaticSite_conditional(t *testing.T) {
+	s := testSite("")
+	for _, path := range []string{"/css/main.css", "/embedded/no-mod.html"} {
+		w := serveStatic(s, "GET", path)
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s: no ETag", path)
+		}
+		if w := serveStatic(s, "GET", path, "If-None-Match", etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s: If-None-Match: got %d", path, w.Code)
+		}
+	}
+	if w := serveStatic(s, "GET", "/css/main.css", "If-Modified-Since", "Thu, 01 Oct 2026 12:00:00 GMT"); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got %d", w.Code)
+	}
+	if w := serveStatic(s, "GET", "/css/main.css", "Range", "bytes=0-3"); w.Code != http.StatusPartialContent || w.Body.String() != "body" {
+		t.Errorf("Range: got %d %q", w.Code, w.Body.String())
+	}
+	br := serveStatic(s, "GET", "/", "Accept-Encoding", "br").Header().Get("ETag")
+	gz := serveStatic(s, "GET", "/", "Accept-Encoding", "gzip").Header().Get("ETag")
+	if br == gz {
+		t.Errorf("variants share the ETag %s", br)
+	}
+}
+
+func TestStaticSite_fallback(t *testing.T) {
+	s := testSite("/index.html")
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/app/settings", 200, "<h1>home</h1>"},
+		{"/posts/", 200, "posts"},
+		{"/js/missing.js", 404, "not here"},
+	}
+	for _, tt := range tests {
+		if w := serveStatic(s, "GET", tt.path); w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: got %d %q", tt.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"br, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*, gzip;q=0", false},
+		{"*;q=0", false},
+		{"deflate", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsEncoding(r, "gzip"); got != tt.want {
+			t.Errorf("%q: got %v", tt.header, got)
+		}
+	}
+}
+
+func TestReverseProxy_static(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"index.html":      "home",
+		"docs/index.html": "docs",
+		"404.html":        "missing",
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644)
+	}
+
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{
+		Routes: []RouteConfig{
+			{Prefix: "/api", Local: true},
+			{Prefix: "/site", Static: dir, StripPrefix: true, ResponseHeaders: map[string]string{"X-Site": "static"}},
+			{Prefix: "/", Static: dir},
+		},
+		Cache: &CacheConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := proxyRouter(rp)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", 200, "home"},
+		{"/docs/", 200, "docs"},
+		{"/site/docs/", 200, "docs"},
+		{"/other", 404, "missing"},
+		{"/api/ping", 200, "local /api/ping"},
+	}
+	for _, tt := range tests {
+		w := do(h, "GET", tt.path)
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: got %d %q", tt.path, w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-Cache") != "" {
+			t.Errorf("%s: static files went through the cache", tt.path)
+		}
+	}
+	if w := do(h, "GET", "/site/"); w.Header().Get("X-Site") != "static" {
+		t.Errorf("response headers: %v", w.Header())
+	}
+	if len(rp.Status()) != 0 {
+		t.Errorf("static routes listed among upstreams: %v", rp.Status())
+	}
+
+	errs := []struct {
+		name string
+		rc   RouteConfig
+		want string
+	}{
+		{"missing dir", RouteConfig{Static: filepath.Join(dir, "nope")}, "no such file"},
+		{"file", RouteConfig{Static: filepath.Join(dir, "index.html")}, "not a directory"},
+		{"static and upstreams", RouteConfig{Static: dir, Upstreams: []string{"http://a"}}, "one of"},
+		{"missing fallback", RouteConfig{Static: dir, Fallback: "/app.html"}, "fallback"},
+		{"relative fallback", RouteConfig{Static: dir, Fallback: "index.html"}, "fallback"},
+		{"fallback without static", RouteConfig{Local: true, Fallback: "/index.html"}, "needs static"},
+		{"embed", RouteConfig{Static: "embed"}, "embedsite"},
+	}
+	for _, tt := range errs {
+		err := rp.Load(&ProxyConfig{Routes: []RouteConfig{tt.rc}})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
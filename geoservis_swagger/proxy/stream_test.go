@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// proxyServer serves a proxy with a single catch-all route to upstream.
+func proxyServer(t *testing.T, upstream string) (*httptest.Server, *ReverseProxy) {
+	t.Helper()
+	rp := newReverseProxy("")
+	err := rp.Load(&ProxyConfig{Routes: []RouteConfig{{Upstreams: []string{upstream}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(proxyRouter(rp))
+	t.Cleanup(func() {
+		srv.Close()
+		rp.Close()
+	})
+	return srv, rp
+}
+
+func TestReverseProxy_websocket(t *testing.T) {
+	var forwardedFor string
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, append([]byte("echo: "), msg...))
+		}
+	}))
+	defer echo.Close()
+	srv, rp := proxyServer(t, echo.URL)
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/livereload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Via") != "1.1 geoservis" {
+		t.Errorf("unexpected handshake %d %v", resp.StatusCode, resp.Header)
+	}
+	if forwardedFor != "127.0.0.1" {
+		t.Errorf("X-Forwarded-For: got %q", forwardedFor)
+	}
+
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprint("reload ", i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "echo: "+msg {
+			t.Errorf("got %q", got)
+		}
+	}
+
+	if active := rp.Status()[0].Upstreams[0].Active; active != 1 {
+		t.Errorf("an open socket should count as active, got %d", active)
+	}
+	conn.Close()
+	waitFor(t, "the socket to be released", func() bool { return rp.Status()[0].Upstreams[0].Active == 0 })
+}
+
+// gatedUpstream writes first, then waits for release before writing last.
+func gatedUpstream(t *testing.T, header http.Header, first, last []byte) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.Write(first)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		w.Write(last)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, release
+}
+
+func TestReverseProxy_streaming(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1 MiB
+	partial := large[:len(large)-1000]
+
+	tests := []struct {
+		name        string
+		header      http.Header
+		first, last []byte
+	}{
+		{
+			name:   "server-sent events",
+			header: http.Header{"Content-Type": {"text/event-stream"}},
+			first:  []byte("event: reload\ndata: {}\n\n"),
+			last:   []byte("event: done\ndata: {}\n\n"),
+		},
+		{
+			name:   "chunked",
+			header: http.Header{"Content-Type": {"application/x-ndjson"}},
+			first:  []byte("{\"index\":0}\n"),
+			last:   []byte("{\"index\":1}\n"),
+		},
+		{
+			// small writes sit in the server's buffers until flushed
+			name: "known length",
+			header: http.Header{
+				"Content-Type":   {"text/html"},
+				"Content-Length": {"26"},
+			},
+			first: []byte("<html><body>"),
+			last:  []byte("</body></html>"),
+		},
+		{
+			name: "large download",
+			header: http.Header{
+				"Content-Type":   {"application/octet-stream"},
+				"Content-Length": {fmt.Sprint(len(partial) + len(large))},
+			},
+			first: partial,
+			last:  large,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, release := gatedUpstream(t, tt.header, tt.first, tt.last)
+			srv, _ := proxyServer(t, upstream.URL)
+
+			// the headers and the first part must arrive while the upstream
+			// is still blocked
+			var body *bufio.Reader
+			got := make([]byte, len(tt.first))
+			done := make(chan error, 1)
+			go func() {
+				resp, err := http.Get(srv.URL + "/stream")
+				if err != nil {
+					done <- err
+					return
+				}
+				t.Cleanup(func() { resp.Body.Close() })
+				body = bufio.NewReader(resp.Body)
+				_, err = io.ReadFull(body, got)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(2 * time.Second):
+				close(release)
+				t.Fatal("the first part was buffered by the proxy")
+			}
+			if !bytes.Equal(got, tt.first) {
+				t.Error("first part corrupted")
+			}
+
+			close(release)
+			rest, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, tt.last) {
+				t.Errorf("last part corrupted, got %d bytes", len(rest))
+			}
+		})
+	}
+}
@@ -2,5 +2,5 @@ package swagger
 
 import "embed"
 
-//go:embed swagger.yaml
+//go:embed swagger.yaml v2.yaml
 var Swaggerfile embed.FS
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// coordPrecision is the number of decimal places kept for coordinates in the
+// v2 contract, about 11 cm at the equator.
+const coordPrecision = 6
+
+// AddressV2 is the v2 address representation with numeric coordinates.
+// Lat and Lon are null when the provider doesn't know the location.
+//
+//swagger:model
+type AddressV2 struct {
+	City   string   `json:"city"`
+	Street string   `json:"street"`
+	House  string   `json:"house"`
+	Lat    *float64 `json:"lat"`
+	Lon    *float64 `json:"lon"`
+	// distance from the reverse geocoding query point
+	Distance *float64 `json:"distance_meters,omitempty"`
+	// zones containing the address, only with zones=true
+	Zones []ZoneRef `json:"zones,omitempty"`
+	// extended fields, only serialized with detail=full
+	*AddressDetails
+}
+
+// swagger:parameters GetAddressByGeocodeV2
+type GeocodeRequestV2 struct {
+	// latitude in degrees, -90..90
+	// example: 55.878
+	Lat *float64 `json:"lat"`
+	// longitude in degrees, -180..180
+	// example: 37.653
+	Lng *float64 `json:"lng"`
+	// search radius in meters, 1..1000 (default 100)
+	RadiusMeters int `json:"radius_meters"`
+	// maximum number of results, 1..20 (default 10)
+	Count int `json:"count"`
+	//Response detail level: "compact" (default) or "full"
+	Detail string `json:"detail"`
+	// include the zones containing each address
+	Zones bool `json:"zones"`
+}
+
+//swagger:model
+type AddressResponseV2 struct {
+	// An array of addresses
+	Addresses []*AddressV2 `json:"addresses"`
+}
+
+// roundCoord rounds a coordinate to coordPrecision decimal places.
+func roundCoord(v float64) float64 {
+	p := math.Pow10(coordPrecision)
+	return math.Round(v*p) / p
+}
+
+// parseCoord parses a v1 string coordinate. Empty or malformed values yield nil.
+func parseCoord(s string) *float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	v = roundCoord(v)
+	return &v
+}
+
+// validateCoords checks that lat and lng are present and in range.
+func validateCoords(lat, lng *float64) error {
+	if lat == nil || lng == nil {
+		return errors.New("lat and lng are required")
+	}
+	if math.IsNaN(*lat) || *lat < -90 || *lat > 90 {
+		return errors.New("lat must be between -90 and 90")
+	}
+	if math.IsNaN(*lng) || *lng < -180 || *lng > 180 {
+		return errors.New("lng must be between -180 and 180")
+	}
+	return nil
+}
+
+// GeocodeRequest converts a validated v2 request into the v1 form used by the
+// providers, rounding the coordinates to coordPrecision.
+func (req *GeocodeRequestV2) GeocodeRequest() GeocodeRequest {
+	format := func(v float64) string {
+		return strconv.FormatFloat(roundCoord(v), 'f', -1, 64)
+	}
+	return GeocodeRequest{
+		GeocodeParams: GeocodeParams{
+			Lat:          format(*req.Lat),
+			Lng:          format(*req.Lng),
+			RadiusMeters: req.RadiusMeters,
+			Count:        req.Count,
+		},
+		Detail: req.Detail,
+		Zones:  req.Zones,
+	}
+}
+
+// V2 converts the address into the v2 representation.
+func (a *Address) V2() *AddressV2 {
+	return &AddressV2{
+		City:           a.City,
+		Street:         a.Street,
+		House:          a.House,
+		Lat:            parseCoord(a.Lat),
+		Lon:            parseCoord(a.Lon),
+		Distance:       a.Distance,
+		Zones:          a.Zones,
+		AddressDetails: a.AddressDetails,
+	}
+}
+
+func toV2(addresses []*Address) []*AddressV2 {
+	res := make([]*AddressV2, len(addresses))
+	for i, a := range addresses {
+		res[i] = a.V2()
+	}
+	return res
+}
+
+func (app *application) writeV2(w http.ResponseWriter, addresses []*Address) {
+	responseJSON, _ := json.Marshal(AddressResponseV2{Addresses: toV2(addresses)})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func (app *application) SearchV2Handler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /address/search GetAddressV2
+	// swagger:operation POST /address/search GetAddressV2
+	//
+	// returns addresses matching the query with numeric coordinates
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// - application/geo+json
+	// parameters:
+	// - name: query
+	//   in: body
+	//   type: string
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: list of addresses
+	//     schema:
+	//         "$ref": "#/definitions/AddressResponseV2"
+	//   '400':
+	//      description: invalid request
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	addresses, geoJSON, ok := app.search(w, r)
+	if !ok {
+		return
+	}
+	if geoJSON {
+		app.writeGeoJSON(w, addresses)
+		return
+	}
+	app.writeV2(w, addresses)
+}
+
+func (app *application) GeocodeV2Handler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /address/geocode GetAddressByGeocodeV2
+	// swagger:operation POST /address/geocode GetAddressByGeocodeV2
+	//
+	// returns addresses near numeric coordinates
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// - application/geo+json
+	// parameters:
+	// - name: lat
+	//   in: body
+	//   type: number
+	//   required: true
+	// - name: lng
+	//   in: body
+	//   type: number
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: list of addresses
+	//     schema:
+	//         "$ref": "#/definitions/AddressResponseV2"
+	//   '400':
+	//      description: missing or out of range coordinates
+	//      schema:
+	//	        type: string
+	//   '500':
+	//        description: internal server error
+	//        schema:
+	//	        type: string
+
+	var req GeocodeRequestV2
+	q := r.URL.Query()
+	if q.Get("lat") != "" || q.Get("lng") != "" {
+		for name, dst := range map[string]**float64{"lat": &req.Lat, "lng": &req.Lng} {
+			v, err := strconv.ParseFloat(q.Get(name), 64)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = &v
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			app.logger.Error(err.Error())
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	err := validateCoords(req.Lat, req.Lng)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v1 := req.GeocodeRequest()
+	if !app.parseGeocodeQuery(w, r, &v1) {
+		return
+	}
+	v1.Zones = v1.Zones || req.Zones
+	if v1.Detail == "" {
+		v1.Detail = req.Detail
+	}
+	if v1.RadiusMeters == 0 {
+		v1.RadiusMeters = req.RadiusMeters
+	}
+	if v1.Count == 0 {
+		v1.Count = req.Count
+	}
+	addresses, geoJSON, ok := app.geocode(w, r, &v1)
+	if !ok {
+		return
+	}
+	if geoJSON {
+		app.writeGeoJSON(w, addresses)
+		return
+	}
+	app.writeV2(w, addresses)
+}
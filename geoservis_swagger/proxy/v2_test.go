@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAddressV2(t *testing.T) {
+	a := (&Address{City: "Москва", Lat: "55.87825571", Lon: "37.6537249"}).V2()
+	if a.Lat == nil || *a.Lat != 55.878256 || a.Lon == nil || *a.Lon != 37.653725 {
+		t.Errorf("wrong coordinates %v, %v", a.Lat, a.Lon)
+	}
+
+	b, _ := json.Marshal((&Address{City: "Москва"}).V2())
+	if !strings.Contains(string(b), `"lat":null`) {
+		t.Errorf("unknown coordinates should be null, got %s", b)
+	}
+}
+
+func TestGeocodeV2Handler(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantLat    string
+	}{
+		{"body", "/api/v2/address/geocode", `{"lat": 55.8782557123, "lng": 37.65372}`, http.StatusOK, "55.878256"},
+		{"query", "/api/v2/address/geocode?lat=55.87&lng=37.65", "", http.StatusOK, "55.87"},
+		{"string coordinate", "/api/v2/address/geocode", `{"lat": "55.87", "lng": 37.65}`, http.StatusBadRequest, ""},
+		{"garbage query", "/api/v2/address/geocode?lat=sdfsfsfsf&lng=37.65", "", http.StatusBadRequest, ""},
+		{"missing lng", "/api/v2/address/geocode", `{"lat": 55.87}`, http.StatusBadRequest, ""},
+		{"lat out of range", "/api/v2/address/geocode", `{"lat": 91, "lng": 37.65}`, http.StatusBadRequest, ""},
+		{"lng out of range", "/api/v2/address/geocode?lat=55&lng=-180.5", "", http.StatusBadRequest, ""},
+		{"NaN", "/api/v2/address/geocode?lat=NaN&lng=37.65", "", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got GeocodeParams
+			app := &application{
+				geo: &MockGeoService{
+					GeoCode_field: func(params GeocodeParams) ([]*Address, error) {
+						got = params
+						return []*Address{{City: "Москва", Lat: "55.87", Lon: "37.65"}}, nil
+					},
+				},
+				logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+			w := httptest.NewRecorder()
+			app.setupRouter().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status code %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got.Lat != tt.wantLat {
+				t.Errorf("provider got lat %q, want %q", got.Lat, tt.wantLat)
+			}
+			var resp AddressResponseV2
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Addresses) != 1 || *resp.Addresses[0].Lat != 55.87 {
+				t.Errorf("wrong response %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSearchV2Handler(t *testing.T) {
+	app := &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+				return []*Address{{City: "Москва", Lat: "55.87", Lon: "37.65"}}, nil
+			},
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/address/search", strings.NewReader(`{"query": "Москва"}`))
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"lat":55.87,"lon":37.65`) {
+		t.Errorf("expected numeric coordinates, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"test/geo"
+	"test/models"
+
+	"github.com/go-chi/chi"
+)
+
+// ZoneRef identifies a zone containing an address.
+type ZoneRef struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// zoneIndex is an immutable snapshot of all zones. It is rebuilt and swapped
+// whenever a zone changes, so lookups never block on writes.
+type zoneIndex struct {
+	tree *geo.RTree
+}
+
+// indexedZone is one polygon of a zone; a MultiPolygon zone has several.
+type indexedZone struct {
+	ref     ZoneRef
+	polygon geo.Polygon
+}
+
+// swagger:parameters CreateZone UpdateZone
+type ZoneRequest struct {
+	// example: Центр
+	Name string `json:"name"`
+	// a GeoJSON Polygon or MultiPolygon
+	Geometry json.RawMessage `json:"geometry"`
+}
+
+// rebuildZones loads every zone from the store into a new index.
+func (app *application) rebuildZones() error {
+	if app.zones == nil {
+		return nil
+	}
+	// a rebuild that listed before a write must not store after the
+	// rebuild that follows it
+	app.zonesMu.Lock()
+	defer app.zonesMu.Unlock()
+	zones, err := app.zones.List()
+	if err != nil {
+		return err
+	}
+
+	var items []geo.RTreeItem
+	for _, z := range zones {
+		polygons, err := geo.ParsePolygons(z.Geometry)
+		if err != nil {
+			// validated on write, so this is a corrupt row
+			app.logger.Error("skipping invalid zone", "id", z.ID, "error", err.Error())
+			continue
+		}
+		for _, pg := range polygons {
+			items = append(items, geo.RTreeItem{
+				Bounds: pg.Bounds(),
+				Value:  &indexedZone{ref: ZoneRef{ID: z.ID, Name: z.Name}, polygon: pg},
+			})
+		}
+	}
+	app.zoneIndex.Store(&zoneIndex{tree: geo.NewRTree(items)})
+	return nil
+}
+
+// zonesAt returns the zones containing p ordered by id.
+func (app *application) zonesAt(p geo.Point) []ZoneRef {
+	idx := app.zoneIndex.Load()
+	if idx == nil {
+		return nil
+	}
+	seen := make(map[int64]bool)
+	var res []ZoneRef
+	for _, v := range idx.tree.Search(p) {
+		z := v.(*indexedZone)
+		if !seen[z.ref.ID] && z.polygon.Contains(p) {
+			seen[z.ref.ID] = true
+			res = append(res, z.ref)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// tagZones fills in the zones of every address that has coordinates.
+func (app *application) tagZones(addresses []*Address) {
+	for _, a := range addresses {
+		lat, err1 := strconv.ParseFloat(a.Lat, 64)
+		lon, err2 := strconv.ParseFloat(a.Lon, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		a.Zones = app.zonesAt(geo.Point{Lat: lat, Lon: lon})
+	}
+}
+
+// parseZonesParam reads the optional zones query parameter into dst.
+func parseZonesParam(r *http.Request, dst *bool) error {
+	v := r.URL.Query().Get("zones")
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return errors.New("Invalid zones")
+	}
+	*dst = b
+	return nil
+}
+
+func (app *application) zoneID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid zone id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func (app *application) zoneError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNoZone) {
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return
+	}
+	app.logger.Error(err.Error())
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// zoneRequest decodes and validates a create or update request body.
+func (app *application) zoneRequest(w http.ResponseWriter, r *http.Request) (*ZoneRequest, bool) {
+	var req ZoneRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return nil, false
+	}
+	_, err = geo.ParsePolygons(req.Geometry)
+	if err != nil {
+		http.Error(w, "Invalid geometry: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// zonesChanged rebuilds the index after a write. The write itself has
+// already succeeded, so a failure is only logged.
+func (app *application) zonesChanged() {
+	err := app.rebuildZones()
+	if err != nil {
+		app.logger.Error("failed to rebuild zone index", "error", err.Error())
+	}
+}
+
+func (app *application) writeZone(w http.ResponseWriter, status int, id int64) {
+	zone, err := app.zones.Get(id)
+	if err != nil {
+		app.zoneError(w, err)
+		return
+	}
+	responseJSON, _ := json.Marshal(zone)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseJSON)
+}
+
+func (app *application) CreateZoneHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route POST /zones CreateZone
+	// swagger:operation POST /zones CreateZone
+	//
+	// creates a zone from a GeoJSON Polygon or MultiPolygon
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: zone
+	//   in: body
+	//   type: object
+	//   required: true
+	// responses:
+	//   '201':
+	//     description: the created zone
+	//     schema:
+	//         "$ref": "#/definitions/Zone"
+	//   '400':
+	//      description: missing name or invalid geometry
+	//      schema:
+	//	        type: string
+
+	req, ok := app.zoneRequest(w, r)
+	if !ok {
+		return
+	}
+	id, err := app.zones.Create(req.Name, req.Geometry)
+	if err != nil {
+		app.zoneError(w, err)
+		return
+	}
+	app.zonesChanged()
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/zones/%d", id))
+	app.writeZone(w, http.StatusCreated, id)
+}
+
+func (app *application) ListZonesHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route GET /zones ListZones
+	// swagger:operation GET /zones ListZones
+	//
+	// lists all zones
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// responses:
+	//   '200':
+	//     description: all zones
+	//     schema:
+	//         type: array
+	//         items:
+	//             "$ref": "#/definitions/Zone"
+
+	zones, err := app.zones.List()
+	if err != nil {
+		app.zoneError(w, err)
+		return
+	}
+	responseJSON, _ := json.Marshal(zones)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func (app *application) GetZoneHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route GET /zones/{id} GetZone
+	// swagger:operation GET /zones/{id} GetZone
+	//
+	// returns a zone
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: integer
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: the zone
+	//     schema:
+	//         "$ref": "#/definitions/Zone"
+	//   '404':
+	//      description: zone not found
+	//      schema:
+	//	        type: string
+
+	id, ok := app.zoneID(w, r)
+	if !ok {
+		return
+	}
+	app.writeZone(w, http.StatusOK, id)
+}
+
+func (app *application) UpdateZoneHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route PUT /zones/{id} UpdateZone
+	// swagger:operation PUT /zones/{id} UpdateZone
+	//
+	// replaces the name and geometry of a zone
+	//
+	//
+	//
+	// ---
+	// produces:
+	// - application/json
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: integer
+	//   required: true
+	// - name: zone
+	//   in: body
+	//   type: object
+	//   required: true
+	// responses:
+	//   '200':
+	//     description: the updated zone
+	//     schema:
+	//         "$ref": "#/definitions/Zone"
+	//   '400':
+	//      description: missing name or invalid geometry
+	//      schema:
+	//	        type: string
+	//   '404':
+	//      description: zone not found
+	//      schema:
+	//	        type: string
+
+	id, ok := app.zoneID(w, r)
+	if !ok {
+		return
+	}
+	req, ok := app.zoneRequest(w, r)
+	if !ok {
+		return
+	}
+	err := app.zones.Update(id, req.Name, req.Geometry)
+	if err != nil {
+		app.zoneError(w, err)
+		return
+	}
+	app.zonesChanged()
+	app.writeZone(w, http.StatusOK, id)
+}
+
+func (app *application) DeleteZoneHandler(w http.ResponseWriter, r *http.Request) {
+	//swagger:route DELETE /zones/{id} DeleteZone
+	// swagger:operation DELETE /zones/{id} DeleteZone
+	//
+	// deletes a zone
+	//
+	//
+	//
+	// ---
+	// parameters:
+	// - name: id
+	//   in: path
+	//   type: integer
+	//   required: true
+	// responses:
+	//   '204':
+	//     description: deleted
+	//   '404':
+	//      description: zone not found
+	//      schema:
+	//	        type: string
+
+	id, ok := app.zoneID(w, r)
+	if !ok {
+		return
+	}
+	err := app.zones.Delete(id)
+	if err != nil {
+		app.zoneError(w, err)
+		return
+	}
+	app.zonesChanged()
+	w.WriteHeader(http.StatusNoContent)
+}
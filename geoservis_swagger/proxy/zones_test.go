@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"test/geo"
+	"test/models"
+	"testing"
+	"time"
+)
+
+const (
+	// roughly the Garden Ring
+	centerZone = `{"name": "Центр", "geometry": {"type": "Polygon", "coordinates": [[[37.58,55.73],[37.66,55.73],[37.66,55.78],[37.58,55.78],[37.58,55.73]]]}}`
+	// everything inside the MKAD ring road, with a second far-away part
+	moscowZone = `{"name": "Москва", "geometry": {"type": "MultiPolygon", "coordinates": [
+		[[[37.36,55.57],[37.84,55.57],[37.84,55.91],[37.36,55.91],[37.36,55.57]]],
+		[[[30,59],[31,59],[31,60],[30,60],[30,59]]]
+	]}}`
+)
+
+func zonesTestApp() *application {
+	return &application{
+		geo: &MockGeoService{
+			AddressSearch_field: func(params SearchParams) ([]*Address, error) {
+				return []*Address{
+					{City: "Москва", Street: "Тверская", Lat: "55.7600", Lon: "37.6100"},
+					{City: "Москва", Street: "Сухонская", Lat: "55.8782", Lon: "37.6537"},
+					{City: "Тверь", Lat: "56.8587", Lon: "35.9176"},
+				}, nil
+			},
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		zones:  &models.ZoneModel{DB: inmemory_DB()},
+	}
+}
+
+func doZones(app *application, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: GenerateToken("test")})
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestZoneHandlers(t *testing.T) {
+	app := zonesTestApp()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"create", http.MethodPost, "/api/v1/zones", centerZone, http.StatusCreated},
+		{"create second", http.MethodPost, "/api/v1/zones", moscowZone, http.StatusCreated},
+		{"missing name", http.MethodPost, "/api/v1/zones", `{"geometry": {"type": "Polygon", "coordinates": [[[0,0],[1,0],[1,1],[0,0]]]}}`, http.StatusBadRequest},
+		{"not a polygon", http.MethodPost, "/api/v1/zones", `{"name": "x", "geometry": {"type": "Point", "coordinates": [0,0]}}`, http.StatusBadRequest},
+		{"get", http.MethodGet, "/api/v1/zones/1", "", http.StatusOK},
+		{"get missing", http.MethodGet, "/api/v1/zones/99", "", http.StatusNotFound},
+		{"bad id", http.MethodGet, "/api/v1/zones/abc", "", http.StatusBadRequest},
+		{"update", http.MethodPut, "/api/v1/zones/1", strings.Replace(centerZone, "Центр", "ЦАО", 1), http.StatusOK},
+		{"update missing", http.MethodPut, "/api/v1/zones/99", centerZone, http.StatusNotFound},
+		{"list", http.MethodGet, "/api/v1/zones", "", http.StatusOK},
+		{"delete", http.MethodDelete, "/api/v1/zones/2", "", http.StatusNoContent},
+		{"delete missing", http.MethodDelete, "/api/v1/zones/2", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doZones(app, tt.method, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status code %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := doZones(app, http.MethodGet, "/api/v1/zones", "")
+	var zones []*models.Zone
+	if err := json.Unmarshal(w.Body.Bytes(), &zones); err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 1 || zones[0].Name != "ЦАО" {
+		t.Errorf("wrong zones after updates %s", w.Body.String())
+	}
+}
+
+func TestZonesInResponses(t *testing.T) {
+	app := zonesTestApp()
+	for _, z := range []string{centerZone, moscowZone} {
+		if w := doZones(app, http.MethodPost, "/api/v1/zones", z); w.Code != http.StatusCreated {
+			t.Fatalf("creating zone: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := doZones(app, http.MethodPost, "/api/v1/address/search?zones=true", `{"query": "Москва"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+	}
+	var resp SearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]ZoneRef{
+		{{ID: 1, Name: "Центр"}, {ID: 2, Name: "Москва"}},
+		{{ID: 2, Name: "Москва"}},
+		nil,
+	}
+	for i, a := range resp.Addresses {
+		if len(a.Zones) != len(want[i]) {
+			t.Errorf("address %d: expected zones %v, got %v", i, want[i], a.Zones)
+			continue
+		}
+		for j := range a.Zones {
+			if a.Zones[j] != want[i][j] {
+				t.Errorf("address %d: expected zones %v, got %v", i, want[i], a.Zones)
+			}
+		}
+	}
+
+	w = doZones(app, http.MethodPost, "/api/v1/address/search", `{"query": "Москва"}`)
+	if strings.Contains(w.Body.String(), `"zones"`) {
+		t.Errorf("zones should only be returned when requested: %s", w.Body.String())
+	}
+
+	w = doZones(app, http.MethodPost, "/api/v1/address/search?zones=maybe", `{"query": "Москва"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for an invalid zones flag but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// deleting a zone drops it from the index
+	doZones(app, http.MethodDelete, "/api/v1/zones/1", "")
+	if got := app.zonesAt(geo.Point{Lat: 55.76, Lon: 37.61}); len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("expected only zone 2 after delete, got %v", got)
+	}
+}
+
+// slowZones holds the first List until release is closed, so a rebuild can be
+// overtaken by a later write.
+type slowZones struct {
+	models.ZoneModelInterface
+	calls   atomic.Int32
+	listed  chan struct{}
+	release chan struct{}
+}
+
+func (s *slowZones) List() ([]*models.Zone, error) {
+	zones, err := s.ZoneModelInterface.List()
+	if s.calls.Add(1) == 1 {
+		close(s.listed)
+		<-s.release
+	}
+	return zones, err
+}
+
+func TestRebuildZones_concurrent(t *testing.T) {
+	app := zonesTestApp()
+	store := &slowZones{ZoneModelInterface: app.zones, listed: make(chan struct{}), release: make(chan struct{})}
+	app.zones = store
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.zonesChanged()
+	}()
+	<-store.listed
+
+	// the first rebuild listed no zones, the second one must win
+	var req ZoneRequest
+	json.Unmarshal([]byte(centerZone), &req)
+	if _, err := store.Create(req.Name, req.Geometry); err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.zonesChanged()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	if zones := app.zonesAt(geo.Point{Lat: 55.76, Lon: 37.61}); len(zones) != 1 {
+		t.Errorf("stale index: got zones %v", zones)
+	}
+}